@@ -0,0 +1,72 @@
+package serpent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BatchResult is the result of running a program with one input of a batch.
+type BatchResult[TResult any] struct {
+	// Index is the zero-based line number of the input in the batch.
+	Index int
+	// Value is the result of the program.
+	Value TResult
+	// Err is the error from running the program with the input, or from reading the batch.
+	Err error
+}
+
+// RunBatchReader runs a [Program] with each line of r as its input, where r holds JSON Lines: one JSON
+// document per line, with each document encoding a TInput. Lines are read and run one at a time on a
+// single worker, so memory use is bounded by the longest line regardless of the size of the batch, and
+// results are sent on the returned channel in input order. Blank lines are skipped but counted in Index.
+//
+// The channel is closed once r is exhausted. If reading r fails, a final result with Index -1 and the
+// read error is sent. Cancelling ctx stops the batch after the line being run, without reading further
+// lines, releases the worker and closes the channel; the caller must otherwise receive from the channel
+// until it is closed.
+func RunBatchReader[TInput, TResult any](ctx context.Context, program Program[TInput, TResult], r io.Reader) (<-chan BatchResult[TResult], error) {
+	exec, err := Load(program)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(chan BatchResult[TResult])
+	go func() {
+		defer close(results)
+		defer exec.Close()
+
+		// send delivers a result, reporting whether the batch should continue.
+		send := func(result BatchResult[TResult]) bool {
+			select {
+			case results <- result:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		reader := bufio.NewReader(r)
+		for index := 0; ctx.Err() == nil; index++ {
+			line, err := reader.ReadBytes('\n')
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				value, runErr := exec.RunJSON(json.RawMessage(line))
+				if !send(BatchResult[TResult]{Index: index, Value: value, Err: runErr}) {
+					return
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				send(BatchResult[TResult]{Index: -1, Err: fmt.Errorf("read batch: %w", err)})
+				return
+			}
+		}
+	}()
+	return results, nil
+}
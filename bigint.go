@@ -0,0 +1,45 @@
+package serpent
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// BigInt is an integer of any size decoded from a result encoded as either a JSON number or, as with
+// [WithBigIntAsString], a JSON string. The value is available as a *big.Int from [BigInt.Big], and as an
+// int64 from the Int64 and IsInt64 methods of the embedded big.Int.
+//
+// Example:
+//
+//	var result struct {
+//		ID serpent.BigInt `json:"id"`
+//	}
+type BigInt struct {
+	big.Int
+}
+
+// UnmarshalJSON decodes an integer from a JSON number or string. A null leaves the value unchanged.
+func (b *BigInt) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	text, err := numberText(data)
+	if err != nil {
+		return err
+	}
+	if _, ok := b.Int.SetString(text, 10); !ok {
+		return fmt.Errorf("invalid integer %s", data)
+	}
+	return nil
+}
+
+// MarshalJSON encodes the integer as a JSON number, which the json module decodes exactly into a Python
+// int.
+func (b BigInt) MarshalJSON() ([]byte, error) {
+	return b.Int.MarshalJSON()
+}
+
+// Big returns the value as a *big.Int, which shares its storage with b.
+func (b *BigInt) Big() *big.Int {
+	return &b.Int
+}
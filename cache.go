@@ -0,0 +1,142 @@
+package serpent
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// cacheKey identifies a cached result by a hash of the program source, as transformed by the function
+// registered with SetCodeTransform, and its JSON input, so that results are not reused across transforms.
+type cacheKey [sha256.Size]byte
+
+// newCacheKey returns the key of the result of running the program with code on input.
+func newCacheKey(code string, input []byte) cacheKey {
+	h := sha256.New()
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(len(code)))
+	h.Write(n[:])
+	h.Write([]byte(code))
+	h.Write(input)
+
+	var key cacheKey
+	h.Sum(key[:0])
+	return key
+}
+
+// cacheEntry is a result held by a resultCache.
+type cacheEntry struct {
+	key    cacheKey
+	result string
+}
+
+// resultCache is an LRU cache of the JSON results of programs which is safe for concurrent use.
+type resultCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[cacheKey]*list.Element
+}
+
+// newResultCache returns a cache which holds up to size results.
+func newResultCache(size int) *resultCache {
+	return &resultCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+// get returns the cached result for key, marking it as the most recently used.
+func (c *resultCache) get(key cacheKey) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).result, true
+}
+
+// add caches result for key, evicting the least recently used result if the cache is full.
+func (c *resultCache) add(key cacheKey, result string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).result = result
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, result: result})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// clear removes every result from the cache.
+func (c *resultCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[cacheKey]*list.Element)
+}
+
+// ClearCache removes every result from the cache of the default pool enabled with [WithCache]. It has no
+// effect when the cache is not enabled.
+func ClearCache() {
+	if cache := defaultCache(); cache != nil {
+		cache.clear()
+	}
+}
+
+// defaultCache returns the result cache of the default pool, or nil if it has none.
+func defaultCache() *resultCache {
+	if checkInit() != nil {
+		return nil
+	}
+	return workerPool.cache
+}
+
+// cacheable reports whether the result of a run with arg can be cached. Inputs encoded with MarshalPython
+// are not JSON, which is checked on arg itself as the input type may be an interface, and Handle results
+// are live objects rather than values.
+func cacheable[TResult any](arg any) bool {
+	_, marshaler := arg.(Marshaler)
+	_, handle := any(*new(TResult)).(Handle)
+	return !marshaler && !handle
+}
+
+// runCached returns the result of running program with the JSON input from the cache, running the program
+// and caching its result on a miss.
+func runCached[TInput, TResult any](cache *resultCache, program Program[TInput, TResult], input []byte) (TResult, error) {
+	key := newCacheKey(transformCode(string(program)), input)
+	result, ok := cache.get(key)
+	if !ok {
+		exec, err := newExecutable(program)
+		if err != nil {
+			return *new(TResult), err
+		}
+		defer exec.Close()
+
+		var info RunInfo
+		if result, err = exec.result(&execContext{input: string(input)}, &info); err != nil {
+			return *new(TResult), err
+		}
+		cache.add(key, result)
+	}
+
+	var value TResult
+	if err := json.Unmarshal([]byte(result), &value); err != nil {
+		return *new(TResult), fmt.Errorf("unmarshal result: %w", err)
+	}
+	return value, nil
+}
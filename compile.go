@@ -0,0 +1,90 @@
+package serpent
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoEntrypoint is returned by [Compile] for a program which neither defines a run() function nor
+// assigns result at module level.
+var ErrNoEntrypoint = errors.New("no entrypoint")
+
+// compileProgram is the program run by Compile. It compiles the code which is executed for the program,
+// reporting syntax errors, and reports the style of the program: "run" if the program's own source binds
+// the name run at module level, whether by a def, an assignment or an import, otherwise "result" if it
+// binds result, and an empty string if it binds neither. The check errs towards finding a
+// binding, so a name bound only inside a nested function or in a branch which is never taken is accepted;
+// names bound dynamically are not seen.
+const compileProgram = `
+import ast
+
+def binds(node, name):
+    for child in ast.walk(node):
+        if isinstance(child, (ast.FunctionDef, ast.AsyncFunctionDef, ast.ClassDef)) and child.name == name:
+            return True
+        if isinstance(child, ast.Name) and child.id == name and isinstance(child.ctx, ast.Store):
+            return True
+        if isinstance(child, (ast.Import, ast.ImportFrom)):
+            for alias in child.names:
+                if alias.name == "*" or (alias.asname or alias.name.split(".")[0]) == name:
+                    return True
+    return False
+
+def run(input):
+    compile(input["code"], "<string>", "exec", dont_inherit=True)
+    body = ast.parse(input["source"]).body
+    for name in ("run", "result"):
+        if any(binds(node, name) for node in body):
+            return name
+    return ""
+`
+
+// compileInput is the input of compileProgram.
+type compileInput struct {
+	Code   string `json:"code"`
+	Source string `json:"source"`
+}
+
+// Compile checks a [Program] without running it, so that mistakes are caught before its first run. The
+// code which would be executed for the program, including any function registered with
+// [SetCodeTransform], is compiled on a worker of the default pool and a SyntaxError is returned as a
+// [PythonError]. A program whose source neither defines run() nor assigns result at module level, as a
+// script run by [LoadScript] does, fails with [ErrNoEntrypoint]. The check is static: a name bound
+// dynamically, such as through globals(), is not found.
+func Compile[TInput, TResult any](program Program[TInput, TResult]) error {
+	_, err := ProgramStyle(program)
+	return err
+}
+
+// Style is the execution model of a program, as reported by [ProgramStyle].
+type Style int
+
+const (
+	// StyleRun is a program which defines a run() function, called with the input by [Run], [Load] and
+	// the other functions which take a [Program].
+	StyleRun Style = iota + 1
+	// StyleResult is a program written in the module-level style, which reads the global input and
+	// assigns the global result, to be run with [LoadScript].
+	StyleResult
+)
+
+// ProgramStyle compiles a [Program] like [Compile] and reports whether it defines a run() function or
+// assigns result at module level, so that a host accepting programs in either style can pick how to run
+// each one. A program which does both is reported as [StyleRun], as that is how [Run] executes it. A
+// program which does neither fails with [ErrNoEntrypoint].
+func ProgramStyle[TInput, TResult any](program Program[TInput, TResult]) (Style, error) {
+	input := compileInput{Code: transformCode(generateCode(program)), Source: transformCode(string(program))}
+
+	style, err := Run(Program[compileInput, string](compileProgram), input)
+	if err != nil {
+		return 0, err
+	}
+	switch style {
+	case "run":
+		return StyleRun, nil
+	case "result":
+		return StyleResult, nil
+	default:
+		return 0, fmt.Errorf("%w: program defines neither run() nor result", ErrNoEntrypoint)
+	}
+}
@@ -0,0 +1,99 @@
+package serpent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"unsafe"
+)
+
+// Python expressions which decompress the input and compress the result of a run made with
+// WithCompression. The input is decoded with loads, the function of the worker's JSON module. The result is
+// compressed at the fastest level, matching gzip.BestSpeed on the Go side.
+const (
+	decompressInputExpr = `loads(__import__("gzip").decompress(data))`
+	compressResultExpr  = `__import__("gzip").compress(s.encode(), 1)`
+)
+
+// compressedContext returns a request which runs the program with the compressed form of the JSON input.
+// The result of the request is compressed and is decompressed with decompressResult.
+func compressedContext(w *worker, input string) (*execContext, error) {
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	io.WriteString(zw, input)
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("compress input: %w", err)
+	}
+
+	data := buf.Bytes()
+	return &execContext{
+		call: func(globals pyObject) (string, error) {
+			return callRunCompressed(w, globals, data)
+		},
+	}, nil
+}
+
+// decompressResult decompresses the result of a request made with compressedContext.
+func decompressResult(result string) (string, error) {
+	zr, err := gzip.NewReader(strings.NewReader(result))
+	if err != nil {
+		return "", fmt.Errorf("decompress result: %w", err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return "", fmt.Errorf("decompress result: %w", err)
+	}
+	return string(data), nil
+}
+
+// callRunCompressed invokes the run function defined in globals with the gzip-compressed JSON input, and
+// returns the gzip-compressed JSON-serialized result.
+func callRunCompressed(w *worker, globals pyObject, data []byte) (string, error) {
+	runfn, err := runFunc(globals)
+	if err != nil {
+		return "", err
+	}
+
+	loadsfn, err := jsonFunc("loads")
+	if err != nil {
+		return "", err
+	}
+	defer py_DecRef(loadsfn)
+
+	compressed, err := newBytes(data)
+	if err != nil {
+		return "", err
+	}
+	input := evalObject(decompressInputExpr, map[string]pyObject{"data": compressed, "loads": loadsfn})
+	py_DecRef(compressed)
+	if input == 0 {
+		return "", fmt.Errorf("%w: %w", ErrInvalidInput, fetchPythonError())
+	}
+	defer py_DecRef(input)
+
+	result, err := invokeRun(w, runfn, input)
+	if err != nil {
+		return "", err
+	}
+	defer py_DecRef(result)
+
+	jsonResult, err := dumpJSONObject(w, result)
+	if err != nil {
+		return "", err
+	}
+	output := evalObject(compressResultExpr, map[string]pyObject{"s": jsonResult})
+	py_DecRef(jsonResult)
+	if output == 0 {
+		return "", fetchPythonError()
+	}
+	defer py_DecRef(output)
+
+	var ptr *byte
+	var size int
+	if pyBytes_AsStringAndSize(output, &ptr, &size) != 0 {
+		return "", fetchPythonError()
+	}
+	return string(unsafe.Slice(ptr, size)), nil
+}
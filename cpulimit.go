@@ -0,0 +1,72 @@
+package serpent
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCPULimitExceeded is returned by runs which used more CPU time than the limit set with
+// [WithCPULimit].
+var ErrCPULimitExceeded = errors.New("CPU limit exceeded")
+
+// cpuLimitInterval is the longest interval between checks of a run's CPU time.
+const cpuLimitInterval = 10 * time.Millisecond
+
+// watchCPU enforces the CPU limit on the request which the worker is about to execute, raising
+// _serpent_go.CPULimitExceeded in the program once its thread has used more than limit. It must be called on
+// the worker's thread while holding the GIL, and the returned function, which stops the watch, must be
+// called there once the request completes.
+func (w *worker) watchCPU(limit time.Duration) (stop func()) {
+	start, ok := threadCPUTime(w.tid)
+	if !ok {
+		return func() {}
+	}
+
+	// finished guards against interrupting a later request, as in stop.
+	var mu sync.Mutex
+	var finished bool
+	done := make(chan struct{})
+	go func() {
+		interval := cpuLimitInterval
+		if limit < interval {
+			interval = limit
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			used, ok := threadCPUTime(w.tid)
+			if !ok {
+				return
+			}
+			if used-start < limit {
+				continue
+			}
+
+			w.withGIL(func() error {
+				mu.Lock()
+				defer mu.Unlock()
+				if finished {
+					return nil
+				}
+				return w.raiseAsync("CPULimitExceeded")
+			})
+			return
+		}
+	}()
+
+	return func() {
+		close(done)
+		mu.Lock()
+		finished = true
+		mu.Unlock()
+		pyThreadState_SetAsyncExc(w.thread, 0)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package serpent
+
+import "time"
+
+// currentThreadID returns 0 on platforms where the CPU time of other threads is not measured.
+func currentThreadID() int {
+	return 0
+}
+
+// threadCPUTime reports that CPU time cannot be measured on platforms other than Linux.
+func threadCPUTime(tid int) (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package serpent
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// cpuClockPerThreadSched is or-ed into the clock id of a thread's CPU-time clock, selecting the
+// per-thread scheduler clock (CPUCLOCK_PERTHREAD_MASK | CPUCLOCK_SCHED).
+const cpuClockPerThreadSched = 6
+
+// currentThreadID returns the kernel id of the calling thread.
+func currentThreadID() int {
+	return syscall.Gettid()
+}
+
+// threadCPUTime returns the CPU time used by the thread with the given kernel id, which must belong to
+// this process.
+func threadCPUTime(tid int) (time.Duration, bool) {
+	clock := ^int32(tid)<<3 | cpuClockPerThreadSched
+	var ts syscall.Timespec
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, uintptr(clock), uintptr(unsafe.Pointer(&ts)), 0)
+	if errno != 0 {
+		return 0, false
+	}
+	return time.Duration(ts.Nano()), true
+}
@@ -0,0 +1,141 @@
+package serpent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/ebitengine/purego"
+)
+
+// py_DumpTracebackThreads writes the traceback of every thread of an interpreter to a file descriptor
+// without taking the GIL, as faulthandler does. It is a private function of CPython which is resolved when
+// a dump is first made, and nil if the library does not export it.
+var (
+	py_DumpTracebackThreads     func(fd int32, interp pyInterpreterState, current pyThreadState) *byte
+	py_DumpTracebackThreadsOnce sync.Once
+)
+
+// startDeadlockDetector starts watching the pool for requests which make no progress for the duration set
+// with WithDeadlockDetector. It is stopped by Shutdown.
+func (p *Pool) startDeadlockDetector() {
+	timeout := p.config.deadlockTimeout
+	p.detectorStop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(timeout / 4)
+		defer ticker.Stop()
+
+		var completed uint64
+		progressed := time.Now()
+		dumped := false
+		for {
+			select {
+			case <-p.detectorStop:
+				return
+			case <-ticker.C:
+			}
+
+			var done uint64
+			var pending int64
+			for _, w := range p.workers {
+				done += w.completed.Load()
+				pending += w.pending.Load()
+			}
+			if done != completed || pending == 0 {
+				completed, progressed, dumped = done, time.Now(), false
+				continue
+			}
+			if stalled := time.Since(progressed); !dumped && stalled >= timeout {
+				p.dumpStacks(stalled, pending)
+				dumped = true
+			}
+		}
+	}()
+}
+
+// dumpStacks writes the state of each worker, the Python traceback of each interpreter and the stacks of
+// all goroutines to the writer set with SetStderr, or to standard error.
+func (p *Pool) dumpStacks(stalled time.Duration, pending int64) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "serpent: no request completed for %v with %d pending\n", stalled.Round(time.Millisecond), pending)
+	for _, w := range p.workers {
+		fmt.Fprintf(&buf, "worker %d: ", w.id)
+		if since := w.busySince.Load(); since != 0 {
+			fmt.Fprintf(&buf, "running a request for %v", time.Since(time.Unix(0, since)).Round(time.Millisecond))
+		} else {
+			buf.WriteString("idle")
+		}
+		fmt.Fprintf(&buf, ", %d pending\n", w.pending.Load())
+	}
+
+	// Workers in the main interpreter share it and its threads, so it is dumped once.
+	dumpedMain := false
+	for _, w := range p.workers {
+		var interp pyInterpreterState
+		if w.interp != 0 {
+			interp = pyThreadState_GetInterpreter(w.interp)
+		} else if dumpedMain {
+			continue
+		} else {
+			dumpedMain = true
+		}
+		fmt.Fprintf(&buf, "\nPython threads of worker %d:\n", w.id)
+		buf.WriteString(dumpTracebacks(interp))
+	}
+
+	stack := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(stack, true)
+		if n < len(stack) {
+			stack = stack[:n]
+			break
+		}
+		stack = make([]byte, 2*len(stack))
+	}
+	buf.WriteString("\nGoroutines:\n\n")
+	buf.Write(stack)
+
+	if sink := stderr.Load(); sink != nil {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		sink.w.Write(buf.Bytes())
+		return
+	}
+	os.Stderr.Write(buf.Bytes())
+}
+
+// dumpTracebacks returns the tracebacks of the threads of interp, or of the main interpreter if interp is
+// 0. The threads are read while they run, so the tracebacks are a best effort.
+func dumpTracebacks(interp pyInterpreterState) string {
+	py_DumpTracebackThreadsOnce.Do(func() {
+		if sym, err := purego.Dlsym(python, "_Py_DumpTracebackThreads"); err == nil {
+			purego.RegisterFunc(&py_DumpTracebackThreads, sym)
+		}
+	})
+	if py_DumpTracebackThreads == nil {
+		return "unavailable: the Python library does not export _Py_DumpTracebackThreads\n"
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Sprintf("unavailable: %v\n", err)
+	}
+	defer r.Close()
+	output := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- data
+	}()
+
+	msg := py_DumpTracebackThreads(int32(w.Fd()), interp, 0)
+	w.Close()
+	data := <-output
+	if msg != nil {
+		data = append(data, fmt.Sprintf("unavailable: %s\n", cString(msg))...)
+	}
+	return string(data)
+}
@@ -0,0 +1,138 @@
+package serpent
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Diagnostics holds what a single run captured for debugging. See [RunDiagnostic].
+type Diagnostics struct {
+	// Stdout is the text the run wrote to sys.stdout.
+	Stdout string
+	// Stderr is the text the run wrote to sys.stderr.
+	Stderr string
+	// Warnings holds the warnings issued by the run, in order.
+	Warnings []Warning
+	// Info describes where the time of the run was spent.
+	Info RunInfo
+}
+
+// Warning is a Python warning issued by a run.
+type Warning struct {
+	// Category is the name of the warning class, such as "DeprecationWarning".
+	Category string
+	// Message is the warning message.
+	Message string
+	// Filename and Lineno locate the code which issued the warning.
+	Filename string
+	Lineno   int
+}
+
+// captureCode adds the helpers which capture the output and warnings of a run to the serpent module of the
+// current interpreter. sys.stdout and sys.stderr are replaced by streams which write to the capture of the
+// calling thread, if it has one, so that runs on workers sharing an interpreter are captured separately
+// and output from other threads is written as before.
+const captureCode = `import _serpent_go as __serpent__
+if not hasattr(__serpent__, "_capture_begin"):
+    exec(r"""
+import _thread, io, sys, warnings
+
+_captures = {}
+
+class _CaptureStream:
+    def __init__(self, stream, index):
+        self._stream, self._index = stream, index
+
+    def write(self, s):
+        capture = _captures.get(_thread.get_ident())
+        if capture is not None:
+            return capture[self._index].write(s)
+        if self._stream is None:
+            return len(s)
+        return self._stream.write(s)
+
+    def flush(self):
+        if _thread.get_ident() not in _captures and self._stream is not None:
+            self._stream.flush()
+
+    def __getattr__(self, name):
+        return getattr(self._stream, name)
+
+def _capture_begin():
+    if not isinstance(sys.stdout, _CaptureStream):
+        sys.stdout = _CaptureStream(sys.stdout, 0)
+    if not isinstance(sys.stderr, _CaptureStream):
+        sys.stderr = _CaptureStream(sys.stderr, 1)
+    record = warnings.catch_warnings(record=True)
+    caught = record.__enter__()
+    warnings.simplefilter("always")
+    _captures[_thread.get_ident()] = (io.StringIO(), io.StringIO(), record, caught)
+
+def _capture_end():
+    out, err, record, caught = _captures.pop(_thread.get_ident())
+    record.__exit__(None, None, None)
+    return __import__("json").dumps({
+        "Stdout": out.getvalue(),
+        "Stderr": err.getvalue(),
+        "Warnings": [
+            {"Category": w.category.__name__, "Message": str(w.message), "Filename": w.filename, "Lineno": w.lineno}
+            for w in caught
+        ],
+    })
+""", __serpent__.__dict__)
+__serpent__._capture_begin()
+`
+
+// runCapture receives the output and warnings captured from a run.
+type runCapture struct {
+	diagnostics Diagnostics
+	err         error
+}
+
+// beginCapture starts capturing the output and warnings of the calling thread. The caller must hold the
+// GIL.
+func beginCapture() error {
+	if err := initWorker(captureCode); err != nil {
+		return fmt.Errorf("capture diagnostics: %w", err)
+	}
+	return nil
+}
+
+// end stops the capture started by beginCapture and records what it captured. The caller must hold the
+// GIL.
+func (c *runCapture) end() {
+	result, ok := evalString(`__import__("_serpent_go")._capture_end()`, nil)
+	if !ok {
+		c.err = fmt.Errorf("capture diagnostics: %w", ErrRunFailed)
+		return
+	}
+	if err := json.Unmarshal([]byte(result), &c.diagnostics); err != nil {
+		c.err = fmt.Errorf("capture diagnostics: %w", err)
+	}
+}
+
+// RunDiagnostic runs a [Program] like [Run] and also returns the [Diagnostics] of the run: the text it
+// wrote to sys.stdout and sys.stderr, the warnings it issued and where its time was spent. This covers
+// both the program's module body and its run() function, so warnings such as a DeprecationWarning raised
+// on import are included. Every warning is recorded, including those the interpreter's filters would show
+// only once or ignore, and none is printed. Output and warnings are captured per run, so concurrent runs
+// do not see each other's. Output written by threads the program starts, or directly to the file
+// descriptors, is not captured.
+//
+// The diagnostics are returned along with the error when the run fails, holding what was captured before
+// the failure.
+func RunDiagnostic[TInput, TResult any](program Program[TInput, TResult], arg TInput) (TResult, Diagnostics, error) {
+	exec, err := newExecutable(program)
+	if err != nil {
+		return *new(TResult), Diagnostics{}, err
+	}
+	defer exec.Close()
+
+	var capture runCapture
+	value, info, err := exec.runWithInfo(arg, true, &capture)
+	capture.diagnostics.Info = info
+	if err == nil {
+		err = capture.err
+	}
+	return value, capture.diagnostics, err
+}
@@ -0,0 +1,53 @@
+package serpent
+
+// PyEnv describes the environment resolved by the embedded interpreter, as reported by the sys module.
+type PyEnv struct {
+	// Executable is sys.executable, which may be empty or the host binary when embedded.
+	Executable string `json:"executable"`
+	// Prefix is sys.prefix, the installation or virtual environment in use.
+	Prefix string `json:"prefix"`
+	// Path is sys.path, the directories searched for modules.
+	Path []string `json:"path"`
+	// Shared reports whether the interpreter was built with libpython as a shared library, as recorded by
+	// the Py_ENABLE_SHARED build variable. It is a best-effort heuristic: a build whose libpython is static
+	// usually builds extension modules which do not link against libpython and rely on the host to
+	// export its symbols, so they can fail to import when embedded, and such builds are less tested with
+	// sub-interpreters. Builds on Windows, which do not record the variable, are always shared.
+	// Distributions which link their python executable statically and package libpython separately, as
+	// Debian does, record the static build, so Shared is false even though a shared library is embedded.
+	Shared bool `json:"shared"`
+	// Library is the LDLIBRARY build variable, the file name of the library built for libpython, such as
+	// "libpython3.12.so" or "libpython3.12.a", or empty where it is not recorded.
+	Library string `json:"library"`
+}
+
+// environmentProgram reports the environment of a worker.
+const environmentProgram = `
+import sys, sysconfig
+
+def run(input):
+    shared = sysconfig.get_config_var("Py_ENABLE_SHARED")
+    return {
+        "executable": sys.executable,
+        "prefix": sys.prefix,
+        "path": sys.path,
+        "shared": bool(shared) if shared is not None else sys.platform == "win32",
+        "library": sysconfig.get_config_var("LDLIBRARY") or "",
+    }
+`
+
+// Environment returns the executable, prefix and module search path resolved by the interpreter, as seen
+// by a worker in the default pool. Resolving these when embedding depends on the library location and the
+// environment, so they are the first thing to check when a program fails with "No module named X", such as
+// when the wrong standard library or virtual environment is picked up. It also reports how libpython was
+// built, which helps to diagnose extension modules which fail to import or misbehave in sub-interpreters,
+// where [InitSingleWorker] may be the better choice. The environment is read afresh on each call, bypassing
+// the cache set with [WithCache], so that changes to sys.path are seen.
+func Environment() (PyEnv, error) {
+	exec, err := newExecutable(Program[*struct{}, PyEnv](environmentProgram))
+	if err != nil {
+		return PyEnv{}, err
+	}
+	defer exec.Close()
+	return exec.Run(nil)
+}
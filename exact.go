@@ -0,0 +1,78 @@
+package serpent
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Rat is an exact rational number decoded from a result encoded as a JSON number or string, such as the
+// fractions.Fraction "1/3" and decimal.Decimal "0.1" encoded with [WithExactNumbers]. Unlike a float64, it
+// holds both exactly. The value is available through the methods of the embedded big.Rat.
+//
+// Example:
+//
+//	const source = "from fractions import Fraction\ndef run(input): return Fraction(1, 3)"
+//	program := serpent.Program[*struct{}, serpent.Rat](source)
+type Rat struct {
+	big.Rat
+}
+
+// UnmarshalJSON decodes a fraction "a/b" or a decimal number, with an optional exponent, from a JSON
+// number or string. A null leaves the value unchanged.
+func (r *Rat) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	text, err := numberText(data)
+	if err != nil {
+		return err
+	}
+	if _, ok := r.Rat.SetString(text); !ok {
+		return fmt.Errorf("invalid rational number %s", data)
+	}
+	return nil
+}
+
+// Float is a floating-point number of arbitrary precision decoded from a result encoded as a JSON number or
+// string, such as the decimal.Decimal "0.1" encoded with [WithExactNumbers]. The precision is chosen so
+// that every significant decimal digit is kept, but a decimal fraction such as 0.1 has no exact binary
+// representation and is rounded to it; use [Rat] for an exact value. The value is available through the
+// methods of the embedded big.Float.
+type Float struct {
+	big.Float
+}
+
+// UnmarshalJSON decodes a decimal number, with an optional exponent, from a JSON number or string. A null
+// leaves the value unchanged.
+func (f *Float) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	text, err := numberText(data)
+	if err != nil {
+		return err
+	}
+	// Each decimal digit needs log2(10) bits, and at least the 53 bits of a float64 are kept.
+	prec := uint(math.Ceil(float64(len(text)) * math.Log2(10)))
+	if prec < 53 {
+		prec = 53
+	}
+	f.Float.SetPrec(prec)
+	if _, _, err := f.Float.Parse(text, 10); err != nil {
+		return fmt.Errorf("invalid decimal number %s", data)
+	}
+	return nil
+}
+
+// numberText returns the text of a JSON number or the contents of a JSON string.
+func numberText(data []byte) (string, error) {
+	text := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &text); err != nil {
+			return "", err
+		}
+	}
+	return text, nil
+}
@@ -0,0 +1,146 @@
+package serpent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// exceptHook holds the function registered with SetExceptHook, if any.
+var exceptHook atomic.Pointer[func(pyErr *PythonError)]
+
+// SetExceptHook registers fn to be called with every unhandled Python exception, for centralized error
+// reporting. This includes the exceptions which fail a run, which are also returned from it, and those
+// which reach sys.excepthook or threading.excepthook in any interpreter, such as an exception raised in a
+// thread started by a program, which may outlive the run that started it and would otherwise only be
+// printed to stderr. The interpreter's own hooks still run after fn is called.
+//
+// fn is called with the type, message and traceback of the exception: for a failed run from the goroutine
+// which made it, and for other exceptions from a single goroutine, one at a time. It must be safe for
+// concurrent use and must not block, as a thread reporting an exception waits for it to be received.
+// Registering a new hook replaces the previous one; a nil fn removes it.
+func SetExceptHook(fn func(pyErr *PythonError)) {
+	if fn == nil {
+		exceptHook.Store(nil)
+		return
+	}
+	exceptHook.Store(&fn)
+}
+
+// reportException calls the hook registered with SetExceptHook, if any, with err if it is a PythonError.
+func reportException(err error) {
+	hook := exceptHook.Load()
+	var pyErr *PythonError
+	if hook == nil || !errors.As(err, &pyErr) {
+		return
+	}
+	(*hook)(pyErr)
+}
+
+// Exceptions are reported by the interpreters through a pipe shared by the process. Writes to a pipe of
+// at most PIPE_BUF bytes, 512 on every supported platform, are not interleaved with other writes, so each
+// report is written in chunks of that size which carry the id of the interpreter which wrote them, along
+// with a flag marking the last chunk, and reassembled by a reader goroutine. Each interpreter writes one
+// report at a time.
+const (
+	exceptChunkHeader = 11 // 8-byte interpreter id, final flag, 2-byte big-endian length
+	exceptChunkSize   = 512 - exceptChunkHeader
+)
+
+// exceptHookCode installs the interpreter's hooks, writing reports to the file descriptor substituted for
+// %[1]d in chunks of up to %[2]d bytes.
+const exceptHookCode = `import _serpent_go as __serpent__
+if not hasattr(__serpent__, "_report_exception"):
+    exec(r"""
+import _thread, json, os, sys, threading, traceback
+_report_lock = _thread.allocate_lock()
+_report_id = os.urandom(8)
+
+def _report_exception(exc_type, e, tb):
+    try:
+        tb = "".join(traceback.format_exception(exc_type, e, tb)).rstrip()
+        if e.__cause__ is None and (e.__context__ is None or e.__suppress_context__):
+            message = str(e)
+        else:
+            message = tb
+        data = json.dumps({"Type": exc_type.__name__, "Message": message, "Traceback": tb}).encode()
+        with _report_lock:
+            for i in range(0, len(data), %[2]d):
+                chunk = data[i:i + %[2]d]
+                final = i + %[2]d >= len(data)
+                os.write(%[1]d, _report_id + bytes([final]) + len(chunk).to_bytes(2, "big") + chunk)
+    except Exception:
+        pass
+
+def _excepthook(exc_type, e, tb, _previous=sys.excepthook):
+    _report_exception(exc_type, e, tb)
+    _previous(exc_type, e, tb)
+
+def _threading_excepthook(args, _previous=threading.excepthook):
+    if args.exc_type is not SystemExit and args.exc_value is not None:
+        _report_exception(args.exc_type, args.exc_value, args.exc_traceback)
+    _previous(args)
+
+sys.excepthook = _excepthook
+threading.excepthook = _threading_excepthook
+""", __serpent__.__dict__)
+`
+
+// exceptPipe is the pipe through which the interpreters report exceptions. The write end is never closed,
+// as it is shared by every interpreter the process creates.
+var exceptPipe struct {
+	once sync.Once
+	w    *os.File
+}
+
+// exceptHookInitCode returns the Python code which installs the exception hooks in an interpreter, or an
+// empty string if the pipe to report them could not be created.
+func exceptHookInitCode() string {
+	exceptPipe.once.Do(func() {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return
+		}
+		exceptPipe.w = w
+		go readExceptions(r)
+	})
+	if exceptPipe.w == nil {
+		return ""
+	}
+	return fmt.Sprintf(exceptHookCode, exceptPipe.w.Fd(), exceptChunkSize)
+}
+
+// readExceptions reassembles the reports written to r and passes them to the hook registered with
+// SetExceptHook.
+func readExceptions(r io.Reader) {
+	br := bufio.NewReader(r)
+	partial := make(map[[8]byte][]byte)
+	var header [exceptChunkHeader]byte
+	for {
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return
+		}
+		var id [8]byte
+		copy(id[:], header[:8])
+		data := append(partial[id], make([]byte, binary.BigEndian.Uint16(header[9:]))...)
+		if _, err := io.ReadFull(br, data[len(partial[id]):]); err != nil {
+			return
+		}
+		if header[8] == 0 {
+			partial[id] = data
+			continue
+		}
+		delete(partial, id)
+
+		pyErr := &PythonError{}
+		if err := json.Unmarshal(data, pyErr); err == nil {
+			reportException(pyErr)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package serpent
+
+import (
+	"fmt"
+	"time"
+)
+
+// workerExitBuffer is the number of exit notifications retained for a reader of NotifyWorkerExit.
+const workerExitBuffer = 16
+
+// workerExits receives a notification for each worker which exits abnormally.
+var workerExits = make(chan WorkerExit, workerExitBuffer)
+
+// WorkerExit describes a worker which exited abnormally.
+type WorkerExit struct {
+	// WorkerID is the identifier of the worker, as reported by InterpreterID and RunInfo.
+	WorkerID int
+	// Err describes why the worker exited. It wraps [ErrWorkerExited].
+	Err error
+}
+
+// NotifyWorkerExit returns a channel which receives a [WorkerExit] whenever a worker exits abnormally, such
+// as when a panic occurs while it executes a request. The worker stays in the pool but is no longer
+// counted by WorkerCount or given new executables, and requests pinned to it fail with [ErrWorkerExited].
+// Workers which stop because of Close are not reported.
+//
+// The channel is buffered and never blocks a worker; when it is full the oldest notification is dropped.
+// A crash of the Python interpreter itself, such as a segmentation fault in a C extension, terminates the
+// process and cannot be reported.
+func NotifyWorkerExit() <-chan WorkerExit {
+	return workerExits
+}
+
+// notifyWorkerExit delivers the exit notification, dropping the oldest pending notification if the
+// channel is full.
+func notifyWorkerExit(exit WorkerExit) {
+	for {
+		select {
+		case workerExits <- exit:
+			return
+		default:
+		}
+
+		select {
+		case <-workerExits:
+		default:
+		}
+	}
+}
+
+// serve executes requests using run until the request channel is closed. If a request panics the worker
+// is marked as exited, the exit is reported and the remaining requests are failed without running.
+func (w *worker) serve(run func(*execContext)) {
+	err := w.serveRequests(run)
+	if err == nil {
+		return
+	}
+
+	w.exited.Store(true)
+	notifyWorkerExit(WorkerExit{WorkerID: w.id, Err: err})
+	for req := range w.requests {
+		req.fail(err)
+	}
+}
+
+// serveRequests executes requests until the request channel is closed, returning an error if a request
+// panics.
+func (w *worker) serveRequests(run func(*execContext)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: worker %d: panic: %v", ErrWorkerExited, w.id, r)
+		}
+	}()
+
+	for req := range w.requests {
+		w.busySince.Store(time.Now().UnixNano())
+		run(req)
+		w.busySince.Store(0)
+		w.completed.Add(1)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package serpent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerServe_Panic(t *testing.T) {
+	w := &worker{id: 7, requests: make(chan *execContext, 2)}
+
+	var mu sync.Mutex
+	pending := &execContext{cond: sync.NewCond(&mu)}
+	w.requests <- &execContext{cond: sync.NewCond(&mu)}
+	w.requests <- pending
+	close(w.requests)
+
+	w.serve(func(*execContext) { panic("boom") })
+
+	if !w.exited.Load() {
+		t.Error("expected worker to be marked as exited")
+	}
+	if !pending.done || !errors.Is(pending.err, ErrWorkerExited) {
+		t.Errorf("expected pending request to fail with ErrWorkerExited; got done: %v, err: %v", pending.done, pending.err)
+	}
+
+	select {
+	case exit := <-NotifyWorkerExit():
+		if exit.WorkerID != 7 || !errors.Is(exit.Err, ErrWorkerExited) {
+			t.Errorf("unexpected exit notification: %+v", exit)
+		}
+	default:
+		t.Error("expected exit notification")
+	}
+}
+
+func TestNotifyWorkerExit_DropsOldest(t *testing.T) {
+	for i := 0; i < workerExitBuffer+2; i++ {
+		notifyWorkerExit(WorkerExit{WorkerID: i})
+	}
+
+	for i := 2; i < workerExitBuffer+2; i++ {
+		if exit := <-NotifyWorkerExit(); exit.WorkerID != i {
+			t.Fatalf("expected worker %d; got: %d", i, exit.WorkerID)
+		}
+	}
+	select {
+	case exit := <-NotifyWorkerExit():
+		t.Errorf("unexpected exit notification: %+v", exit)
+	default:
+	}
+}
+
+func TestPoolPing_SkipsExited(t *testing.T) {
+	w := &worker{id: 3}
+	w.exited.Store(true)
+	pool := &Pool{workers: []*worker{w}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := pool.PingContext(ctx); err != nil {
+		t.Errorf("expected exited worker to be skipped; got: %v", err)
+	}
+}
+
+func TestPoolWarmup_SkipsExited(t *testing.T) {
+	w := &worker{id: 3}
+	w.exited.Store(true)
+	pool := &Pool{workers: []*worker{w}}
+
+	if err := pool.warmup(context.Background(), "def run(input): return input"); err != nil {
+		t.Errorf("expected exited worker to be skipped; got: %v", err)
+	}
+}
@@ -31,13 +31,25 @@ func searchPaths() []string {
 }
 
 // findLib attempts to find a Python shared library on macOS systems.
-// It first tries pkg-config, then falls back to searching common paths.
-func findLib() (string, error) {
-	if path, ok := pkgConfigLibPath(".dylib"); ok {
+// It first searches the active pyenv versions, then tries pkg-config, then falls back to searching common
+// paths, including every installed pyenv version.
+func findLib(cfg *config) (string, error) {
+	if path, ok := searchLib(pyenvPaths(), cfg); ok {
 		return path, nil
 	}
+	if path, ok := pkgConfigLibPath(".dylib", cfg); ok {
+		return path, nil
+	}
+	if path, ok := searchLib(searchPaths(), cfg); ok {
+		return path, nil
+	}
+	return "", ErrLibraryNotFound
+}
 
-	for _, prefix := range searchPaths() {
+// searchLib returns the preferred library in the first directory matching paths, which may be patterns,
+// holding one.
+func searchLib(paths []string, cfg *config) (string, bool) {
+	for _, prefix := range paths {
 		dirMatches, err := filepath.Glob(prefix)
 		if err != nil {
 			continue
@@ -48,10 +60,10 @@ func findLib() (string, error) {
 			if err != nil {
 				continue
 			}
-			if len(matches) > 0 {
-				return preferredVersion(matches), nil
+			if path, ok := preferredVersion(matches, cfg); ok {
+				return path, true
 			}
 		}
 	}
-	return "", ErrLibraryNotFound
+	return "", false
 }
@@ -6,6 +6,6 @@ package serpent
 var platformSupportsSubInterpreters = false
 
 // findLib returns ErrLibraryNotFound on systems which do not support the library search.
-func findLib() (string, error) {
+func findLib(*config) (string, error) {
 	return "", ErrLibraryNotFound
 }
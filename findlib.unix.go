@@ -26,20 +26,31 @@ func searchPaths() []string {
 }
 
 // findLib attempts to find a Python shared library on Unix systems.
-// It first tries pkg-config, then falls back to searching common paths.
-func findLib() (string, error) {
-	if path, ok := pkgConfigLibPath(".so"); ok {
+// It first searches the active pyenv versions, then tries pkg-config, then falls back to searching common
+// paths, including every installed pyenv version.
+func findLib(cfg *config) (string, error) {
+	if path, ok := searchLib(pyenvPaths(), cfg); ok {
 		return path, nil
 	}
+	if path, ok := pkgConfigLibPath(".so", cfg); ok {
+		return path, nil
+	}
+	if path, ok := searchLib(searchPaths(), cfg); ok {
+		return path, nil
+	}
+	return "", ErrLibraryNotFound
+}
 
-	for _, prefix := range searchPaths() {
+// searchLib returns the preferred library in the first of paths, which may be patterns, holding one.
+func searchLib(paths []string, cfg *config) (string, bool) {
+	for _, prefix := range paths {
 		matches, err := filepath.Glob(filepath.Join(prefix, "libpython*.so"))
 		if err != nil {
 			continue
 		}
-		if len(matches) > 0 {
-			return preferredVersion(matches), nil
+		if path, ok := preferredVersion(matches, cfg); ok {
+			return path, true
 		}
 	}
-	return "", ErrLibraryNotFound
+	return "", false
 }
@@ -4,22 +4,92 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 )
 
-// preferredVersion sorts library paths and returns the highest version.
-func preferredVersion(paths []string) string {
-	if len(paths) == 1 {
-		return paths[0]
+// libNamePattern matches the file name of a versioned Python shared library, capturing its version and
+// ABI flags.
+var libNamePattern = regexp.MustCompile(`^libpython(\d+)\.(\d+)([a-z]*)\.`)
+
+// isDebugBuild reports whether the library path names a debug build of Python, identified by the d
+// ABI flag (e.g. libpython3.12d.so).
+func isDebugBuild(path string) bool {
+	m := libNamePattern.FindStringSubmatch(filepath.Base(path))
+	return m != nil && strings.Contains(m[3], "d")
+}
+
+// isFreeThreadedBuild reports whether the library path names a free-threaded build of Python, identified
+// by the t ABI flag (e.g. libpython3.13t.so).
+func isFreeThreadedBuild(path string) bool {
+	m := libNamePattern.FindStringSubmatch(filepath.Base(path))
+	return m != nil && strings.Contains(m[3], "t")
+}
+
+// libVersion returns the major and minor version from the library path, or zeros if the file name is not
+// versioned, such as the libpython3.so stable ABI forwarding library.
+func libVersion(path string) (int, int) {
+	m := libNamePattern.FindStringSubmatch(filepath.Base(path))
+	if m == nil {
+		return 0, 0
 	}
-	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
-	return paths[0]
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return major, minor
+}
+
+// preferredVersion returns the highest version from the library paths. Libraries with a version in their
+// name are preferred over unversioned ones. Debug builds are skipped unless WithDebugBuild is configured,
+// in which case they are preferred over release builds. Free-threaded builds are preferred when
+// WithFreeThreaded is configured and builds with a GIL are preferred otherwise, falling back to the other
+// kind when none of the preferred kind are found.
+func preferredVersion(paths []string, cfg *config) (string, bool) {
+	var release, debugBuilds []string
+	for _, path := range paths {
+		if isDebugBuild(path) {
+			debugBuilds = append(debugBuilds, path)
+		} else {
+			release = append(release, path)
+		}
+	}
+
+	candidates := release
+	if cfg.debugBuild && len(debugBuilds) > 0 {
+		candidates = debugBuilds
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	var preferred []string
+	for _, path := range candidates {
+		if isFreeThreadedBuild(path) == cfg.freeThreaded {
+			preferred = append(preferred, path)
+		}
+	}
+	if len(preferred) > 0 {
+		candidates = preferred
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		imajor, iminor := libVersion(candidates[i])
+		jmajor, jminor := libVersion(candidates[j])
+		if imajor != jmajor {
+			return imajor > jmajor
+		}
+		if iminor != jminor {
+			return iminor > jminor
+		}
+		return candidates[i] > candidates[j]
+	})
+	return candidates[0], true
 }
 
 // pkgConfigLibPath attempts to find the Python library using pkg-config.
 // It tries python3-embed first (for static linking), then python3.
-func pkgConfigLibPath(libExtension string) (string, bool) {
+func pkgConfigLibPath(libExtension string, cfg *config) (string, bool) {
 	libDir, ok := pkgConfigGetLibDir("python3")
 	if !ok {
 		return "", false
@@ -32,7 +102,7 @@ func pkgConfigLibPath(libExtension string) (string, bool) {
 		return "", false
 	}
 
-	return preferredVersion(matches), true
+	return preferredVersion(matches, cfg)
 }
 
 // pkgConfigGetLibDir runs pkg-config --libs and extracts the -L path.
@@ -64,6 +134,64 @@ func pkgConfigGetLibDir(pkg string) (string, bool) {
 	return "", false
 }
 
+// pyenvPaths returns the library directories of the active pyenv versions, in priority order. The active
+// versions are read from PYENV_VERSION, then the nearest .python-version file, then the global version
+// file in the pyenv root, mirroring the resolution performed by pyenv itself. The "system" version has no
+// directory, so when it is the only active version, or none is set, no paths are returned and the system
+// library is found through pkg-config.
+func pyenvPaths() []string {
+	root := os.Getenv("PYENV_ROOT")
+	if root == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		root = filepath.Join(home, ".pyenv")
+	}
+
+	versions := strings.Split(os.Getenv("PYENV_VERSION"), ":")
+	if versions[0] == "" {
+		versions = pyenvVersionFile(root)
+	}
+
+	var paths []string
+	for _, version := range versions {
+		if version == "" || version == "system" {
+			continue
+		}
+		paths = append(paths, filepath.Join(root, "versions", version, "lib"))
+	}
+	return paths
+}
+
+// pyenvVersionFile returns the versions listed in the nearest .python-version file found by walking up
+// from the working directory, or in the global version file in the pyenv root.
+func pyenvVersionFile(root string) []string {
+	var files []string
+	if dir, err := os.Getwd(); err == nil {
+		for {
+			files = append(files, filepath.Join(dir, ".python-version"))
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+	files = append(files, filepath.Join(root, "version"))
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if versions := strings.Fields(string(data)); len(versions) > 0 {
+			return versions
+		}
+	}
+	return nil
+}
+
 // fileExists returns true if the given path exists and is a regular file.
 func fileExists(path string) bool {
 	info, err := os.Stat(path)
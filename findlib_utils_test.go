@@ -0,0 +1,106 @@
+package serpent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPreferredVersion_DebugBuilds(t *testing.T) {
+	paths := []string{
+		"/usr/lib/libpython3.12d.so",
+		"/usr/lib/libpython3.11.so",
+		"/usr/lib/libpython3.12.so",
+		"/usr/lib/libpython3.12dm.so",
+	}
+
+	cases := []struct {
+		name  string
+		paths []string
+		debug bool
+		exp   string
+		ok    bool
+	}{
+		{"Release", paths, false, "/usr/lib/libpython3.12.so", true},
+		{"Debug", paths, true, "/usr/lib/libpython3.12dm.so", true},
+		{"OnlyDebug", []string{"/usr/lib/libpython3.12d.so"}, false, "", false},
+		{"DebugFallback", []string{"/usr/lib/libpython3.12.so"}, true, "/usr/lib/libpython3.12.so", true},
+		{"Numeric", []string{"/usr/lib/libpython3.9.so", "/usr/lib/libpython3.12.so"}, false, "/usr/lib/libpython3.12.so", true},
+		{"StableABI", []string{"/usr/lib/libpython3.so", "/usr/lib/libpython3.11.so"}, false, "/usr/lib/libpython3.11.so", true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path, ok := preferredVersion(append([]string(nil), tc.paths...), &config{debugBuild: tc.debug})
+			if ok != tc.ok || path != tc.exp {
+				t.Errorf("unexpected result: %q, %v; got: %q, %v", tc.exp, tc.ok, path, ok)
+			}
+		})
+	}
+}
+
+func TestPreferredVersion_FreeThreadedBuilds(t *testing.T) {
+	paths := []string{
+		"/usr/lib/libpython3.13t.so",
+		"/usr/lib/libpython3.13.so",
+		"/usr/lib/libpython3.12.so",
+	}
+
+	cases := []struct {
+		name         string
+		paths        []string
+		freeThreaded bool
+		exp          string
+	}{
+		{"GIL", paths, false, "/usr/lib/libpython3.13.so"},
+		{"FreeThreaded", paths, true, "/usr/lib/libpython3.13t.so"},
+		{"OnlyFreeThreaded", []string{"/usr/lib/libpython3.13t.so"}, false, "/usr/lib/libpython3.13t.so"},
+		{"FreeThreadedFallback", []string{"/usr/lib/libpython3.12.so"}, true, "/usr/lib/libpython3.12.so"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path, ok := preferredVersion(append([]string(nil), tc.paths...), &config{freeThreaded: tc.freeThreaded})
+			if !ok || path != tc.exp {
+				t.Errorf("unexpected result: %q; got: %q, %v", tc.exp, path, ok)
+			}
+		})
+	}
+}
+
+func TestPyenvPaths(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("PYENV_ROOT", root)
+	if err := os.WriteFile(filepath.Join(root, "version"), []byte("3.11.9\nsystem\n"), 0o644); err != nil {
+		t.Fatalf("write version: %v", err)
+	}
+
+	t.Run("VersionFile", func(t *testing.T) {
+		t.Setenv("PYENV_VERSION", "")
+		paths := pyenvPaths()
+		exp := []string{filepath.Join(root, "versions/3.11.9/lib")}
+		if !reflect.DeepEqual(paths, exp) {
+			t.Errorf("unexpected paths: %v; got: %v", exp, paths)
+		}
+	})
+
+	t.Run("Environment", func(t *testing.T) {
+		t.Setenv("PYENV_VERSION", "3.12.1:3.10.4")
+		paths := pyenvPaths()
+		exp := []string{
+			filepath.Join(root, "versions/3.12.1/lib"),
+			filepath.Join(root, "versions/3.10.4/lib"),
+		}
+		if !reflect.DeepEqual(paths, exp) {
+			t.Errorf("unexpected paths: %v; got: %v", exp, paths)
+		}
+	})
+
+	t.Run("System", func(t *testing.T) {
+		t.Setenv("PYENV_VERSION", "system")
+		if paths := pyenvPaths(); len(paths) != 0 {
+			t.Errorf("expected no paths for the system version; got: %v", paths)
+		}
+	})
+}
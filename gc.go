@@ -0,0 +1,93 @@
+package serpent
+
+import (
+	"errors"
+	"fmt"
+)
+
+// GCGeneration holds the statistics of one generation of a worker's garbage collector, as reported by
+// gc.get_stats().
+type GCGeneration struct {
+	// Collections is the number of times the generation was collected.
+	Collections int `json:"collections"`
+	// Collected is the number of objects collected in the generation.
+	Collected int `json:"collected"`
+	// Uncollectable is the number of objects found to be uncollectable in the generation.
+	Uncollectable int `json:"uncollectable"`
+}
+
+// WorkerGCStats holds the garbage collector statistics of a worker.
+type WorkerGCStats struct {
+	// WorkerID identifies the worker.
+	WorkerID int `json:"-"`
+	// Enabled reports whether automatic collection is enabled. See [WithGC].
+	Enabled bool `json:"enabled"`
+	// Generations holds the statistics of each generation, youngest first.
+	Generations []GCGeneration `json:"generations"`
+}
+
+// collectGarbageProgram runs a full collection on a worker.
+const collectGarbageProgram = "import gc\ndef run(input): gc.collect()"
+
+// gcStatsProgram reports the garbage collector statistics of a worker.
+const gcStatsProgram = "import gc\ndef run(input): return {'enabled': gc.isenabled(), 'generations': gc.get_stats()}"
+
+// CollectGarbage runs a full garbage collection on every worker of the default pool. See
+// [Pool.CollectGarbage].
+func CollectGarbage() error {
+	if err := checkInit(); err != nil {
+		return err
+	}
+	return workerPool.CollectGarbage()
+}
+
+// CollectGarbage runs gc.collect() on every worker of the pool, waiting for runs already queued on each
+// worker to complete first. Each sub-interpreter has its own garbage collector, so this is the way to
+// collect all of them. Together with [WithGC] it allows automatic collection, which can pause a run at any
+// allocation, to be replaced by collections at times chosen by the host, such as between requests. The
+// returned error joins an error for each worker on which the collection failed.
+func (p *Pool) CollectGarbage() error {
+	if p.closed.Load() {
+		return ErrNotInitialized
+	}
+	_, errs := broadcast(p, Program[*struct{}, struct{}](collectGarbageProgram), nil)
+	return joinWorkerErrors(p, errs)
+}
+
+// GCStats returns the garbage collector statistics of every worker of the default pool. See
+// [Pool.GCStats].
+func GCStats() ([]WorkerGCStats, error) {
+	if err := checkInit(); err != nil {
+		return nil, err
+	}
+	return workerPool.GCStats()
+}
+
+// GCStats returns the garbage collector statistics of every worker of the pool, such as to tune the
+// interval between calls to [Pool.CollectGarbage]. Workers whose statistics could not be read are omitted
+// and reported in the returned error.
+func (p *Pool) GCStats() ([]WorkerGCStats, error) {
+	if p.closed.Load() {
+		return nil, ErrNotInitialized
+	}
+	results, errs := broadcast(p, Program[*struct{}, WorkerGCStats](gcStatsProgram), nil)
+	stats := make([]WorkerGCStats, 0, len(results))
+	for i, result := range results {
+		if errs[i] == nil {
+			result.WorkerID = p.workers[i].id
+			stats = append(stats, result)
+		}
+	}
+	return stats, joinWorkerErrors(p, errs)
+}
+
+// joinWorkerErrors joins the errors returned by broadcast, prefixing each with its worker.
+func joinWorkerErrors(p *Pool, errs []error) error {
+	var joined []error
+	for i, err := range errs {
+		if err != nil {
+			joined = append(joined, fmt.Errorf("worker %d: %w", p.workers[i].id, err))
+		}
+	}
+	return errors.Join(joined...)
+}
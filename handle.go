@@ -0,0 +1,119 @@
+package serpent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrHandleReleased is returned when a [Handle] is used after it has been released.
+var ErrHandleReleased = errors.New("handle released")
+
+// Handle refers to a Python object returned by a program whose result type is Handle, such as a configured
+// predictor function or a partially-applied closure. Rather than being serialized, the object is kept
+// alive in the interpreter of the worker which ran the program, so it can be built once and called many
+// times. The object is released by [Handle.Release], which must be called before [Close]; a Handle which
+// is not released keeps the object alive for the lifetime of the worker.
+//
+// Example Python program for a Program[string, Handle]:
+//
+//	def run(input):
+//	    model = load_model(input)
+//	    return lambda text: model.predict(text)
+type Handle struct {
+	h *handle
+}
+
+// handle holds the state shared by copies of a Handle.
+type handle struct {
+	mu     sync.Mutex
+	worker *worker
+	obj    pyObject
+}
+
+// runHandle runs the program with the input created by newInput and returns a Handle to its result.
+func (e *Executable[TInput, TResult]) runHandle(newInput func() (pyObject, error), info *RunInfo) (Handle, error) {
+	w := e.worker
+	var obj pyObject
+	start := time.Now()
+	_, err := e.dispatch(&execContext{
+		call: func(globals pyObject) (string, error) {
+			runfn, err := runFunc(globals)
+			if err != nil {
+				return "", err
+			}
+			input, err := newInput()
+			if err != nil {
+				return "", err
+			}
+			defer py_DecRef(input)
+
+			obj, err = invokeRun(w, runfn, input)
+			return "", err
+		},
+	})
+	info.PythonDuration = time.Since(start)
+	if err != nil {
+		return Handle{}, err
+	}
+	return Handle{&handle{worker: w, obj: obj}}, nil
+}
+
+// Call calls the Python object with args, each encoded as JSON, and returns the JSON-encoded result. If
+// the object is a coroutine function, the coroutine is run to completion. Calls on a Handle run on the
+// worker which holds its object, one at a time.
+// Once the pool of the worker has been closed, calls fail with [ErrNotInitialized].
+func (h Handle) Call(args ...any) (json.RawMessage, error) {
+	if args == nil {
+		args = []any{}
+	}
+	input, err := json.Marshal(args)
+	if err != nil {
+		return nil, fmt.Errorf("marshal args: %w", err)
+	}
+
+	if h.h == nil {
+		return nil, ErrHandleReleased
+	}
+	h.h.mu.Lock()
+	defer h.h.mu.Unlock()
+	if h.h.obj == 0 {
+		return nil, ErrHandleReleased
+	}
+
+	w, obj := h.h.worker, h.h.obj
+	result, err := w.submit(&execContext{
+		call: func(pyObject) (string, error) {
+			return callObject(w, obj, string(input))
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(result), nil
+}
+
+// Release releases the Python object, after which calls fail with [ErrHandleReleased]. Releasing a
+// Handle more than once has no effect.
+func (h Handle) Release() error {
+	if h.h == nil {
+		return nil
+	}
+	h.h.mu.Lock()
+	defer h.h.mu.Unlock()
+	if h.h.obj == 0 {
+		return nil
+	}
+
+	obj := h.h.obj
+	_, err := h.h.worker.submit(&execContext{
+		call: func(pyObject) (string, error) {
+			py_DecRef(obj)
+			return "", nil
+		},
+	})
+	h.h.obj = 0
+	return err
+}
@@ -0,0 +1,50 @@
+package serpent
+
+// Interrupt interrupts the run of the executable which is executing, if any, by raising
+// _serpent_go.Interrupted, a KeyboardInterrupt, in it, and the run fails with [ErrInterrupted]. Runs of
+// other executables are never interrupted, even in single worker mode where every executable shares the
+// one worker thread: a run of the executable which is still queued behind them is not in flight, and
+// Interrupt has no effect on it. As with [Stop], a program which catches KeyboardInterrupt or is blocked
+// in a call to a C extension is not interrupted until it returns to Python code. The worker remains
+// usable afterwards.
+//
+// Unlike the other methods of an executable, Interrupt may be called while a run is in flight, such as
+// from another goroutine, but not concurrently with Close.
+func (b *executable) Interrupt() error {
+	w, state := b.worker, b.state
+	if w == nil {
+		return ErrNotInitialized
+	}
+	return w.withGIL(func() error {
+		w.runningMu.Lock()
+		defer w.runningMu.Unlock()
+		if w.running != state || w.interrupted {
+			return nil
+		}
+		if err := w.raiseAsync("Interrupted"); err != nil {
+			return err
+		}
+		w.interrupted = true
+		return nil
+	})
+}
+
+// track records state as the executable whose request the worker is executing, so that it can be
+// interrupted. It must be called on the worker's thread while holding the GIL, and the returned function
+// must be called there once the request completes.
+func (w *worker) track(state *execState) (done func()) {
+	w.runningMu.Lock()
+	w.running = state
+	w.runningMu.Unlock()
+
+	return func() {
+		w.runningMu.Lock()
+		defer w.runningMu.Unlock()
+		w.running = nil
+		// An interrupt which was raised after the program returned must not reach a later request.
+		if w.interrupted {
+			pyThreadState_SetAsyncExc(w.thread, 0)
+			w.interrupted = false
+		}
+	}
+}
@@ -2,6 +2,7 @@ package serpent
 
 import (
 	"errors"
+	"fmt"
 	"os"
 )
 
@@ -10,10 +11,37 @@ var ErrLibraryNotFound = errors.New("library not found")
 
 // Lib attempts to find a Python shared library on the system and returns the path if found. If the library
 // cannot be found, ErrLibraryNotFound is returned. If the LIBPYTHON_PATH envrionment variable is set, the value
-// of that environment variable is returned.
-func Lib() (string, error) {
+// of that environment variable is returned. Debug builds of Python are skipped unless [WithDebugBuild] is
+// supplied.
+func Lib(opts ...Option) (string, error) {
 	if path := os.Getenv("LIBPYTHON_PATH"); path != "" {
 		return path, nil
 	}
-	return findLib()
+	return findLib(newConfig(opts))
+}
+
+// InitTry initializes the Python interpreter like [Init] with the first of paths which loads successfully,
+// and returns the path used. Candidates which do not exist or cannot be opened are skipped, so a
+// distribution can list a bundled library ahead of system ones as fallbacks. Once a library has
+// initialized the interpreter, any later failure, such as of its workers, is returned with its path as
+// further libraries cannot be loaded into the process. If serpent is already initialized, no candidate is
+// loaded and an empty path is returned with [ErrAlreadyInitialized]. If no candidate loads, an error
+// wrapping [ErrLibraryNotFound] and the failure of each candidate is returned.
+func InitTry(paths []string, opts ...Option) (string, error) {
+	var errs []error
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err := Init(path, opts...)
+		if errors.Is(err, ErrAlreadyInitialized) {
+			return "", err
+		}
+		if err == nil || python != 0 || workerPool != nil {
+			return path, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", path, err))
+	}
+	return "", fmt.Errorf("%w: %w", ErrLibraryNotFound, errors.Join(errs...))
 }
@@ -0,0 +1,148 @@
+package serpent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// fsModule is a Python module read from an fs.FS, as passed to fsProgramCode.
+type fsModule struct {
+	Source  string `json:"source"`
+	Origin  string `json:"origin"`
+	Package bool   `json:"package"`
+}
+
+// fsProgramCode is the program generated by LoadFSWithModules. It installs a finder for the modules read
+// from the FS ahead of the path-based finder, as sys.path[0] is for a script, so that the modules shadow
+// installed ones of the same name, and then runs the entry program compiled with its own file name so that
+// tracebacks refer to it. A finder is installed once per worker for each distinct set of modules.
+// The verbs are the JSON-encoded modules, the key identifying them, and the entry's source and path.
+const fsProgramCode = `
+def __serpent_install_fs__(modules, key):
+    import importlib.machinery, importlib.util, json, sys
+    for finder in sys.meta_path:
+        if getattr(finder, "serpent_fs_key", None) == key:
+            return
+    modules = json.loads(modules)
+
+    class Finder:
+        serpent_fs_key = key
+
+        def find_spec(self, name, path=None, target=None):
+            module = modules.get(name)
+            if module is None:
+                return None
+            return importlib.util.spec_from_loader(name, self, origin=module["origin"], is_package=module["package"])
+
+        def create_module(self, spec):
+            return None
+
+        def exec_module(self, module):
+            spec = module.__spec__
+            exec(compile(modules[spec.name]["source"], spec.origin, "exec"), module.__dict__)
+
+    index = len(sys.meta_path)
+    if importlib.machinery.PathFinder in sys.meta_path:
+        index = sys.meta_path.index(importlib.machinery.PathFinder)
+    sys.meta_path.insert(index, Finder())
+
+__serpent_install_fs__(%s, %s)
+del __serpent_install_fs__
+exec(compile(%s, %s, "exec"), globals())
+`
+
+// LoadFSWithModules loads the Python program at entry in fsys, such as an [embed.FS], like [Load], making
+// the other .py files in fsys importable by the program so that a multi-file program can be shipped in
+// the Go binary. Modules are named relative to the directory of entry, as they would be for a script run
+// from that directory: with entry "app/main.py", "app/helpers.py" is imported as helpers and
+// "app/pkg/util.py" as pkg.util, with "app/pkg/__init__.py" as the package pkg if it exists. The modules
+// take precedence over installed modules of the same name, and tracebacks refer to them by their paths
+// in fsys. Other files are not readable through the import system.
+//
+// Imported modules are kept in sys.modules of the worker, as for any import, so programs sharing a worker
+// should not load different modules with the same name.
+//
+// Example:
+//
+//	//go:embed python
+//	var programs embed.FS
+//
+//	exec, err := serpent.LoadFSWithModules[string, string](programs, "python/main.py")
+func LoadFSWithModules[TInput, TResult any](fsys fs.FS, entry string) (*Executable[TInput, TResult], error) {
+	code, err := generateFSCode(fsys, entry)
+	if err != nil {
+		return nil, err
+	}
+	return Load(Program[TInput, TResult](code))
+}
+
+// generateFSCode reads the program at entry and the modules alongside it in fsys and returns the code
+// which runs it with the modules importable.
+func generateFSCode(fsys fs.FS, entry string) (string, error) {
+	source, err := fs.ReadFile(fsys, entry)
+	if err != nil {
+		return "", fmt.Errorf("read entry: %w", err)
+	}
+
+	root := path.Dir(entry)
+	modules := map[string]fsModule{}
+	err = fs.WalkDir(fsys, root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == "__pycache__" {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if name == entry || path.Ext(name) != ".py" {
+			return nil
+		}
+
+		rel := strings.TrimSuffix(name, ".py")
+		if root != "." {
+			rel = strings.TrimPrefix(rel, root+"/")
+		}
+		parts := strings.Split(rel, "/")
+		pkg := parts[len(parts)-1] == "__init__"
+		if pkg {
+			parts = parts[:len(parts)-1]
+		}
+		// Directories without an __init__.py are packages, as namespace packages are on sys.path.
+		for i := 1; i < len(parts); i++ {
+			dir := strings.Join(parts[:i], ".")
+			if _, ok := modules[dir]; !ok {
+				modules[dir] = fsModule{Origin: path.Join(root, path.Join(parts[:i]...)), Package: true}
+			}
+		}
+
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		modules[strings.Join(parts, ".")] = fsModule{Source: string(data), Origin: name, Package: pkg}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("read modules: %w", err)
+	}
+
+	encoded, err := json.Marshal(modules)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	// JSON strings are also valid Python string literals.
+	literal := func(s string) string {
+		data, _ := json.Marshal(s)
+		return string(data)
+	}
+	return fmt.Sprintf(fsProgramCode, literal(string(encoded)), literal(hex.EncodeToString(sum[:])),
+		literal(string(source)), literal(entry)), nil
+}
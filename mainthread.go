@@ -0,0 +1,66 @@
+package serpent
+
+import "errors"
+
+// mainThreadWorkers passes the worker of the default pool created by Main to the thread calling Main.
+var mainThreadWorkers = make(chan *worker)
+
+// Main initializes the Python interpreter with a single worker which runs on the calling thread, then
+// calls fn on another goroutine and serves the requests made by fn and the goroutines it starts until fn
+// returns. The default pool is then closed and Main returns. It is for libraries which must run on the
+// process's main thread, such as GUI toolkits on macOS. Programs which only install signal handlers can
+// use [InitSingleWorker] instead, as its worker already runs on Python's main thread.
+//
+// Main must be called from the main goroutine locked to the main thread, which requires calling
+// runtime.LockOSThread from an init function of package main:
+//
+//	func init() {
+//		runtime.LockOSThread()
+//	}
+//
+//	func main() {
+//		err := serpent.Main(lib, func() {
+//			// Use serpent as usual.
+//		})
+//	}
+//
+// As with [InitSingleWorker], programs run one at a time, so runs from concurrent goroutines are queued.
+// Main returns [ErrAlreadyInitialized] if serpent is already initialized, and otherwise the error from
+// initializing or closing the pool.
+func Main(libraryPath string, fn func(), opts ...Option) error {
+	initErr := make(chan error, 1)
+	go func() {
+		initErr <- initDefaultPool(libraryPath, poolMainThread, opts)
+	}()
+
+	var w *worker
+	select {
+	case err := <-initErr:
+		return err
+	case w = <-mainThreadWorkers:
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		if err := <-initErr; err != nil {
+			Close()
+			result <- err
+			return
+		}
+		fn()
+		// fn may have closed the pool itself.
+		if err := Close(); err != nil && !errors.Is(err, ErrNotInitialized) {
+			result <- err
+			return
+		}
+		result <- nil
+	}()
+	startSingleWorker(w)
+	return <-result
+}
+
+// runOnMainThread hands the worker to Main to be run on the main thread.
+func runOnMainThread(w *worker) {
+	w.mainThread = true
+	mainThreadWorkers <- w
+}
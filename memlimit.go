@@ -0,0 +1,50 @@
+package serpent
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrMemoryLimitExceeded is returned by runs which failed with MemoryError while a limit set with
+// [WithMemoryLimit] was in effect.
+var ErrMemoryLimitExceeded = errors.New("memory limit exceeded")
+
+// The address space limit of the process before WithMemoryLimit was applied, restored when the Python
+// runtime is finalized. Guarded by runtimeMu.
+var (
+	savedMemoryLimit uint64
+	memoryLimitSet   bool
+)
+
+// applyMemoryLimit limits the address space of the process to limit bytes. It must be called while
+// holding runtimeMu.
+func applyMemoryLimit(limit int) error {
+	prev, err := setAddressSpaceLimit(uint64(limit))
+	if err != nil {
+		return fmt.Errorf("set memory limit: %w", err)
+	}
+	if !memoryLimitSet {
+		savedMemoryLimit, memoryLimitSet = prev, true
+	}
+	return nil
+}
+
+// restoreMemoryLimit restores the address space limit which the process had before applyMemoryLimit. It
+// must be called while holding runtimeMu.
+func restoreMemoryLimit() {
+	if !memoryLimitSet {
+		return
+	}
+	setAddressSpaceLimit(savedMemoryLimit)
+	memoryLimitSet = false
+}
+
+// memoryLimitError wraps err with ErrMemoryLimitExceeded if it was caused by a program running out of
+// memory under a limit set with WithMemoryLimit.
+func memoryLimitError(cfg *config, err error) error {
+	var pyErr *PythonError
+	if cfg == nil || cfg.memoryLimit <= 0 || !errors.As(err, &pyErr) || pyErr.Type != "MemoryError" {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrMemoryLimitExceeded, err)
+}
@@ -0,0 +1,150 @@
+package serpent
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ModelPool runs a program, such as one serving a machine learning model, as a fixed number of replicas,
+// each with its own copy of the program's module-level state on its own worker, and distributes runs
+// among them in turn. It is safe for concurrent use.
+//
+// Each replica needs its own interpreter, so a pool of more than one replica uses sub-interpreters, which
+// require Python 3.12 or later and extension modules which support them. Extensions which do not, such as
+// many used by the transformers library, fail to import in a sub-interpreter; as the main interpreter
+// cannot be duplicated in one process, such programs can only be served by a single replica, or by one
+// process per replica.
+type ModelPool[TInput, TResult any] struct {
+	pool     *Pool
+	replicas []*replica[TInput, TResult]
+	next     atomic.Uint64
+	inFlight atomic.Int64
+}
+
+// replica is a loaded copy of the program of a ModelPool.
+type replica[TInput, TResult any] struct {
+	worker *worker
+	// mu serializes the runs of exec, which is nil once the pool is closed.
+	mu   sync.Mutex
+	exec *Executable[TInput, TResult]
+}
+
+// InitModelPool creates a pool of n workers independent of the default pool, like [NewPool], and loads
+// program on each of them, running every module body, and so loading every copy of the model, before it
+// returns. With n of 1 the worker runs in the main interpreter when no other pool is running, so that
+// programs using extensions which do not support sub-interpreters can be served; otherwise the workers are
+// sub-interpreters, and [ErrModeUnsupported] is returned if they are not supported.
+//
+// If some replicas fail to start or to load the program, the pool is returned along with the error and
+// runs with the remaining replicas, which are reported by [ModelPool.Capacity]. A returned pool must be
+// closed with [ModelPool.Close].
+func InitModelPool[TInput, TResult any](libraryPath string, n int, program Program[TInput, TResult], opts ...Option) (*ModelPool[TInput, TResult], error) {
+	if n < 1 {
+		return nil, fmt.Errorf("%w: model pool needs at least one replica", ErrInvalidInput)
+	}
+	if err := checkValueResult[TResult](); err != nil {
+		return nil, err
+	}
+
+	mode := poolRequireSubInterpreters
+	if n == 1 {
+		mode = poolSubInterpreters
+	}
+	opts = append(opts[:len(opts):len(opts)], func(c *config) { c.numWorkers = n })
+	pool, initErr := newPool(libraryPath, mode, opts)
+	if pool == nil {
+		return nil, initErr
+	}
+
+	replicas := make([]*replica[TInput, TResult], len(pool.workers))
+	errs := make([]error, len(pool.workers))
+	var wg sync.WaitGroup
+	for i, w := range pool.workers {
+		wg.Add(1)
+		go func(i int, w *worker) {
+			defer wg.Done()
+			exec := &Executable[TInput, TResult]{executable: executable{code: string(program), pool: pool}}
+			exec.pinTo(w)
+			if err := exec.load(); err != nil {
+				errs[i] = fmt.Errorf("replica %d: %w", w.id, err)
+				return
+			}
+			replicas[i] = &replica[TInput, TResult]{worker: w, exec: exec}
+		}(i, w)
+	}
+	wg.Wait()
+
+	m := &ModelPool[TInput, TResult]{pool: pool}
+	for _, r := range replicas {
+		if r != nil {
+			m.replicas = append(m.replicas, r)
+		}
+	}
+	err := errors.Join(append([]error{initErr}, errs...)...)
+	if len(m.replicas) == 0 {
+		pool.Shutdown()
+		return nil, fmt.Errorf("all replicas failed to load: %w", err)
+	}
+	return m, err
+}
+
+// Run runs the program with arg on the next replica in turn, skipping replicas whose worker has exited.
+// Runs on a replica which is busy wait for it, so at most [ModelPool.Capacity] runs execute at once.
+func (m *ModelPool[TInput, TResult]) Run(arg TInput) (TResult, error) {
+	if m.pool.closed.Load() {
+		return *new(TResult), ErrNotInitialized
+	}
+	m.inFlight.Add(1)
+	defer m.inFlight.Add(-1)
+
+	r := m.replicas[(m.next.Add(1)-1)%uint64(len(m.replicas))]
+	for i := 1; i < len(m.replicas) && r.worker.exited.Load(); i++ {
+		r = m.replicas[(m.next.Add(1)-1)%uint64(len(m.replicas))]
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.exec == nil {
+		return *new(TResult), ErrNotInitialized
+	}
+	return r.exec.Run(arg)
+}
+
+// Capacity returns the number of replicas serving runs, which is the number of runs the pool executes at
+// once. It is lower than requested when replicas failed to load, and 0 once the pool is closed.
+func (m *ModelPool[TInput, TResult]) Capacity() int {
+	if m.pool.closed.Load() {
+		return 0
+	}
+	var n int
+	for _, r := range m.replicas {
+		if !r.worker.exited.Load() {
+			n++
+		}
+	}
+	return n
+}
+
+// InFlight returns the number of runs which are executing or waiting for a replica. Compared with
+// [ModelPool.Capacity] it shows how close the pool is to saturation.
+func (m *ModelPool[TInput, TResult]) InFlight() int {
+	return int(m.inFlight.Load())
+}
+
+// Close releases the replicas and shuts down their pool, waiting for runs in progress to complete.
+// Closing a pool more than once returns [ErrNotInitialized].
+func (m *ModelPool[TInput, TResult]) Close() error {
+	if m.pool.closed.Load() {
+		return ErrNotInitialized
+	}
+	for _, r := range m.replicas {
+		r.mu.Lock()
+		if r.exec != nil {
+			r.exec.Close()
+			r.exec = nil
+		}
+		r.mu.Unlock()
+	}
+	return m.pool.Shutdown()
+}
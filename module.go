@@ -0,0 +1,56 @@
+package serpent
+
+// serpentModuleCode creates the _serpent_go module, which provides helpers to programs. It is named so as
+// not to shadow the serpent package on PyPI, which libraries such as Pyro depend on.
+//
+//   - should_stop() reports whether [Stop] has asked the running program to stop. Workers on free-threaded
+//     builds share one interpreter and its modules, so stop requests are recorded per thread.
+//   - Interrupted is the KeyboardInterrupt raised in a program by [Stop], [Executable.Interrupt] and, with
+//     [WithInstallSignalHandlers], SIGINT. Only it fails a run with [ErrInterrupted], so a KeyboardInterrupt
+//     raised by the program itself is reported as a [PythonError].
+//   - CPULimitExceeded is raised in a program which exceeds the limit set with [WithCPULimit]. It derives
+//     from BaseException so that it is not caught by handlers for Exception.
+//   - parse_datetime(value) converts an RFC 3339 timestamp, such as a time.Time in the input, to a
+//     datetime. Go writes fractions of up to nine digits and "Z" for UTC, which datetime.fromisoformat
+//     only accepts from Python 3.11, so the value is normalized first.
+const serpentModuleCode = `import sys
+if "_serpent_go" not in sys.modules:
+    _serpent = type(sys)("_serpent_go")
+    exec(r"""
+import _thread
+_stopping = set()
+
+def should_stop():
+    return _thread.get_ident() in _stopping
+
+class Interrupted(KeyboardInterrupt):
+    pass
+
+def _sigint(signum, frame):
+    raise Interrupted
+
+class CPULimitExceeded(BaseException):
+    pass
+
+def parse_datetime(value):
+    import datetime, re
+    if value[-1:] in ("Z", "z"):
+        value = value[:-1] + "+00:00"
+    value = re.sub(r"\.(\d+)", lambda m: "." + (m.group(1) + "000000")[:6], value, count=1)
+    return datetime.datetime.fromisoformat(value)
+""", _serpent.__dict__)
+    sys.modules["_serpent_go"] = _serpent
+`
+
+// raiseAsync raises the exception class of the _serpent_go module named by name in the worker's thread, to
+// interrupt the program it is running. It must be called while holding the GIL of the worker's
+// interpreter.
+func (w *worker) raiseAsync(name string) error {
+	exc := evalObject(`__import__("_serpent_go").`+name, nil)
+	if exc == 0 {
+		return fetchPythonError()
+	}
+	pyThreadState_SetAsyncExc(w.thread, exc)
+	py_DecRef(exc)
+	return nil
+}
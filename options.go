@@ -0,0 +1,502 @@
+package serpent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ebitengine/purego"
+)
+
+// Option configures the Python interpreter initialized by [Init] or [InitSingleWorker], or the library
+// search performed by [Lib].
+type Option func(*config)
+
+// config holds the settings applied to the Python interpreter and its workers.
+type config struct {
+	faulthandler    bool
+	sortKeys        bool
+	ensureASCII     bool
+	debugBuild      bool
+	freeThreaded    bool
+	daemonThreads   bool
+	eventLoop       bool
+	optimize        int
+	maxResultBytes  int
+	maxSourceBytes  int
+	pipeBufferSize  int
+	compression     bool
+	cpuLimit        time.Duration
+	memoryLimit     int
+	initTimeout     time.Duration
+	deadlockTimeout time.Duration
+	cacheSize       int
+	isolated        bool
+	gcDisabled      bool
+	noBytecode      bool
+	jsonModule      string
+	bigIntAsString  bool
+	exactNumbers    bool
+	namedTuples     bool
+	signalHandlers  bool
+	workdir         string
+	dlopenFlags     int
+	programName     string
+	threadEnv       map[string]string
+	stdin           io.Reader
+	// stdinFile is the read end of the pipe fed from stdin, opened when the pool is created.
+	stdinFile *os.File
+	// numWorkers is the number of workers of a pool of sub-interpreters, or 0 for one per CPU. It is set
+	// by InitModelPool.
+	numWorkers int
+}
+
+// newConfig returns a config with the supplied options applied.
+func newConfig(opts []Option) *config {
+	cfg := &config{
+		ensureASCII:    true,
+		optimize:       -1,
+		maxSourceBytes: defaultMaxSourceBytes,
+		dlopenFlags:    purego.RTLD_NOW | purego.RTLD_GLOBAL,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// WithFaulthandler enables Python's faulthandler module so that a fatal error, such as a segmentation
+// fault in a C extension module, prints the Python traceback of the crashing thread to stderr. This does
+// not prevent the crash; the process still terminates, but the output helps diagnose where the crash
+// originated. faulthandler is enabled for the whole process by the pool which initializes the interpreter;
+// the option has no effect on pools added later with [NewPool].
+func WithFaulthandler() Option {
+	return func(c *config) {
+		c.faulthandler = true
+	}
+}
+
+// WithSortKeys controls whether the keys of objects in results are sorted when serialized to JSON.
+// Sorting gives deterministic output for caching and golden-file comparisons. The default is false.
+func WithSortKeys(sortKeys bool) Option {
+	return func(c *config) {
+		c.sortKeys = sortKeys
+	}
+}
+
+// WithEnsureASCII controls whether non-ASCII characters in results are escaped when serialized to
+// JSON. Disabling escaping reduces the size of results containing large amounts of UTF-8 text. The
+// default is true.
+func WithEnsureASCII(ensureASCII bool) Option {
+	return func(c *config) {
+		c.ensureASCII = ensureASCII
+	}
+}
+
+// WithDebugBuild makes [Lib] prefer debug builds of Python (libraries with the d ABI flag, such as
+// libpython3.12d.so), which are otherwise skipped as loading one in place of a release build can crash.
+func WithDebugBuild() Option {
+	return func(c *config) {
+		c.debugBuild = true
+	}
+}
+
+// WithFreeThreaded selects free-threaded builds of Python 3.13 and later, which run without a GIL. [Lib]
+// prefers free-threaded libraries (those with the t ABI flag, such as libpython3.13t.so) when this option
+// is supplied and release builds with a GIL otherwise. When the library passed to [Init] or [NewPool] is a
+// free-threaded build, the workers run on their own threads in a single interpreter instead of in
+// sub-interpreters, so programs run truly in parallel while sharing module state; as with threads in any
+// Python program, such state must be safe for concurrent use. Other builds fall back to sub-interpreters.
+func WithFreeThreaded() Option {
+	return func(c *config) {
+		c.freeThreaded = true
+	}
+}
+
+// WithDaemonThreads allows programs to start daemon threads in sub-interpreters, which is otherwise
+// disallowed. Libraries such as torch start background daemon threads when imported and fail with
+// [ErrDaemonThreadsDisabled] unless this option is supplied. Daemon threads still running when a worker
+// shuts down are abandoned. The option has no effect in single worker mode, where daemon threads are
+// always allowed.
+func WithDaemonThreads() Option {
+	return func(c *config) {
+		c.daemonThreads = true
+	}
+}
+
+// WithEventLoop makes each worker keep a single asyncio event loop on which the coroutines returned by
+// async def run functions are run, instead of creating a new event loop for every run with asyncio.run.
+// This avoids the cost of creating a loop per run and allows libraries to keep loop-bound resources,
+// such as pooled connections, between runs.
+func WithEventLoop() Option {
+	return func(c *config) {
+		c.eventLoop = true
+	}
+}
+
+// WithThreadEnv sets environment variables in each worker before any program is loaded. It is intended
+// for variables such as OMP_NUM_THREADS and MKL_NUM_THREADS, which native libraries like numpy and torch
+// read when imported to size their thread pools. Each worker imports its own copy of such libraries, so
+// N workers each starting M threads oversubscribe the CPU; setting the thread count to roughly
+// runtime.NumCPU() divided by the number of workers avoids this. The variables are set for the whole
+// process.
+func WithThreadEnv(env map[string]string) Option {
+	return func(c *config) {
+		if c.threadEnv == nil {
+			c.threadEnv = make(map[string]string, len(env))
+		}
+		for k, v := range env {
+			c.threadEnv[k] = v
+		}
+	}
+}
+
+// WithOptimize sets the optimization level at which programs are compiled, as for the optimize argument of
+// Python's compile(). Level 1 removes assert statements and code conditional on __debug__, which is
+// compiled as False; level 2 also removes docstrings, so [Executable.Metadata] no longer reports them. The
+// default of -1 uses the optimization level of the interpreter.
+func WithOptimize(level int) Option {
+	return func(c *config) {
+		c.optimize = level
+	}
+}
+
+// WithMaxResultBytes limits the size of the JSON-serialized result of a program to n bytes. Larger
+// results fail with [ErrResultTooLarge] without being copied out of the interpreter, protecting the host
+// from programs which produce runaway results. Output written by writer and pipe programs is not
+// limited. The default of 0 disables the limit.
+func WithMaxResultBytes(n int) Option {
+	return func(c *config) {
+		c.maxResultBytes = n
+	}
+}
+
+// defaultMaxSourceBytes is the default limit on the size of the source of a program.
+const defaultMaxSourceBytes = 64 << 20
+
+// WithMaxSourceBytes limits the size of the source executed for a program, after any transform registered
+// with [SetCodeTransform], to n bytes. Larger programs fail to load with [ErrSourceTooLarge] before they
+// are compiled. Programs this large are usually built by formatting data into their code, which the
+// parser handles slowly and with a great deal of memory; such data should be passed as the program's
+// input instead. The default is 64 MiB, and n of 0 or less disables the limit.
+func WithMaxSourceBytes(n int) Option {
+	return func(c *config) {
+		c.maxSourceBytes = n
+	}
+}
+
+// WithPipeBufferSize sets the capacity of the pipes used by writer and pipe programs to size bytes,
+// which can improve the throughput of programs writing large amounts of output. Pipes are resized with
+// F_SETPIPE_SZ on Linux, where unprivileged processes are limited to /proc/sys/fs/pipe-max-size; the
+// option has no effect on other platforms. The default of 0 uses the operating system's default size.
+func WithPipeBufferSize(size int) Option {
+	return func(c *config) {
+		c.pipeBufferSize = size
+	}
+}
+
+// WithCompression compresses the JSON input and result of each run with gzip as they cross between Go
+// and Python, decompressing them on the other side. It reduces the size of large, repetitive payloads
+// while they are passed, at the cost of CPU time and of buffers for compressing them, so it is only worth
+// enabling for inputs and results of many megabytes. It applies to [Run], [RunJSON] and their
+// [Executable] methods, other than for inputs which implement [Marshaler]. Compressing the input is
+// included in the PythonDuration of [RunInfo], and decompressing the result in its UnmarshalDuration.
+func WithCompression() Option {
+	return func(c *config) {
+		c.compression = true
+	}
+}
+
+// WithCPULimit limits the CPU time which each run may use on its worker's thread. A program which exceeds
+// the limit is interrupted by raising _serpent_go.CPULimitExceeded in it, and the run fails with
+// [ErrCPULimitExceeded]; the worker remains usable. Unlike a wall-clock timeout, time spent waiting, such
+// as in time.sleep or on I/O, does not count towards the limit, nor does CPU time used by other threads
+// the program starts. The limit is checked every 10ms, and a program blocked in a call to a C extension
+// is not interrupted until it returns to Python code. Limits are only enforced on Linux, where the CPU
+// time of each thread can be measured; setrlimit is not used as RLIMIT_CPU applies to the whole process.
+func WithCPULimit(d time.Duration) Option {
+	return func(c *config) {
+		c.cpuLimit = d
+	}
+}
+
+// WithMemoryLimit limits the address space of the process to limit bytes by setting RLIMIT_AS when the
+// pool is created, so a program which allocates without bound fails with MemoryError rather than
+// exhausting the memory of the host. Such runs fail with [ErrMemoryLimitExceeded] and the worker remains
+// usable. The limit applies to the whole process, not to each worker: it covers the Go runtime, the
+// stacks of every thread and all workers together, and a Go allocation which exceeds it is fatal, so the
+// limit must leave room for the host. It also counts address space which is reserved but not used, which
+// some libraries reserve generously. The previous limit is restored when the last pool is shut down.
+// Limits are only enforced on Linux.
+func WithMemoryLimit(limit int) Option {
+	return func(c *config) {
+		c.memoryLimit = limit
+	}
+}
+
+// WithInitTimeout limits how long each worker may take to initialize when a pool starts a worker per CPU,
+// such as a worker stuck importing a module which hangs on a network fetch. A worker which does not
+// become ready within d is abandoned and reported with [ErrInitTimeout], and initialization continues
+// with the remaining workers, as it does for workers which fail. An abandoned worker is stopped once it
+// finishes initializing. Shutting down its pool waits for it for up to d again; a worker still
+// initializing then is leaked, and the interpreter, which cannot be finalized while it runs, is left
+// running, as described for [Pool.Shutdown]. By default workers are waited for indefinitely. The option
+// does not apply to a single worker, which has no other worker to continue with.
+func WithInitTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.initTimeout = d
+	}
+}
+
+// WithDeadlockDetector starts a watchdog which reports the pool as stuck when requests are pending but
+// none completes for d, such as when a worker holding the GIL blocks on a Go channel waiting for another
+// worker which needs the GIL to proceed. The report lists whether each worker is running a request and
+// how many requests it has pending, the Python traceback of each thread of each worker's interpreter and
+// the stacks of all goroutines, and is written to the writer set with [SetStderr] or, if none is set, to
+// standard error. It is written once per stall, and again only after a request has completed. The
+// Python tracebacks are read without the GIL, as faulthandler reads them, and are a best effort.
+//
+// This is a debugging aid: a single request which legitimately runs for longer than d is also reported.
+func WithDeadlockDetector(d time.Duration) Option {
+	return func(c *config) {
+		c.deadlockTimeout = d
+	}
+}
+
+// WithInstallSignalHandlers controls whether Python installs its signal handlers when the interpreter is
+// initialized, as the initsigs argument of Py_InitializeEx does. The default is false, which leaves signal
+// handling to Go, as embedding requires. When enabled, SIGINT raises KeyboardInterrupt in the program running
+// on the thread which initialized the interpreter, which is the worker in single worker mode and the main
+// thread with [Main], failing its run with [ErrInterrupted]; programs in sub-interpreters never receive it.
+// SIGPIPE and SIGXFSZ are also ignored.
+//
+// Enabling the handlers conflicts with the Go runtime's own handling of these signals: Go no longer sees
+// SIGINT, so signal.Notify for it stops receiving and Ctrl-C no longer terminates the process, and writes
+// to a closed pipe fail with EPIPE rather than terminating it. The option only applies to the pool which
+// initializes the interpreter and has no effect with [AttachExisting].
+func WithInstallSignalHandlers(install bool) Option {
+	return func(c *config) {
+		c.signalHandlers = install
+	}
+}
+
+// WithCache caches the results of up to size runs, keyed by a hash of the program source and the JSON
+// input, so that repeated runs of a program with the same input return the cached result without
+// dispatching to a worker; the least recently used result is evicted when the cache is full. Only [Run]
+// and [RunJSON] use the cache, and only for inputs encoded as JSON: programs loaded with [Load] keep
+// state between runs, and programs returning a [Writer], [Pipe] or [Handle] produce no value to cache.
+// Programs run with the cache must be pure, as a cached result is returned regardless of side effects,
+// time or randomness. Use [ClearCache] to discard cached results, such as after changing data a program
+// reads. Failed runs are not cached. The option only applies to the default pool.
+func WithCache(size int) Option {
+	return func(c *config) {
+		c.cacheSize = size
+	}
+}
+
+// WithIsolated initializes the interpreter in isolated mode, as the -I command line flag does, so that
+// programs are not influenced by the environment of the host. In isolated mode PYTHON* environment
+// variables such as PYTHONPATH, PYTHONHOME and PYTHONDONTWRITEBYTECODE are ignored, the user site-packages
+// directory is not added to sys.path and the current directory is never added to sys.path. The locale and
+// C standard streams are also left as the host configured them, and UTF-8 mode is not enabled, so files
+// opened without an encoding use the encoding of the host's locale. The library must be able to locate its
+// standard library without PYTHONHOME. The option only applies to the pool which initializes the
+// interpreter and has no effect with [AttachExisting].
+func WithIsolated() Option {
+	return func(c *config) {
+		c.isolated = true
+	}
+}
+
+// WithGC enables or disables automatic garbage collection in each worker, which is enabled by default.
+// Automatic collection can pause a run at any allocation, so latency-sensitive hosts can disable it and
+// collect at times of their choosing with [CollectGarbage], such as between requests; reference counting
+// still frees objects which are not part of reference cycles. In single worker mode and on free-threaded
+// builds the workers share the main interpreter and its collector, which an interpreter attached with
+// [AttachExisting] also shares with the host.
+func WithGC(enabled bool) Option {
+	return func(c *config) {
+		c.gcDisabled = !enabled
+	}
+}
+
+// WithJSONModule sets the module which encodes the input and result of each run, such as "orjson" or
+// "ujson", in place of the json module of the standard library, which is slow for large payloads. If the
+// module cannot be imported by a worker, the json module is used. orjson is adapted to the interface of
+// the json module; other modules must provide loads and a dumps accepting its sort_keys, ensure_ascii,
+// allow_nan and default keyword arguments, as ujson and simplejson do. The output of the modules differs
+// in whitespace and escaping, as orjson never escapes non-ASCII characters, and orjson serializes types
+// such as dataclasses and datetimes itself. NaN and infinite floats fail with [ErrResultNotSerializable]
+// whichever module is used. In single worker mode and on free-threaded builds the module is set for the
+// shared main interpreter.
+func WithJSONModule(name string) Option {
+	return func(c *config) {
+		c.jsonModule = name
+	}
+}
+
+// WithBigIntAsString encodes the integers in results whose magnitude exceeds 2^53-1, such as 64-bit IDs and
+// the results of exact arithmetic, as JSON strings. Such integers cannot be represented exactly by a
+// float64, so decoders which use one, including encoding/json decoding into an interface{} and JavaScript,
+// silently round them. Integers within the range, and the keys of dicts, are encoded as usual, so a field
+// holding one may be either a number or a string; decode it into a [BigInt]. Integers are found in dicts,
+// lists, tuples and dataclasses, and not in other values returned by the default serializer or the JSON
+// module.
+func WithBigIntAsString() Option {
+	return func(c *config) {
+		c.bigIntAsString = true
+	}
+}
+
+// WithNamedTuplesAsObjects encodes NamedTuples in results as JSON objects keyed by their field names, as
+// dataclasses are, rather than as arrays. The json module of the standard library encodes every tuple as
+// an array, so each result is first walked to convert them, which adds to the time spent encoding large
+// results. JSON modules which do not encode tuple subclasses themselves, such as orjson, pass NamedTuples
+// to the default serializer, which encodes them as objects without this option.
+func WithNamedTuplesAsObjects() Option {
+	return func(c *config) {
+		c.namedTuples = true
+	}
+}
+
+// WithExactNumbers encodes the fractions.Fraction and decimal.Decimal values in results as JSON strings,
+// such as "1/3" and "0.1", which the json module otherwise fails to serialize and which a float would
+// round. Decode them into a [Rat], which holds either exactly, or a [Float]. Decimal NaN and infinities
+// fail with [ErrResultNotSerializable], as NaN and infinite floats do.
+func WithExactNumbers() Option {
+	return func(c *config) {
+		c.exactNumbers = true
+	}
+}
+
+// WithWorkdir sets the working directory of each worker to dir, so that programs which open files by relative
+// paths find them in a predictable place. On Linux each worker thread is given its own working directory,
+// which threads started by programs share, so the working directory of the host and of other pools is
+// unchanged; with [Main] this includes the main thread. Such a thread can no longer run other goroutines, so
+// once the pool is shut down the thread of each worker is kept idle rather than returned to the Go runtime.
+// On other platforms threads cannot have their own working directory and the directory of the whole process
+// is changed, which affects the host and every pool, so pools must not set different directories. Programs
+// which change the directory themselves change it for later runs on their worker.
+func WithWorkdir(dir string) Option {
+	return func(c *config) {
+		c.workdir = dir
+	}
+}
+
+// WithNoBytecode sets sys.dont_write_bytecode in each worker so that imports do not write .pyc files, as
+// PYTHONDONTWRITEBYTECODE does, avoiding the warnings and errors from writing them on read-only
+// filesystems such as those of containers. Existing .pyc files are still read. In single worker mode and
+// on free-threaded builds the setting applies to the main interpreter, which an interpreter attached with
+// [AttachExisting] shares with the host.
+func WithNoBytecode() Option {
+	return func(c *config) {
+		c.noBytecode = true
+	}
+}
+
+// WithDlopenFlags sets the flags with which the Python library is opened, in place of the default
+// RTLD_NOW|RTLD_GLOBAL. RTLD_GLOBAL is the default because C extension modules are often not linked
+// against libpython and resolve its symbols from the global namespace, so they fail to import when the
+// library is opened with RTLD_LOCAL. Embedders whose other libraries clash with Python's symbols can
+// choose RTLD_LOCAL, or add RTLD_DEEPBIND (0x8 on Linux), provided their extension modules link
+// libpython. The values of the flags differ between platforms; use the constants from purego.
+func WithDlopenFlags(flags int) Option {
+	return func(c *config) {
+		c.dlopenFlags = flags
+	}
+}
+
+// WithProgramName sets sys.argv[0] to name in each worker, for libraries which read the program name for
+// logging. Each worker is given a non-empty sys.argv, which is [""] by default, so that code reading
+// sys.argv[0] does not fail in an embedded interpreter. A program name set by the host for
+// [AttachExisting] is kept.
+func WithProgramName(name string) Option {
+	return func(c *config) {
+		c.programName = name
+	}
+}
+
+// WithStdin rebinds sys.stdin in each worker to read from r, so that programs which call input() or read
+// sys.stdin can be driven by the host rather than reading the process's standard input. Reaching the end
+// of r is seen by programs as the end of the file, on which input() raises EOFError.
+//
+// r is copied into a pipe shared by the workers of the pool. Each worker buffers what it reads, so input is
+// divided between workers in unspecified chunks; programs which read sequential input should be run with
+// [InitSingleWorker] or on a single [Executable].
+func WithStdin(r io.Reader) Option {
+	return func(c *config) {
+		c.stdin = r
+	}
+}
+
+// openStdin starts copying the reader set by WithStdin into a pipe, whose read end is bound to sys.stdin
+// by workerInitCode. The copy stops at the end of the reader or once the read end is closed.
+func (c *config) openStdin() error {
+	if c.stdin == nil {
+		return nil
+	}
+
+	r, w, err := newPipe(c)
+	if err != nil {
+		return fmt.Errorf("stdin pipe: %w", err)
+	}
+	go func() {
+		defer w.Close()
+		io.Copy(w, c.stdin)
+	}()
+	c.stdinFile = r
+	return nil
+}
+
+// closeStdin closes the read end of the stdin pipe.
+func (c *config) closeStdin() {
+	if c.stdinFile != nil {
+		c.stdinFile.Close()
+	}
+}
+
+// mainInitCode returns the Python code to run once in the main interpreter. faulthandler is enabled for
+// the whole process and cannot be imported in sub-interpreters, so it is enabled here rather than in
+// each worker.
+func (c *config) mainInitCode() string {
+	if c.faulthandler {
+		return "import faulthandler\nfaulthandler.enable()\n"
+	}
+	return ""
+}
+
+// workerInitCode returns the Python code to run in each worker after its interpreter is created.
+func (c *config) workerInitCode() string {
+	var builder strings.Builder
+	builder.WriteString(serpentModuleCode)
+	builder.WriteString(exceptHookInitCode())
+	// An embedded interpreter may start with an empty sys.argv, which breaks code reading sys.argv[0].
+	name, _ := json.Marshal(c.programName)
+	builder.WriteString("import sys\nif not sys.argv:\n    sys.argv = ['']\nif not sys.argv[0]:\n    sys.argv[0] = ")
+	builder.Write(name)
+	builder.WriteString("\n")
+	if c.stdinFile != nil {
+		fmt.Fprintf(&builder, "sys.stdin = open(%d, encoding='utf-8', closefd=False)\n", c.stdinFile.Fd())
+	}
+	if c.jsonModule != "" && c.jsonModule != "json" {
+		name, _ := json.Marshal(c.jsonModule)
+		fmt.Fprintf(&builder, jsonModuleCode, name)
+	}
+	if c.noBytecode {
+		builder.WriteString("sys.dont_write_bytecode = True\n")
+	}
+	if c.gcDisabled {
+		builder.WriteString("import gc\ngc.disable()\n")
+	}
+	if len(c.threadEnv) > 0 {
+		// A JSON object of strings is also a valid Python dict literal.
+		env, _ := json.Marshal(c.threadEnv)
+		builder.WriteString("import os\nos.environ.update(")
+		builder.Write(env)
+		builder.WriteString(")\n")
+	}
+	return builder.String()
+}
@@ -0,0 +1,37 @@
+package serpent
+
+// PackageInfo describes a distribution package installed in the interpreter, as reported by
+// importlib.metadata.
+type PackageInfo struct {
+	// Name is the name of the distribution, such as "torch".
+	Name string `json:"name"`
+	// Version is the installed version of the distribution.
+	Version string `json:"version"`
+}
+
+// packagesProgram lists the installed distributions. A distribution found more than once on sys.path is
+// reported once, with the version which is imported.
+const packagesProgram = `
+import importlib.metadata
+
+def run(input):
+    packages = {}
+    for dist in importlib.metadata.distributions():
+        name = dist.metadata["Name"]
+        if name and name.lower() not in packages:
+            packages[name.lower()] = {"name": name, "version": dist.version}
+    return sorted(packages.values(), key=lambda p: p["name"].lower())
+`
+
+// Packages returns the distribution packages installed in the interpreter, sorted by name, so that a host
+// can check that the dependencies of its programs, such as transformers or torch, are present before
+// loading them. The packages are those found on sys.path of a worker in the default pool. The list is read
+// afresh on each call, bypassing the cache set with [WithCache], so that packages installed since are seen.
+func Packages() ([]PackageInfo, error) {
+	exec, err := newExecutable(Program[*struct{}, []PackageInfo](packagesProgram))
+	if err != nil {
+		return nil, err
+	}
+	defer exec.Close()
+	return exec.Run(nil)
+}
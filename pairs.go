@@ -0,0 +1,76 @@
+package serpent
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+)
+
+// Pairs is a map which is encoded as a list of [key, value] pairs rather than as a JSON object. JSON
+// object keys are strings, so a map[int]string input arrives in Python with keys such as "1" rather than
+// 1; as Pairs, it arrives as a list from which dict() rebuilds the map with keys of their own type:
+//
+//	program := serpent.Program[serpent.Pairs[int, string], map[int]string](`
+//	def run(input):
+//	    names = dict(input)
+//	    return {id: name.upper() for id, name in names.items()}
+//	`)
+//	result, err := serpent.Run(program, serpent.Pairs[int, string](names))
+//
+// Results need no conversion, as encoding/json decodes the string keys of an object into a map with
+// integer keys, but a Pairs result decodes either a list of pairs, such as list(d.items()), or an object.
+type Pairs[K comparable, V any] map[K]V
+
+// MarshalJSON implements json.Marshaler. The pairs are ordered by their encoded keys, so that equal maps
+// are encoded identically as they are by encoding/json.
+func (p Pairs[K, V]) MarshalJSON() ([]byte, error) {
+	pairs := make([][2]json.RawMessage, 0, len(p))
+	for k, v := range p {
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, [2]json.RawMessage{key, value})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return bytes.Compare(pairs[i][0], pairs[j][0]) < 0 })
+	return json.Marshal(pairs)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, decoding a list of [key, value] pairs or an object.
+func (p *Pairs[K, V]) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var m map[K]V
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*p = m
+		return nil
+	}
+
+	var raw [][2]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw == nil {
+		*p = nil
+		return nil
+	}
+	m := make(map[K]V, len(raw))
+	for _, pair := range raw {
+		var k K
+		var v V
+		if err := json.Unmarshal(pair[0], &k); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(pair[1], &v); err != nil {
+			return err
+		}
+		m[k] = v
+	}
+	*p = m
+	return nil
+}
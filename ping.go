@@ -0,0 +1,95 @@
+package serpent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// pingTimeout is how long Ping waits for every worker to respond.
+const pingTimeout = time.Second
+
+// pingProgram is the program run by Ping on each worker.
+const pingProgram = "def run(input): return 1"
+
+// ErrPingTimeout is returned by [Ping] for workers which did not respond in time.
+var ErrPingTimeout = errors.New("ping timed out")
+
+// Ping checks that every worker of the default pool responds within one second. See [Pool.Ping].
+func Ping() error {
+	if err := checkInit(); err != nil {
+		return err
+	}
+	return workerPool.Ping()
+}
+
+// PingContext checks that every worker of the default pool responds before ctx is done. See
+// [Pool.PingContext].
+func PingContext(ctx context.Context) error {
+	if err := checkInit(); err != nil {
+		return err
+	}
+	return workerPool.PingContext(ctx)
+}
+
+// Ping checks that every worker of the pool responds within one second, as described by
+// [Pool.PingContext].
+func (p *Pool) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	return p.PingContext(ctx)
+}
+
+// PingContext checks that every worker of the pool is alive and responsive by running a trivial program on
+// each of them, exercising the same dispatch and execution path as [Run]. Workers which fail or have not
+// responded when ctx is done, such as a worker busy with a long-running program, are reported in the
+// returned error, which joins an error per failed worker wrapping [ErrPingTimeout] or the failure. Pings
+// which have not started when ctx is done are abandoned. Workers which have exited are skipped, as they no
+// longer serve requests; see [NotifyWorkerExit].
+func (p *Pool) PingContext(ctx context.Context) error {
+	if p.closed.Load() {
+		return ErrNotInitialized
+	}
+
+	type result struct {
+		id  int
+		err error
+	}
+	abort := make(chan struct{})
+	results := make(chan result, len(p.workers))
+	pending := make(map[int]bool, len(p.workers))
+	for _, w := range p.workers {
+		if w.exited.Load() {
+			continue
+		}
+		pending[w.id] = true
+		go func(w *worker) {
+			exec := &executable{code: pingProgram}
+			exec.pinTo(w)
+			defer exec.Close()
+			_, err := exec.dispatch(&execContext{abort: abort, input: "null"})
+			results <- result{w.id, err}
+		}(w)
+	}
+
+	var errs []error
+	for len(pending) > 0 {
+		select {
+		case r := <-results:
+			delete(pending, r.id)
+			if r.err != nil {
+				errs = append(errs, fmt.Errorf("worker %d: %w", r.id, r.err))
+			}
+		case <-ctx.Done():
+			close(abort)
+			for _, w := range p.workers {
+				if pending[w.id] {
+					errs = append(errs, fmt.Errorf("worker %d: %w", w.id, ErrPingTimeout))
+				}
+			}
+			return errors.Join(errs...)
+		}
+	}
+	return errors.Join(errs...)
+}
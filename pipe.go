@@ -0,0 +1,10 @@
+//go:build !linux
+
+package serpent
+
+import "os"
+
+// setPipeSize is a no-op on platforms which do not support resizing pipes.
+func setPipeSize(f *os.File, size int) error {
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build linux
+
+package serpent
+
+import (
+	"os"
+	"syscall"
+)
+
+// fSetPipeSize is the fcntl command which sets the capacity of a pipe (F_SETPIPE_SZ).
+const fSetPipeSize = 1031
+
+// setPipeSize sets the capacity of the pipe to at least size bytes.
+func setPipeSize(f *os.File, size int) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), fSetPipeSize, uintptr(size))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
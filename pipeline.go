@@ -0,0 +1,112 @@
+package serpent
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Pipeline runs several programs in order on one worker, passing the result of each stage's run()
+// function to the next as a Python object rather than encoding it as JSON, so that large intermediate
+// values such as tensors stay in the interpreter between stages. Only the input of the first stage and
+// the result of the last are encoded as JSON. Like an [Executable], each stage keeps its module-level
+// state between runs, and a Pipeline is not safe for concurrent use.
+//
+// Example:
+//
+//	pipeline, err := serpent.LoadPipeline[string, string](tokenize, embed, classify)
+type Pipeline[TInput, TResult any] struct {
+	stages []*executable
+}
+
+// LoadPipeline loads the programs as the stages of a [Pipeline], pinning them to a single worker of the
+// default pool and running each module body there before returning. The input and result types of the
+// stages are not checked; the first stage's run() receives the decoded TInput and the last stage's result
+// is decoded into TResult. A program whose module body fails is reported with its zero-based stage.
+func LoadPipeline[TInput, TResult any](stages ...Program[any, any]) (*Pipeline[TInput, TResult], error) {
+	if err := checkInit(); err != nil {
+		return nil, err
+	}
+	if len(stages) == 0 {
+		return nil, fmt.Errorf("%w: pipeline has no stages", ErrInvalidInput)
+	}
+
+	p := &Pipeline[TInput, TResult]{}
+	for i, program := range stages {
+		stage := &executable{code: string(program), pool: workerPool}
+		if i > 0 {
+			stage.pinTo(p.stages[0].worker)
+		}
+		if err := stage.load(); err != nil {
+			p.Close()
+			return nil, fmt.Errorf("stage %d: %w", i, err)
+		}
+		p.stages = append(p.stages, stage)
+	}
+	return p, nil
+}
+
+// Run runs the stages in order with arg as the input of the first and returns the result of the last.
+// An error raised by a stage is reported with its zero-based index and the later stages are not run.
+func (p *Pipeline[TInput, TResult]) Run(arg TInput) (TResult, error) {
+	if len(p.stages) == 0 {
+		return *new(TResult), ErrNotInitialized
+	}
+
+	var newInput func() (pyObject, error)
+	if m, ok := any(arg).(Marshaler); ok {
+		data, err := m.MarshalPython()
+		if err != nil {
+			return *new(TResult), fmt.Errorf("marshal input: %w", err)
+		}
+		newInput = func() (pyObject, error) { return newBytes(data) }
+	} else {
+		input, err := json.Marshal(arg)
+		if err != nil {
+			return *new(TResult), fmt.Errorf("marshal input: %w", err)
+		}
+		newInput = func() (pyObject, error) { return loadJSON(string(input)) }
+	}
+
+	w := p.stages[0].worker
+	result, err := p.stages[0].dispatch(&execContext{
+		call: func(pyObject) (string, error) {
+			value, err := newInput()
+			if err != nil {
+				return "", err
+			}
+			for i, stage := range p.stages {
+				runfn, err := runFunc(stage.state.globals)
+				if err != nil {
+					py_DecRef(value)
+					return "", fmt.Errorf("stage %d: %w", i, err)
+				}
+				next, err := invokeRun(w, runfn, value)
+				py_DecRef(value)
+				if err != nil {
+					return "", fmt.Errorf("stage %d: %w", i, err)
+				}
+				value = next
+			}
+			defer py_DecRef(value)
+			return dumpJSON(w, value)
+		},
+	})
+	if err != nil {
+		return *new(TResult), err
+	}
+
+	var value TResult
+	if err := json.Unmarshal([]byte(result), &value); err != nil {
+		return *new(TResult), fmt.Errorf("unmarshal result: %w", err)
+	}
+	return value, nil
+}
+
+// Close releases the module-level state of every stage. The pipeline must not be used afterwards.
+func (p *Pipeline[TInput, TResult]) Close() error {
+	for _, stage := range p.stages {
+		stage.Close()
+	}
+	p.stages = nil
+	return nil
+}
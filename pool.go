@@ -0,0 +1,338 @@
+package serpent
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pool is a set of workers which run Python programs. The package-level functions, such as [Run] and
+// [Load], use the default pool created by [Init]. Additional pools created with [NewPool] run alongside
+// it with their own workers and sub-interpreters, so a process can host several sets of programs, such
+// as independent model sets, which are started and shut down separately.
+type Pool struct {
+	workers []*worker
+	config  *config
+	next    atomic.Uint64
+	closed  atomic.Bool
+	// cache holds the results of runs when enabled with WithCache.
+	cache *resultCache
+	// abandoned holds the workers which did not initialize within the timeout set with WithInitTimeout.
+	abandoned []*worker
+	// detectorStop stops the deadlock detector started for WithDeadlockDetector.
+	detectorStop chan struct{}
+}
+
+// poolMode selects how the workers of a pool are created.
+type poolMode int
+
+const (
+	// poolSubInterpreters uses a sub-interpreter per CPU when supported, and a single worker otherwise.
+	poolSubInterpreters poolMode = iota
+	// poolSingleWorker uses a single worker in the main interpreter.
+	poolSingleWorker
+	// poolAttached uses a single worker in an interpreter initialized by the host.
+	poolAttached
+	// poolMainThread uses a single worker in the main interpreter which is run by Main.
+	poolMainThread
+	// poolRequireSubInterpreters uses a sub-interpreter per CPU, failing when they are not supported.
+	poolRequireSubInterpreters
+	// poolRequireFreeThreaded uses a worker per CPU sharing the main interpreter of a free-threaded build,
+	// failing with other builds.
+	poolRequireFreeThreaded
+)
+
+// workerPool is the default pool used by the package-level functions.
+var workerPool *Pool
+
+// The Python runtime is shared by every pool in the process. It is initialized by the first pool and
+// finalized when the last pool is shut down.
+var (
+	runtimeMu      sync.Mutex
+	runtimePools   int
+	runtimeLibrary string
+	// runtimeFreeThreaded reports whether the running interpreter is a free-threaded build.
+	runtimeFreeThreaded bool
+	mainStop            chan struct{}
+	mainDone            chan struct{}
+	// runtimeLeaked holds the abandoned workers which were still initializing when their pool was shut
+	// down. The interpreter is not finalized while any of them is running.
+	runtimeLeaked []*worker
+	// runtimeAttached reports whether the interpreter was initialized by the host and attached to with
+	// AttachExisting, so that it is left running when the last pool is shut down.
+	runtimeAttached bool
+)
+
+// NewPool creates a pool of workers independent of the default pool, initializing the Python interpreter
+// from the library at libraryPath if no other pool has done so. As the interpreter cannot be initialized
+// twice in one process, every pool must use the same library, and a pool can only be added alongside
+// another when the interpreter supports sub-interpreters (Python 3.12 or later); otherwise
+// [ErrAlreadyInitialized] is returned.
+//
+// If some workers fail to start, the pool is returned along with the error and runs with the remaining
+// workers. A returned pool must be shut down with [Pool.Shutdown].
+func NewPool(libraryPath string, opts ...Option) (*Pool, error) {
+	return newPool(libraryPath, poolSubInterpreters, opts)
+}
+
+// newPool creates a pool whose workers are created according to mode.
+func newPool(libraryPath string, mode poolMode, opts []Option) (pool *Pool, err error) {
+	runtimeMu.Lock()
+	defer runtimeMu.Unlock()
+
+	p := &Pool{config: newConfig(opts)}
+	if p.config.cacheSize > 0 {
+		p.cache = newResultCache(p.config.cacheSize)
+	}
+	if err := p.config.openStdin(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if pool == nil {
+			p.config.closeStdin()
+			if runtimePools == 0 {
+				restoreMemoryLimit()
+			}
+		} else if p.config.deadlockTimeout > 0 {
+			p.startDeadlockDetector()
+		}
+	}()
+	// Further pools can only be added as sub-interpreters of the running main interpreter. This is checked
+	// before the memory limit is applied, which a rejected pool must leave as it was.
+	if python != 0 && ((mode != poolSubInterpreters && mode != poolRequireSubInterpreters && mode != poolRequireFreeThreaded) || mainStop == nil || libraryPath != runtimeLibrary) {
+		return nil, ErrAlreadyInitialized
+	}
+	if python != 0 && mode == poolRequireFreeThreaded && !runtimeFreeThreaded {
+		return nil, fmt.Errorf("%w: the running interpreter is not a free-threaded build", ErrModeUnsupported)
+	}
+	if p.config.memoryLimit > 0 {
+		if err := applyMemoryLimit(p.config.memoryLimit); err != nil {
+			return nil, err
+		}
+	}
+
+	if python != 0 {
+		runtimePools++
+		numWorkers := runtime.NumCPU()
+		if p.config.numWorkers > 0 {
+			numWorkers = p.config.numWorkers
+		}
+		if p.config.freeThreaded && runtimeFreeThreaded {
+			return p, p.initFreeThreaded(numWorkers)
+		}
+		return p, p.initWithSubInterpreters(numWorkers)
+	}
+
+	switch mode {
+	case poolAttached:
+		if err := loadLibrary(libraryPath, p.config.dlopenFlags); err != nil {
+			return nil, err
+		}
+		if py_IsInitialized() == 0 {
+			unloadLibrary()
+			return nil, fmt.Errorf("%w: no running Python interpreter", ErrNotInitialized)
+		}
+		runtimePools, runtimeLibrary, runtimeAttached = 1, libraryPath, true
+		err = p.initAttachedWorker()
+
+	case poolSingleWorker, poolMainThread:
+		if _, err := initPython(libraryPath, p.config.dlopenFlags); err != nil {
+			return nil, err
+		}
+		runtimePools, runtimeLibrary = 1, libraryPath
+		if mode == poolMainThread {
+			err = p.initSingleWorker(runOnMainThread)
+		} else {
+			err = p.initSingleWorker(startWorkerThread)
+		}
+
+	default:
+		features, err := initPython(libraryPath, p.config.dlopenFlags)
+		if err != nil {
+			return nil, err
+		}
+		if mode == poolRequireSubInterpreters && !features.subInterpreters {
+			unloadLibrary()
+			return nil, fmt.Errorf("%w: sub-interpreters are not supported by the Python library or platform", ErrModeUnsupported)
+		}
+		if mode == poolRequireFreeThreaded && !features.freeThreaded {
+			unloadLibrary()
+			return nil, fmt.Errorf("%w: the Python library is not a free-threaded build", ErrModeUnsupported)
+		}
+		runtimePools, runtimeLibrary = 1, libraryPath
+
+		numWorkers := runtime.NumCPU()
+		if p.config.numWorkers > 0 {
+			numWorkers = p.config.numWorkers
+		}
+		if features.subInterpreters && (numWorkers > 1 || mode == poolRequireSubInterpreters || mode == poolRequireFreeThreaded) {
+			mainStop, mainDone = make(chan struct{}), make(chan struct{})
+			if err := startMainInterpreter(p.config, mainStop, mainDone); err != nil {
+				mainStop, mainDone = nil, nil
+				runtimePools, python = 0, 0
+				return nil, err
+			}
+			runtimeFreeThreaded = features.freeThreaded
+			if p.config.freeThreaded && features.freeThreaded {
+				return p, p.initFreeThreaded(numWorkers)
+			}
+			return p, p.initWithSubInterpreters(numWorkers)
+		}
+		return p, p.initSingleWorker(startWorkerThread)
+	}
+	return p, err
+}
+
+// awaitReady waits for w to initialize and returns its initialization error. If the timeout set with
+// WithInitTimeout expires first, the worker is abandoned and [ErrInitTimeout] is returned; the worker is
+// stopped once it becomes ready, and Shutdown waits for it for up to the timeout again.
+func (p *Pool) awaitReady(w *worker) error {
+	if p.config.initTimeout <= 0 {
+		<-w.ready
+		return w.initErr
+	}
+
+	timer := time.NewTimer(p.config.initTimeout)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		return w.initErr
+	case <-timer.C:
+	}
+
+	p.abandoned = append(p.abandoned, w)
+	go func() {
+		<-w.ready
+		if w.initErr == nil {
+			w.closeRequests()
+		}
+	}()
+	return ErrInitTimeout
+}
+
+// LoadPool loads a Python program on the given pool and returns an [Executable] that can be called
+// multiple times. It is the equivalent of [Load] for pools created with [NewPool].
+func LoadPool[TInput, TResult any](pool *Pool, program Program[TInput, TResult]) (*Executable[TInput, TResult], error) {
+	if err := checkValueResult[TResult](); err != nil {
+		return nil, err
+	}
+	exec := &Executable[TInput, TResult]{
+		executable: executable{code: string(program), pool: pool},
+	}
+	if err := exec.load(); err != nil {
+		return nil, err
+	}
+	return exec, nil
+}
+
+// WorkerCount returns the number of workers in the default pool which are serving requests, or 0 before
+// [Init]. See [Pool.WorkerCount].
+func WorkerCount() int {
+	if checkInit() != nil {
+		return 0
+	}
+	return workerPool.WorkerCount()
+}
+
+// WorkerCount returns the number of workers in the pool which are serving requests. Workers which failed
+// to start, such as sub-interpreters which could not be created, and workers which exited abnormally are
+// not counted, so the count may be lower than requested. It is 0 once the pool is shut down.
+func (p *Pool) WorkerCount() int {
+	if p.closed.Load() {
+		return 0
+	}
+
+	var n int
+	for _, w := range p.workers {
+		if !w.exited.Load() {
+			n++
+		}
+	}
+	return n
+}
+
+// Shutdown stops the workers of the pool, waiting for queued requests to complete. When the last pool in
+// the process is shut down the Python interpreter is finalized. Shutting down a pool more than once
+// returns [ErrNotInitialized].
+//
+// Workers abandoned by [WithInitTimeout] are waited for until the init timeout expires again. Those still
+// initializing then are leaked, and as the interpreter cannot be finalized while they run, it is left
+// running for later pools instead, which can then only be created with sub-interpreters.
+func (p *Pool) Shutdown() error {
+	if !p.closed.CompareAndSwap(false, true) {
+		return ErrNotInitialized
+	}
+
+	if p.detectorStop != nil {
+		close(p.detectorStop)
+	}
+	for _, w := range p.workers {
+		w.closeRequests()
+	}
+	for _, w := range p.workers {
+		<-w.done
+	}
+	leaked := p.awaitAbandoned()
+	p.config.closeStdin()
+
+	runtimeMu.Lock()
+	defer runtimeMu.Unlock()
+
+	runtimeLeaked = append(runtimeLeaked, leaked...)
+	runtimePools--
+	if runtimePools == 0 && !runtimeLeaking() {
+		if mainStop != nil {
+			close(mainStop)
+			<-mainDone
+			mainStop, mainDone = nil, nil
+		}
+		// The host's interpreter is detached from by releasing the library, whose functions are not called
+		// again; a finalized interpreter's library stays loaded, as extension modules may still use it.
+		if runtimeAttached {
+			unloadLibrary()
+		} else {
+			python = 0
+		}
+		runtimeFreeThreaded, runtimeAttached = false, false
+		runtimeLeaked = nil
+		restoreMemoryLimit()
+	}
+	return nil
+}
+
+// awaitAbandoned waits for the workers abandoned by awaitReady to stop, for up to the init timeout, and
+// returns those which are still initializing. They cannot be stopped, so they are leaked: their threads
+// run until their initialization finishes.
+func (p *Pool) awaitAbandoned() []*worker {
+	if len(p.abandoned) == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(p.config.initTimeout)
+	defer timer.Stop()
+	for i, w := range p.abandoned {
+		select {
+		case <-w.done:
+		case <-timer.C:
+			return p.abandoned[i:]
+		}
+	}
+	return nil
+}
+
+// runtimeLeaking reports whether any leaked worker is still running, removing those which have stopped.
+// The caller must hold runtimeMu.
+func runtimeLeaking() bool {
+	running := runtimeLeaked[:0]
+	for _, w := range runtimeLeaked {
+		select {
+		case <-w.done:
+		default:
+			running = append(running, w)
+		}
+	}
+	runtimeLeaked = running
+	return len(running) > 0
+}
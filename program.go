@@ -1,21 +1,98 @@
 package serpent
 
-import "strings"
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
 
 // Writer is a result type which indicates that the program writes to the output.
 // e.g. Program[string, Writer] is a program that writes to the output.
 type Writer struct{}
 
+// Pipe is a result type which indicates that the program reads from an input stream and writes to the
+// output. e.g. Program[string, Pipe] is a program that transforms the input stream into the output.
+type Pipe struct{}
+
+// Marshaler is implemented by inputs which provide their own encoding in place of JSON. When the input
+// passed to [Run] or [Executable.Run] implements Marshaler, the bytes returned by MarshalPython are
+// delivered to the program's run() function as a Python bytes object, which the program decodes itself.
+// This allows types with an efficient binary encoding to bypass JSON.
+type Marshaler interface {
+	MarshalPython() ([]byte, error)
+}
+
 // Program identifies a Python program.
 type Program[TInput, TResult any] string
 
-// writerClassDef is the Python code for the Writer class injected into writer programs.
+// GenerateCode returns the Python source which is executed for the program when it is run with arg,
+// without running it. Programs with a [Writer] or [Pipe] result are wrapped with the code which sets up
+// their streams; other programs are executed as written. The function registered with [SetCodeTransform],
+// if any, is applied as it is when the program is loaded. arg is encoded as a run would encode it, and an
+// error is returned if that fails, so the dry run also checks that the input can be passed. This is useful
+// for diagnosing line numbers in tracebacks and for reviewing exactly what serpent runs.
+func GenerateCode[TInput, TResult any](program Program[TInput, TResult], arg TInput) (string, error) {
+	var err error
+	if m, ok := any(arg).(Marshaler); ok {
+		_, err = m.MarshalPython()
+	} else {
+		_, err = json.Marshal(arg)
+	}
+	if err != nil {
+		return "", fmt.Errorf("marshal input: %w", err)
+	}
+	return transformCode(generateCode(program)), nil
+}
+
+// generateCode returns the Python source which is executed for the program, before any transform.
+func generateCode[TInput, TResult any](program Program[TInput, TResult]) string {
+	switch any(*new(TResult)).(type) {
+	case Writer:
+		return generateWriterCode(string(program))
+	case Pipe:
+		return generatePipeCode(string(program))
+	default:
+		return string(program)
+	}
+}
+
+// checkValueResult returns [ErrStreamResult] if TResult is [Writer] or [Pipe]. Such programs define a
+// run() function which takes their streams as arguments, so running them for a value would fail with a
+// TypeError from Python which does not say how they are meant to be run.
+func checkValueResult[TResult any]() error {
+	switch any(*new(TResult)).(type) {
+	case Writer:
+		return fmt.Errorf("%w: a program with a Writer result must be run with RunWrite or LoadWriter", ErrStreamResult)
+	case Pipe:
+		return fmt.Errorf("%w: a program with a Pipe result must be run with RunPipe or LoadPipe", ErrStreamResult)
+	}
+	return nil
+}
+
+// writerClassDef is the Python code for the Writer class injected into writer programs. Its names are
+// dunder names prefixed with __serpent_ so that they cannot collide with names defined by the user's
+// program, such as its own Writer class.
 const writerClassDef = `
-import os
+import os as __serpent_os__
+
+def __serpent_identity__(fd):
+    st = __serpent_os__.fstat(fd)
+    return st.st_dev, st.st_ino
+
+# The descriptor is only closed if it still refers to the stream it was opened for: a program which
+# closed it itself may have had its number reused for an unrelated file.
+def __serpent_close__(fd, identity):
+    try:
+        if __serpent_identity__(fd) != identity:
+            return
+    except OSError:
+        return
+    __serpent_os__.close(fd)
 
-class Writer:
+class __serpent_Writer__:
     def __init__(self, fd):
         self._fd = fd
+        self._identity = __serpent_identity__(fd)
         self._closed = False
 
     def write(self, data):
@@ -23,15 +100,18 @@ class Writer:
             raise RuntimeError("Writer is closed")
         if isinstance(data, str):
             data = data.encode('utf-8')
-        os.write(self._fd, data)
+        __serpent_os__.write(self._fd, data)
 
     def flush(self):
         pass
 
+    def fileno(self):
+        return self._fd
+
     def close(self):
         if not self._closed:
-            os.close(self._fd)
             self._closed = True
+            __serpent_close__(self._fd, self._identity)
 
     def __enter__(self):
         return self
@@ -44,16 +124,66 @@ class Writer:
 // writerRunWrapper is the Python code that wraps the user's run() function to support
 // the Writer type when using RunWrite.
 const writerRunWrapper = `
-_user_run = run
+__serpent_run__ = run
+def run(raw_input):
+    writer = __serpent_Writer__(__serpent_os__.dup(raw_input['Fd']))
+    try:
+        __serpent_run__(raw_input['Input'], writer)
+    finally:
+        writer.close()
+    return None
+`
+
+// readerClassDef is the Python code for the Reader class injected into pipe programs. It relies on the
+// os import and the helpers defined by writerClassDef.
+const readerClassDef = `
+class __serpent_Reader__:
+    def __init__(self, fd):
+        self._fd = fd
+        self._identity = __serpent_identity__(fd)
+        self._closed = False
+
+    def read(self, size=-1):
+        if self._closed:
+            raise RuntimeError("Reader is closed")
+        if size >= 0:
+            return __serpent_os__.read(self._fd, size)
+        chunks = []
+        while True:
+            chunk = __serpent_os__.read(self._fd, 65536)
+            if not chunk:
+                break
+            chunks.append(chunk)
+        return b''.join(chunks)
+
+    def fileno(self):
+        return self._fd
+
+    def close(self):
+        if not self._closed:
+            self._closed = True
+            __serpent_close__(self._fd, self._identity)
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, exc_type, exc_val, exc_tb):
+        self.close()
+        return False
+`
+
+// pipeRunWrapper is the Python code that wraps the user's run() function to support the Reader and
+// Writer types when using RunPipe.
+const pipeRunWrapper = `
+__serpent_run__ = run
 def run(raw_input):
-    import os
-    _input = raw_input['Input']
-    _fd = os.dup(raw_input['Fd'])
-    _writer = Writer(_fd)
+    reader = __serpent_Reader__(__serpent_os__.dup(raw_input['InFd']))
+    writer = __serpent_Writer__(__serpent_os__.dup(raw_input['OutFd']))
     try:
-        _user_run(_input, _writer)
+        __serpent_run__(raw_input['Input'], reader, writer)
     finally:
-        _writer.close()
+        reader.close()
+        writer.close()
     return None
 `
 
@@ -69,3 +199,17 @@ func generateWriterCode(code string) string {
 	builder.WriteString(writerRunWrapper)
 	return builder.String()
 }
+
+// generatePipeCode generates Python code for programs that read from an input stream and write to an
+// output stream. It injects the Reader and Writer class definitions and wraps the user's run() function
+// to handle the setup and teardown of both.
+func generatePipeCode(code string) string {
+	var builder strings.Builder
+	builder.WriteString(writerClassDef)
+	builder.WriteString(readerClassDef)
+	builder.WriteString("\n")
+	builder.WriteString(code)
+	builder.WriteString("\n")
+	builder.WriteString(pipeRunWrapper)
+	return builder.String()
+}
@@ -3,10 +3,13 @@ package serpent
 import (
 	"errors"
 	"fmt"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"unsafe"
 
 	"github.com/ebitengine/purego"
 )
@@ -14,6 +17,7 @@ import (
 // Types used in the Python C API.
 type pyObject uintptr
 type pyThreadState uintptr
+type pyInterpreterState uintptr
 
 // pyInterpreterConfig is the configuration for creating a sub-interpreter.
 // This matches the PyInterpreterConfig struct in Python 3.12+.
@@ -30,37 +34,57 @@ type pyInterpreterConfig struct {
 // pyStatus represents the result of a Python C API call.
 type pyStatus struct {
 	typ      int32
-	func_    uintptr
-	err_msg  uintptr
+	func_    *byte
+	err_msg  *byte
 	exitcode int32
 }
 
+// pyConfig holds a PyConfig, which is only accessed through the C API. It is larger than the struct in
+// any supported version.
+type pyConfig [256]uint64
+
 // Constants used in the Python C API.
 const (
 	pyFileInput               = 257
+	pyEvalInput               = 258
 	pyInterpreterConfigOwnGIL = 2
 )
 
 // Function prototypes for the Python C API.
 var py_InitializeEx func(int)
+var py_InitializeFromConfig func(*pyConfig) pyStatus
+var pyConfig_InitIsolatedConfig func(*pyConfig)
+var pyConfig_Clear func(*pyConfig)
+var py_IsInitialized func() int
 var py_Finalize func()
 var pyEval_GetBuiltins func() pyObject
 var pyRun_String func(string, int, pyObject, pyObject) pyObject
-var pyErr_Occurred func() bool
+var py_CompileStringExFlags func(string, string, int, uintptr, int) pyObject
+var pyEval_EvalCode func(pyObject, pyObject, pyObject) pyObject
+var pyErr_Occurred func() pyObject
 var pyErr_Print func()
 var pyErr_Fetch func(*pyObject, *pyObject, *pyObject)
 var pyErr_Clear func()
+var pyErr_NormalizeException func(*pyObject, *pyObject, *pyObject)
+var pyException_SetTraceback func(pyObject, pyObject) int
 var pyObject_Str func(pyObject) pyObject
 var pyObject_Call func(pyObject, pyObject, pyObject) pyObject
 var pyObject_GetAttrString func(pyObject, string) pyObject
+var pyObject_HasAttrString func(pyObject, string) int
 var pyDict_New func() pyObject
 var pyDict_GetItemString func(pyObject, string) pyObject
 var pyDict_SetItemString func(pyObject, string, pyObject) int
 var pyUnicode_AsUTF8 func(pyObject) string
+var pyUnicode_AsUTF8AndSize func(pyObject, *int) *byte
 var pyUnicode_FromString func(string) pyObject
+var pyBytes_FromStringAndSize func(*byte, int) pyObject
+var pyBytes_AsStringAndSize func(pyObject, **byte, *int) int
+var pyBool_FromLong func(int) pyObject
 var pyTuple_New func(int) pyObject
 var pyTuple_SetItem func(pyObject, int, pyObject) int
 var pyImport_ImportModule func(string) pyObject
+var pyObject_GetIter func(pyObject) pyObject
+var pyIter_Next func(pyObject) pyObject
 var py_DecRef func(pyObject)
 var py_IncRef func(pyObject)
 var py_GetVersion func() string
@@ -68,102 +92,266 @@ var py_NewInterpreterFromConfig func(*pyThreadState, *pyInterpreterConfig) pySta
 var py_EndInterpreter func(pyThreadState)
 var pyThreadState_Swap func(pyThreadState) pyThreadState
 var pyThreadState_Get func() pyThreadState
+var pyThreadState_New func(pyInterpreterState) pyThreadState
+var pyThreadState_Clear func(pyThreadState)
+var pyThreadState_DeleteCurrent func()
+var pyThreadState_GetInterpreter func(pyThreadState) pyInterpreterState
+var pyThreadState_SetAsyncExc func(uintptr, pyObject) int
+var pyThread_get_thread_ident func() uintptr
 var pyEval_SaveThread func() pyThreadState
 var pyEval_RestoreThread func(pyThreadState)
+var pyGILState_Ensure func() int32
+var pyGILState_Release func(int32)
 
 // python is a handle to the Python shared library.
 var python uintptr
 
-// workerPool is the global pool of Python workers.
-var workerPool *pool
+// registered holds pointers to the function variables registered from the Python library, so that they
+// can be reset when it is unloaded.
+var registered []any
+
+// registerLibFunc registers the function of the Python library named name in the variable fptr points to.
+func registerLibFunc(fptr any, name string) {
+	purego.RegisterLibFunc(fptr, python, name)
+	registered = append(registered, fptr)
+}
+
+// unloadLibrary closes the Python library opened by loadLibrary when initialization is abandoned before
+// the interpreter is initialized, or when detaching from an interpreter initialized by the host, resetting
+// the functions registered from it so that none can be called.
+func unloadLibrary() {
+	for _, fptr := range registered {
+		reflect.ValueOf(fptr).Elem().SetZero()
+	}
+	registered = nil
+	purego.Dlclose(python)
+	python = 0
+}
 
 // worker represents a Python sub-interpreter running on a dedicated OS thread.
 type worker struct {
-	id       int
-	interp   pyThreadState
-	requests chan *execContext
-	initErr  error
-	ready    chan struct{}
-	done     chan struct{}
+	id          int
+	interp      pyThreadState
+	thread      uintptr
+	tid         int
+	config      *config
+	loop        pyObject
+	jsonDefault pyObject
+	jsonConvert pyObject
+	requests    chan *execContext
+	initErr     error
+	exited      atomic.Bool
+	ready       chan struct{}
+	done        chan struct{}
+	// mainThread reports whether the worker is run on the main thread by Main.
+	mainThread bool
+	// pending counts the requests submitted to the worker which have not completed, completed counts
+	// those which have, and busySince is the time in nanoseconds at which the running request started,
+	// or 0. They are read by the deadlock detector.
+	pending   atomic.Int64
+	completed atomic.Uint64
+	busySince atomic.Int64
+
+	// running is the state of the executable whose request is executing, and interrupted reports whether
+	// Interrupt raised an exception in it. Both are guarded by runningMu.
+	runningMu   sync.Mutex
+	running     *execState
+	interrupted bool
+	// requestsClosed is set once requests is closed by closeRequests, so that no request is sent to a
+	// stopped worker. It is guarded by sendMu.
+	sendMu         sync.RWMutex
+	requestsClosed bool
 }
 
-// pool manages a collection of workers.
-type pool struct {
-	workers []*worker
-	next    atomic.Uint64
-	closed  atomic.Bool
+// lastWorkerID is the identifier given to the most recently created worker. Identifiers start at 1 and are
+// unique within the process, across pools and re-initialization.
+var lastWorkerID atomic.Int64
+
+// nextWorkerID returns the identifier of a new worker.
+func nextWorkerID() int {
+	return int(lastWorkerID.Add(1))
 }
 
-// initPython initializes the Python library and registers C API functions.
-// Returns whether sub-interpreters are supported.
-func initPython(libraryPath string) (bool, error) {
+// pythonFeatures describes the concurrency features supported by the loaded Python library.
+type pythonFeatures struct {
+	subInterpreters bool
+	freeThreaded    bool
+}
+
+// initPython initializes the Python library, opened with the given dlopen flags, and registers C API
+// functions. Returns the concurrency features supported by the library.
+func initPython(libraryPath string, flags int) (pythonFeatures, error) {
+	if err := loadLibrary(libraryPath, flags); err != nil {
+		return pythonFeatures{}, err
+	}
+	// CPython aborts the process if it cannot find the standard library during initialization.
+	if err := checkStdlib(py_GetVersion()); err != nil {
+		unloadLibrary()
+		return pythonFeatures{}, err
+	}
+
+	supportsVersion, freeThreaded := checkPythonVersion()
+	supportsSubInterpreters := platformSupportsSubInterpreters && supportsVersion
+	if supportsSubInterpreters {
+		registerLibFunc(&py_NewInterpreterFromConfig, "Py_NewInterpreterFromConfig")
+		registerLibFunc(&py_EndInterpreter, "Py_EndInterpreter")
+		registerLibFunc(&pyThreadState_Swap, "PyThreadState_Swap")
+		registerLibFunc(&pyThreadState_Get, "PyThreadState_Get")
+		registerLibFunc(&pyThreadState_New, "PyThreadState_New")
+		registerLibFunc(&pyThreadState_Clear, "PyThreadState_Clear")
+		registerLibFunc(&pyThreadState_DeleteCurrent, "PyThreadState_DeleteCurrent")
+		registerLibFunc(&pyThreadState_GetInterpreter, "PyThreadState_GetInterpreter")
+	}
+
+	return pythonFeatures{
+		subInterpreters: supportsSubInterpreters,
+		freeThreaded:    supportsSubInterpreters && freeThreaded,
+	}, nil
+}
+
+// loadLibrary opens the Python shared library and registers the core C API functions.
+func loadLibrary(libraryPath string, flags int) error {
 	if python != 0 {
-		return false, ErrAlreadyInitialized
+		return ErrAlreadyInitialized
 	}
 
-	lib, err := purego.Dlopen(libraryPath, purego.RTLD_NOW|purego.RTLD_GLOBAL)
+	lib, err := purego.Dlopen(libraryPath, flags)
 	if err != nil {
-		return false, fmt.Errorf("dlopen: %v", err)
+		return fmt.Errorf("dlopen: %v", err)
 	}
 	python = lib
+	registered = registered[:0]
 
 	// Register core Python C API functions
-	purego.RegisterLibFunc(&py_InitializeEx, python, "Py_InitializeEx")
-	purego.RegisterLibFunc(&py_Finalize, python, "Py_Finalize")
-	purego.RegisterLibFunc(&pyEval_GetBuiltins, python, "PyEval_GetBuiltins")
-	purego.RegisterLibFunc(&pyErr_Occurred, python, "PyErr_Occurred")
-	purego.RegisterLibFunc(&pyErr_Print, python, "PyErr_Print")
-	purego.RegisterLibFunc(&pyErr_Fetch, python, "PyErr_Fetch")
-	purego.RegisterLibFunc(&pyErr_Clear, python, "PyErr_Clear")
-	purego.RegisterLibFunc(&pyObject_Str, python, "PyObject_Str")
-	purego.RegisterLibFunc(&pyObject_Call, python, "PyObject_Call")
-	purego.RegisterLibFunc(&pyObject_GetAttrString, python, "PyObject_GetAttrString")
-	purego.RegisterLibFunc(&pyDict_New, python, "PyDict_New")
-	purego.RegisterLibFunc(&pyDict_GetItemString, python, "PyDict_GetItemString")
-	purego.RegisterLibFunc(&pyDict_SetItemString, python, "PyDict_SetItemString")
-	purego.RegisterLibFunc(&pyUnicode_AsUTF8, python, "PyUnicode_AsUTF8")
-	purego.RegisterLibFunc(&pyUnicode_FromString, python, "PyUnicode_FromString")
-	purego.RegisterLibFunc(&pyTuple_New, python, "PyTuple_New")
-	purego.RegisterLibFunc(&pyTuple_SetItem, python, "PyTuple_SetItem")
-	purego.RegisterLibFunc(&pyImport_ImportModule, python, "PyImport_ImportModule")
-	purego.RegisterLibFunc(&py_DecRef, python, "Py_DecRef")
-	purego.RegisterLibFunc(&py_IncRef, python, "Py_IncRef")
-	purego.RegisterLibFunc(&pyRun_String, python, "PyRun_String")
-	purego.RegisterLibFunc(&py_GetVersion, python, "Py_GetVersion")
-
-	supportsSubInterpreters := platformSupportsSubInterpreters && checkPythonVersion()
-	if supportsSubInterpreters {
-		purego.RegisterLibFunc(&py_NewInterpreterFromConfig, python, "Py_NewInterpreterFromConfig")
-		purego.RegisterLibFunc(&py_EndInterpreter, python, "Py_EndInterpreter")
-		purego.RegisterLibFunc(&pyThreadState_Swap, python, "PyThreadState_Swap")
-		purego.RegisterLibFunc(&pyThreadState_Get, python, "PyThreadState_Get")
-		purego.RegisterLibFunc(&pyEval_SaveThread, python, "PyEval_SaveThread")
-		purego.RegisterLibFunc(&pyEval_RestoreThread, python, "PyEval_RestoreThread")
+	registerLibFunc(&py_InitializeEx, "Py_InitializeEx")
+	registerLibFunc(&py_InitializeFromConfig, "Py_InitializeFromConfig")
+	registerLibFunc(&pyConfig_InitIsolatedConfig, "PyConfig_InitIsolatedConfig")
+	registerLibFunc(&pyConfig_Clear, "PyConfig_Clear")
+	registerLibFunc(&py_IsInitialized, "Py_IsInitialized")
+	registerLibFunc(&py_Finalize, "Py_Finalize")
+	registerLibFunc(&pyEval_GetBuiltins, "PyEval_GetBuiltins")
+	registerLibFunc(&pyErr_Occurred, "PyErr_Occurred")
+	registerLibFunc(&pyErr_Print, "PyErr_Print")
+	registerLibFunc(&pyErr_Fetch, "PyErr_Fetch")
+	registerLibFunc(&pyErr_Clear, "PyErr_Clear")
+	registerLibFunc(&pyErr_NormalizeException, "PyErr_NormalizeException")
+	registerLibFunc(&pyException_SetTraceback, "PyException_SetTraceback")
+	registerLibFunc(&pyObject_Str, "PyObject_Str")
+	registerLibFunc(&pyObject_Call, "PyObject_Call")
+	registerLibFunc(&pyObject_GetAttrString, "PyObject_GetAttrString")
+	registerLibFunc(&pyObject_HasAttrString, "PyObject_HasAttrString")
+	registerLibFunc(&pyDict_New, "PyDict_New")
+	registerLibFunc(&pyDict_GetItemString, "PyDict_GetItemString")
+	registerLibFunc(&pyDict_SetItemString, "PyDict_SetItemString")
+	registerLibFunc(&pyUnicode_AsUTF8, "PyUnicode_AsUTF8")
+	registerLibFunc(&pyUnicode_AsUTF8AndSize, "PyUnicode_AsUTF8AndSize")
+	registerLibFunc(&pyUnicode_FromString, "PyUnicode_FromString")
+	registerLibFunc(&pyBytes_FromStringAndSize, "PyBytes_FromStringAndSize")
+	registerLibFunc(&pyBytes_AsStringAndSize, "PyBytes_AsStringAndSize")
+	registerLibFunc(&pyBool_FromLong, "PyBool_FromLong")
+	registerLibFunc(&pyTuple_New, "PyTuple_New")
+	registerLibFunc(&pyTuple_SetItem, "PyTuple_SetItem")
+	registerLibFunc(&pyImport_ImportModule, "PyImport_ImportModule")
+	registerLibFunc(&pyObject_GetIter, "PyObject_GetIter")
+	registerLibFunc(&pyIter_Next, "PyIter_Next")
+	registerLibFunc(&py_DecRef, "Py_DecRef")
+	registerLibFunc(&py_IncRef, "Py_IncRef")
+	registerLibFunc(&pyRun_String, "PyRun_String")
+	registerLibFunc(&py_CompileStringExFlags, "Py_CompileStringExFlags")
+	registerLibFunc(&pyEval_EvalCode, "PyEval_EvalCode")
+	registerLibFunc(&py_GetVersion, "Py_GetVersion")
+	registerLibFunc(&pyGILState_Ensure, "PyGILState_Ensure")
+	registerLibFunc(&pyGILState_Release, "PyGILState_Release")
+	registerLibFunc(&pyEval_SaveThread, "PyEval_SaveThread")
+	registerLibFunc(&pyEval_RestoreThread, "PyEval_RestoreThread")
+	registerLibFunc(&pyThreadState_SetAsyncExc, "PyThreadState_SetAsyncExc")
+	registerLibFunc(&pyThread_get_thread_ident, "PyThread_get_thread_ident")
+
+	return nil
+}
+
+// checkInit checks if the default pool has been initialized, returning ErrNotInitialized if it has not.
+func checkInit() error {
+	if workerPool == nil {
+		return fmt.Errorf("%w: Init must be called before Run", ErrNotInitialized)
 	}
+	return nil
+}
+
+// signalHandlersCode installs Python's signal handlers for WithInstallSignalHandlers. Py_InitializeEx only
+// installs the SIGINT handler if SIGINT has no handler, and the Go runtime has installed one, while the
+// isolated configuration installs none, so the handlers are installed as Py_InitializeEx would otherwise,
+// except that SIGINT raises _serpent_go.Interrupted, so that the run fails with ErrInterrupted.
+const signalHandlersCode = serpentModuleCode + `import signal
+signal.signal(signal.SIGINT, sys.modules["_serpent_go"]._sigint)
+for name in ("SIGPIPE", "SIGXFSZ"):
+    if hasattr(signal, name):
+        signal.signal(getattr(signal, name), signal.SIG_IGN)
+`
 
-	return supportsSubInterpreters, nil
+// initializeInterpreter initializes the Python runtime on the calling thread, in isolated mode if the
+// config requests it.
+func initializeInterpreter(cfg *config) error {
+	if !cfg.isolated {
+		initsigs := 0
+		if cfg.signalHandlers {
+			initsigs = 1
+		}
+		py_InitializeEx(initsigs)
+	} else {
+		var config pyConfig
+		pyConfig_InitIsolatedConfig(&config)
+		defer pyConfig_Clear(&config)
+		if status := py_InitializeFromConfig(&config); status.typ != 0 {
+			return fmt.Errorf("initialize isolated interpreter: %s", cString(status.err_msg))
+		}
+	}
+
+	if cfg.signalHandlers {
+		if err := initWorker(signalHandlersCode); err != nil {
+			return fmt.Errorf("install signal handlers: %w", err)
+		}
+	}
+	return nil
 }
 
-// checkInit checks if the Python interpreter has been initialized. It panics if it has not.
-func checkInit() {
-	if python == 0 {
-		panic(PythonNotInitialized("serpent: Init must be called before Run"))
+// cString converts a NUL-terminated C string to a Go string.
+func cString(p *byte) string {
+	if p == nil {
+		return ""
+	}
+	n := 0
+	for *(*byte)(unsafe.Add(unsafe.Pointer(p), n)) != 0 {
+		n++
 	}
+	return string(unsafe.Slice(p, n))
 }
 
-// checkPythonVersion checks if Python >= 3.12 for sub-interpreter support.
-func checkPythonVersion() bool {
+// checkPythonVersion checks if Python >= 3.12 for sub-interpreter support, and whether the library is
+// a free-threaded build, which reports itself as such in its version string.
+func checkPythonVersion() (bool, bool) {
 	py_InitializeEx(0)
 	version := py_GetVersion()
 	py_Finalize()
 
+	freeThreaded := strings.Contains(version, "free-threading build")
+	major, minor, ok := parseVersion(version)
+	if !ok {
+		return false, freeThreaded
+	}
+	return major > 3 || (major == 3 && minor >= 12), freeThreaded
+}
+
+// parseVersion returns the major and minor version from a version string reported by Py_GetVersion, such
+// as "3.12.1 (main, ...)".
+func parseVersion(version string) (major, minor int, ok bool) {
 	parts := strings.Split(version, ".")
 	if len(parts) < 2 {
-		return false
+		return 0, 0, false
 	}
 	major, err := strconv.Atoi(parts[0])
 	if err != nil {
-		return false
+		return 0, 0, false
 	}
 
 	minorStr := parts[1]
@@ -173,109 +361,287 @@ func checkPythonVersion() bool {
 			break
 		}
 	}
-	minor, err := strconv.Atoi(minorStr)
+	minor, err = strconv.Atoi(minorStr)
 	if err != nil {
-		return false
+		return 0, 0, false
 	}
-
-	return major > 3 || (major == 3 && minor >= 12)
+	return major, minor, true
 }
 
 // initSingleWorker initializes a single worker for interpreters that do not support sub-interpreters.
-func initSingleWorker() error {
+// The worker is run by start, which runs startSingleWorker on a dedicated thread.
+func (p *Pool) initSingleWorker(start func(*worker)) error {
 	w := &worker{
-		id:       0,
+		id:       nextWorkerID(),
+		config:   p.config,
 		requests: make(chan *execContext, 100),
 		ready:    make(chan struct{}),
 		done:     make(chan struct{}),
 	}
-	workerPool.workers = append(workerPool.workers, w)
+	p.workers = append(p.workers, w)
 
-	go startSingleWorker(w)
+	start(w)
+	<-w.ready
+	return w.initErr
+}
+
+// initAttachedWorker initializes a single worker which uses an interpreter initialized by the host.
+func (p *Pool) initAttachedWorker() error {
+	w := &worker{
+		id:       nextWorkerID(),
+		config:   p.config,
+		requests: make(chan *execContext, 100),
+		ready:    make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	p.workers = append(p.workers, w)
+
+	go startAttachedWorker(w, p.config.mainInitCode()+p.config.workerInitCode())
 	<-w.ready
 	return w.initErr
 }
 
-// initWithSubInterpreters initializes multiple workers with sub-interpreters.
-func initWithSubInterpreters(numWorkers int) error {
+// initFreeThreaded initializes multiple workers which share the main interpreter of a free-threaded
+// build. The main interpreter must already be running.
+func (p *Pool) initFreeThreaded(numWorkers int) error {
+	var initErrors []error
+	for i := 0; i < numWorkers; i++ {
+		w := &worker{
+			id:       nextWorkerID(),
+			config:   p.config,
+			requests: make(chan *execContext, 100),
+			ready:    make(chan struct{}),
+			done:     make(chan struct{}),
+		}
+
+		go startAttachedWorker(w, p.config.workerInitCode())
+
+		if err := p.awaitReady(w); err != nil {
+			initErrors = append(initErrors, fmt.Errorf("worker %d: %w", i, err))
+		} else {
+			p.workers = append(p.workers, w)
+		}
+	}
+
+	if len(p.workers) == 0 {
+		return fmt.Errorf("all workers failed to initialize: %w", errors.Join(initErrors...))
+	}
+
+	if len(initErrors) > 0 {
+		return fmt.Errorf("some workers failed to initialize (continuing with %d workers): %w",
+			len(p.workers), errors.Join(initErrors...))
+	}
+
+	return nil
+}
+
+// startMainInterpreter initializes the main interpreter on a dedicated OS thread, runs the main
+// initialization code of cfg and releases its GIL so that sub-interpreters can be created. The
+// interpreter is finalized once stop is closed, after which done is closed. If initialization fails the
+// interpreter is finalized immediately and the error is returned.
+func startMainInterpreter(cfg *config, stop <-chan struct{}, done chan<- struct{}) error {
 	mainReady := make(chan struct{})
 	var mainState pyThreadState
+	var initErr error
 
 	go func() {
 		runtime.LockOSThread()
-		py_InitializeEx(0)
+		defer close(done)
+
+		if initErr = initializeInterpreter(cfg); initErr != nil {
+			close(mainReady)
+			return
+		}
+		if initErr = initWorker(preloadCode + cfg.mainInitCode()); initErr != nil {
+			py_Finalize()
+			close(mainReady)
+			return
+		}
 		mainState = pyThreadState_Get()
 		pyEval_SaveThread()
 		close(mainReady)
 
-		for !workerPool.closed.Load() {
-			runtime.Gosched()
-		}
+		<-stop
 
 		pyEval_RestoreThread(mainState)
 		py_Finalize()
 	}()
 
 	<-mainReady
+	return initErr
+}
 
+// preloadCode imports extension modules in the main interpreter before sub-interpreters are created.
+// CPython 3.12 shares the static types of some extension modules, such as _datetime, between interpreters
+// without isolating them; when a sub-interpreter is the first to import one, another sub-interpreter
+// importing it aborts the process with a double free. Importing them in the main interpreter first
+// initializes the types there.
+const preloadCode = "try:\n    import _datetime\nexcept ImportError:\n    pass\n"
+
+// initWithSubInterpreters initializes multiple workers with sub-interpreters. The main interpreter must
+// already be running.
+func (p *Pool) initWithSubInterpreters(numWorkers int) error {
 	var initErrors []error
 	for i := 0; i < numWorkers; i++ {
 		w := &worker{
-			id:       i,
+			id:       nextWorkerID(),
+			config:   p.config,
 			requests: make(chan *execContext, 100),
 			ready:    make(chan struct{}),
 			done:     make(chan struct{}),
 		}
 
 		go startSubInterpreterWorker(w)
-		<-w.ready
 
-		if w.initErr != nil {
-			initErrors = append(initErrors, fmt.Errorf("worker %d: %w", i, w.initErr))
+		if err := p.awaitReady(w); err != nil {
+			initErrors = append(initErrors, fmt.Errorf("worker %d: %w", i, err))
 		} else {
-			workerPool.workers = append(workerPool.workers, w)
+			p.workers = append(p.workers, w)
 		}
 	}
 
-	if len(workerPool.workers) == 0 {
+	if len(p.workers) == 0 {
 		return fmt.Errorf("all workers failed to initialize: %w", errors.Join(initErrors...))
 	}
 
 	if len(initErrors) > 0 {
 		return fmt.Errorf("some workers failed to initialize (continuing with %d workers): %w",
-			len(workerPool.workers), errors.Join(initErrors...))
+			len(p.workers), errors.Join(initErrors...))
 	}
 
 	return nil
 }
 
-// startSingleWorker runs a single worker using the single-interpreter approach.
+// startWorkerThread starts a single worker on a new goroutine, which locks its own OS thread.
+func startWorkerThread(w *worker) {
+	go startSingleWorker(w)
+}
+
+// startSingleWorker runs a single worker using the single-interpreter approach. The GIL is released
+// between requests so that Stop can signal a running program from another thread.
 func startSingleWorker(w *worker) {
 	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
+	defer w.releaseThread()
 
-	py_InitializeEx(0)
+	w.thread, w.tid = pyThread_get_thread_ident(), currentThreadID()
+	if err := w.setWorkdir(); err != nil {
+		w.initErr = err
+		close(w.ready)
+		close(w.done)
+		return
+	}
+	if err := initializeInterpreter(w.config); err != nil {
+		w.initErr = err
+		close(w.ready)
+		close(w.done)
+		return
+	}
 	defer py_Finalize()
 
+	if err := initWorker(w.config.mainInitCode() + w.config.workerInitCode()); err != nil {
+		w.initErr = err
+		close(w.ready)
+		close(w.done)
+		return
+	}
+
+	tstate := pyEval_SaveThread()
 	close(w.ready)
-	for req := range w.requests {
+	w.serve(func(req *execContext) {
+		pyEval_RestoreThread(tstate)
+		defer pyEval_SaveThread()
 		req.execute()
+	})
+
+	pyEval_RestoreThread(tstate)
+	w.runShutdownCode()
+	w.closeEventLoop()
+	close(w.done)
+}
+
+// setWorkdir changes the working directory of the calling worker thread to the one set with WithWorkdir.
+func (w *worker) setWorkdir() error {
+	if w.config.workdir == "" {
+		return nil
+	}
+	if err := setThreadWorkdir(w.config.workdir); err != nil {
+		return fmt.Errorf("set working directory: %w", err)
+	}
+	return nil
+}
+
+// releaseThread unlocks the calling worker goroutine from its thread as the worker stops. A thread given
+// its own working directory by setWorkdir cannot be returned to the Go runtime, whose goroutines expect the
+// working directory of the process, nor can a thread which has run Python code safely exit, so the
+// goroutine instead keeps the thread idle for the life of the process. The main thread used by Main is
+// left to Main.
+func (w *worker) releaseThread() {
+	if threadWorkdir && w.config.workdir != "" && !w.mainThread {
+		select {}
+	}
+	runtime.UnlockOSThread()
+}
+
+// startAttachedWorker runs a worker on its own thread in the main interpreter, running initCode first.
+// It is used for interpreters initialized by the host and for free-threaded builds. The GIL is acquired
+// for each request and released afterwards so the host and other threads can continue to use the
+// interpreter; on free-threaded builds this detaches idle workers so they do not hold up the
+// interpreter's stop-the-world pauses.
+func startAttachedWorker(w *worker, initCode string) {
+	runtime.LockOSThread()
+	defer w.releaseThread()
+
+	w.thread, w.tid = pyThread_get_thread_ident(), currentThreadID()
+	if err := w.setWorkdir(); err != nil {
+		w.initErr = err
+		close(w.ready)
+		close(w.done)
+		return
+	}
+	gstate := pyGILState_Ensure()
+	err := initWorker(initCode)
+	pyGILState_Release(gstate)
+	if err != nil {
+		w.initErr = err
+		close(w.ready)
+		close(w.done)
+		return
 	}
 
+	close(w.ready)
+	w.serve(func(req *execContext) {
+		gstate := pyGILState_Ensure()
+		defer pyGILState_Release(gstate)
+		req.execute()
+	})
+
+	gstate = pyGILState_Ensure()
+	w.runShutdownCode()
+	w.closeEventLoop()
+	pyGILState_Release(gstate)
 	close(w.done)
 }
 
-// startSubInterpreterWorker runs a worker with its own sub-interpreter.
+// startSubInterpreterWorker runs a worker with its own sub-interpreter. The interpreter's GIL is released
+// between requests so that Stop can signal a running program from another thread.
 func startSubInterpreterWorker(w *worker) {
 	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
+	defer w.releaseThread()
+
+	w.thread, w.tid = pyThread_get_thread_ident(), currentThreadID()
+	if err := w.setWorkdir(); err != nil {
+		w.initErr = err
+		close(w.ready)
+		close(w.done)
+		return
+	}
 
 	config := pyInterpreterConfig{
 		useMainObmalloc:     0,
 		allowFork:           0,
 		allowExec:           0,
 		allowThreads:        1,
-		allowDaemonThreads:  0,
+		allowDaemonThreads:  boolInt(w.config.daemonThreads),
 		checkMultiInterpExt: 1,
 		gil:                 pyInterpreterConfigOwnGIL,
 	}
@@ -291,30 +657,179 @@ func startSubInterpreterWorker(w *worker) {
 
 	w.interp = tstate
 
+	if err := initWorker(w.config.workerInitCode()); err != nil {
+		py_EndInterpreter(w.interp)
+		w.initErr = err
+		close(w.ready)
+		close(w.done)
+		return
+	}
+
+	pyEval_SaveThread()
 	close(w.ready)
-	for req := range w.requests {
+	w.serve(func(req *execContext) {
+		pyEval_RestoreThread(w.interp)
+		defer pyEval_SaveThread()
 		req.execute()
-	}
+	})
 
+	pyEval_RestoreThread(w.interp)
+	w.runShutdownCode()
+	w.closeEventLoop()
 	py_EndInterpreter(w.interp)
 	close(w.done)
 }
 
-// fetchPythonError retrieves the current Python exception and returns it as a Go error.
-// It clears the Python error state after fetching.
+// formatExceptionExpr is a Python expression which formats the exception bound to e. Exceptions
+// without a __cause__ or __context__ are formatted as their message alone; chained exceptions are
+// formatted in full as traceback.format_exception would print them.
+const formatExceptionExpr = `str(e) if e.__cause__ is None and (e.__context__ is None or e.__suppress_context__) ` +
+	`else ` + tracebackExpr
+
+// tracebackExpr is a Python expression which formats the exception bound to e in full, as
+// traceback.print_exception would print it.
+const tracebackExpr = `"".join(__import__("traceback").format_exception(type(e), e, e.__traceback__)).rstrip()`
+
+// exitCodeExpr is a Python expression which evaluates to the exit code of the SystemExit bound to e, as
+// the interpreter would exit with it, or to an empty string for other exceptions.
+const exitCodeExpr = `("" if not isinstance(e, SystemExit) else 0 if e.code is None ` +
+	`else e.code if isinstance(e.code, int) else 1)`
+
+// exitMessageExpr is a Python expression which evaluates to the text the interpreter would print for the
+// SystemExit bound to e, which is empty unless its code is neither None nor an integer.
+const exitMessageExpr = `("" if e.code is None or isinstance(e.code, int) else str(e.code))`
+
+// interruptExpr is a Python expression which evaluates to the name of the exception bound to e if it is
+// the _serpent_go.Interrupted raised by Stop or the _serpent_go.CPULimitExceeded raised by WithCPULimit,
+// or to an empty string otherwise.
+const interruptExpr = `(lambda m: "Interrupted" if isinstance(e, m.Interrupted) ` +
+	`else "CPULimitExceeded" if isinstance(e, m.CPULimitExceeded) else "")(__import__("_serpent_go"))`
+
+// initWorker runs the worker initialization code in the current interpreter.
+func initWorker(code string) error {
+	if code == "" {
+		return nil
+	}
+
+	globals := pyDict_New()
+	defer py_DecRef(globals)
+	pyDict_SetItemString(globals, "__builtins__", pyEval_GetBuiltins())
+
+	result := pyRun_String(code, pyFileInput, globals, globals)
+	if result == 0 {
+		if pyErr_Occurred() != 0 {
+			return fetchPythonError()
+		}
+		return fmt.Errorf("%w: worker initialization failed", ErrRunFailed)
+	}
+	py_DecRef(result)
+	return nil
+}
+
+// execProgram compiles the program code, transformed by the function registered with SetCodeTransform, at
+// the configured optimization level and executes it in globals. Code over the configured size limit is
+// rejected before it is compiled.
+func execProgram(cfg *config, code string, globals pyObject) error {
+	code = transformCode(code)
+	if limit := cfg.maxSourceBytes; limit > 0 && len(code) > limit {
+		return fmt.Errorf("%w: program source is %d bytes, over the limit of %d; pass data as the program's input rather than in its code", ErrSourceTooLarge, len(code), limit)
+	}
+	compiled := py_CompileStringExFlags(code, "<string>", pyFileInput, 0, cfg.optimize)
+	if compiled == 0 {
+		return fetchPythonError()
+	}
+	defer py_DecRef(compiled)
+
+	result := pyEval_EvalCode(compiled, globals, globals)
+	if result == 0 {
+		return fetchPythonError()
+	}
+	py_DecRef(result)
+	return nil
+}
+
+// boolInt converts a bool to the int32 representation used by the Python C API.
+func boolInt(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// daemonThreadMessage starts the message of the RuntimeError raised by threading when a program starts a
+// daemon thread in an interpreter which does not allow them.
+const daemonThreadMessage = "daemon threads are disabled in this "
+
+// daemonThreadError wraps err with ErrDaemonThreadsDisabled if it was caused by a program starting a
+// daemon thread in a sub-interpreter which does not allow them. Other workers run in the main
+// interpreter, where daemon threads are always allowed.
+func daemonThreadError(w *worker, err error) error {
+	var pyErr *PythonError
+	if w.interp == 0 || w.config.daemonThreads || !errors.As(err, &pyErr) ||
+		pyErr.Type != "RuntimeError" || !strings.HasPrefix(pyErr.Message, daemonThreadMessage) {
+		return err
+	}
+	return fmt.Errorf("%w (enable with WithDaemonThreads): %w", ErrDaemonThreadsDisabled, err)
+}
+
+// fetchPythonError retrieves the current Python exception and returns it as a Go error, a *PythonError
+// unless the exception is one with its own error. It clears the Python error state after fetching.
 func fetchPythonError() error {
 	var ptype, pvalue, ptraceback pyObject
 	pyErr_Fetch(&ptype, &pvalue, &ptraceback)
+	if ptype == 0 {
+		pyErr_Clear()
+		return ErrRunFailed
+	}
+	// Exceptions raised by type alone, such as the Interrupted raised by Stop, are instantiated.
+	pyErr_NormalizeException(&ptype, &pvalue, &ptraceback)
 	if pvalue == 0 {
 		pyErr_Clear()
+		py_DecRef(ptype)
+		if ptraceback != 0 {
+			py_DecRef(ptraceback)
+		}
 		return ErrRunFailed
 	}
+	if ptraceback != 0 {
+		pyException_SetTraceback(pvalue, ptraceback)
+	}
+
+	// SystemExit is reported with its exit code and message rather than a traceback, and the exceptions
+	// raised to interrupt a program as ErrInterrupted or ErrCPULimitExceeded.
+	var kindErr error
+	if code, ok := evalString(exitCodeExpr, map[string]pyObject{"e": pvalue}); ok && code != "" {
+		n, err := strconv.Atoi(code)
+		if err != nil {
+			n = 1
+		}
+		msg, _ := evalString(exitMessageExpr, map[string]pyObject{"e": pvalue})
+		kindErr = &ExitError{Code: n, Message: msg}
+	} else if name, ok := evalString(interruptExpr, map[string]pyObject{"e": pvalue}); ok {
+		switch name {
+		case "Interrupted":
+			kindErr = fmt.Errorf("%w: %w", ErrRunFailed, ErrInterrupted)
+		case "CPULimitExceeded":
+			kindErr = fmt.Errorf("%w: %w", ErrRunFailed, ErrCPULimitExceeded)
+		}
+	}
 
-	strObj := pyObject_Str(pvalue)
-	var msg string
-	if strObj != 0 {
-		msg = pyUnicode_AsUTF8(strObj)
-		py_DecRef(strObj)
+	pyErr := &PythonError{}
+	if kindErr == nil {
+		vars := map[string]pyObject{"e": pvalue}
+		msg, ok := evalString(formatExceptionExpr, vars)
+		if !ok {
+			strObj := pyObject_Str(pvalue)
+			if strObj != 0 {
+				msg = pyUnicode_AsUTF8(strObj)
+				py_DecRef(strObj)
+			} else {
+				pyErr_Clear()
+			}
+		}
+		pyErr.Message = msg
+		pyErr.Type, _ = evalString(`type(e).__name__`, vars)
+		pyErr.Traceback, _ = evalString(tracebackExpr, vars)
 	}
 
 	if ptype != 0 {
@@ -327,107 +842,547 @@ func fetchPythonError() error {
 		py_DecRef(ptraceback)
 	}
 
-	if msg == "" {
-		return ErrRunFailed
+	if kindErr != nil {
+		return kindErr
+	}
+	return pyErr
+}
+
+// evalString evaluates a Python expression with the supplied variables in scope and returns the
+// str() of the result. The Python error state is cleared if the evaluation fails.
+func evalString(expr string, vars map[string]pyObject) (string, bool) {
+	result := evalObject(expr, vars)
+	if result == 0 {
+		pyErr_Clear()
+		return "", false
+	}
+	defer py_DecRef(result)
+
+	strObj := pyObject_Str(result)
+	if strObj == 0 {
+		pyErr_Clear()
+		return "", false
+	}
+	defer py_DecRef(strObj)
+	return pyUnicode_AsUTF8(strObj), true
+}
+
+// evalObject evaluates a Python expression with the supplied variables in scope and returns a new
+// reference to the result, or 0 with the Python error set if the evaluation fails.
+func evalObject(expr string, vars map[string]pyObject) pyObject {
+	scope := pyDict_New()
+	if scope == 0 {
+		return 0
+	}
+	defer py_DecRef(scope)
+	pyDict_SetItemString(scope, "__builtins__", pyEval_GetBuiltins())
+	for name, value := range vars {
+		pyDict_SetItemString(scope, name, value)
+	}
+
+	return pyRun_String(expr, pyEvalInput, scope, scope)
+}
+
+// awaitExpr is a Python expression which runs the coroutine bound to c to completion, as returned by
+// calling an async def run function.
+const awaitExpr = `__import__("asyncio").run(c) if __import__("inspect").iscoroutine(c) else c`
+
+// awaitLoopExpr is a Python expression which runs the coroutine bound to c to completion on the event
+// loop bound to loop.
+const awaitLoopExpr = `loop.run_until_complete(c) if __import__("inspect").iscoroutine(c) else c`
+
+// await runs the coroutine to completion and returns a new reference to its result. The coroutine runs
+// on the worker's event loop when one is configured, or on a new event loop otherwise.
+func (w *worker) await(coro pyObject) (pyObject, error) {
+	var awaited pyObject
+	if w.config.eventLoop {
+		if w.loop == 0 {
+			w.loop = evalObject(`__import__("asyncio").new_event_loop()`, nil)
+			if w.loop == 0 {
+				return 0, fetchPythonError()
+			}
+		}
+		awaited = evalObject(awaitLoopExpr, map[string]pyObject{"c": coro, "loop": w.loop})
+	} else {
+		awaited = evalObject(awaitExpr, map[string]pyObject{"c": coro})
+	}
+	if awaited == 0 {
+		return 0, fetchPythonError()
+	}
+	return awaited, nil
+}
+
+// closeEventLoop closes the worker's event loop if one was created.
+func (w *worker) closeEventLoop() {
+	if w.loop == 0 {
+		return
+	}
+	if result := evalObject("loop.close()", map[string]pyObject{"loop": w.loop}); result != 0 {
+		py_DecRef(result)
+	} else {
+		pyErr_Clear()
 	}
-	return fmt.Errorf("%w: %s", ErrRunFailed, msg)
+	py_DecRef(w.loop)
+	w.loop = 0
 }
 
 // callRun invokes the run function defined in globals with the JSON input,
 // and returns the JSON-serialized result.
-func callRun(globals pyObject, jsonInput string) (string, error) {
+func callRun(w *worker, globals pyObject, jsonInput string) (string, error) {
+	runfn, err := runFunc(globals)
+	if err != nil {
+		return "", err
+	}
+
+	parsedInput, err := loadJSON(jsonInput)
+	if err != nil {
+		return "", err
+	}
+	defer py_DecRef(parsedInput)
+
+	return callRunWith(w, runfn, parsedInput)
+}
+
+// callRunBytes invokes the run function defined in globals with the data as a Python bytes object, and
+// returns the JSON-serialized result.
+func callRunBytes(w *worker, globals pyObject, data []byte) (string, error) {
+	runfn, err := runFunc(globals)
+	if err != nil {
+		return "", err
+	}
+
+	input, err := newBytes(data)
+	if err != nil {
+		return "", err
+	}
+	defer py_DecRef(input)
+
+	return callRunWith(w, runfn, input)
+}
+
+// runFunc returns a borrowed reference to the run function defined in globals.
+func runFunc(globals pyObject) (pyObject, error) {
 	runfn := pyDict_GetItemString(globals, "run")
 	if runfn == 0 {
-		return "", fmt.Errorf("%w: run() function not defined", ErrRunFailed)
+		return 0, fmt.Errorf("%w: run() function not defined", ErrRunFailed)
+	}
+	return runfn, nil
+}
+
+// newBytes returns a new reference to a Python bytes object holding a copy of data.
+func newBytes(data []byte) (pyObject, error) {
+	var ptr *byte
+	if len(data) > 0 {
+		ptr = &data[0]
+	}
+	obj := pyBytes_FromStringAndSize(ptr, len(data))
+	if obj == 0 {
+		return 0, fetchPythonError()
+	}
+	return obj, nil
+}
+
+// callRunWith invokes the run function with the parsed input and returns the JSON-serialized result.
+func callRunWith(w *worker, runfn pyObject, parsedInput pyObject) (string, error) {
+	result, err := invokeRun(w, runfn, parsedInput)
+	if err != nil {
+		return "", err
+	}
+	defer py_DecRef(result)
+
+	return dumpJSON(w, result)
+}
+
+// invokeRun invokes the run function with the parsed input and returns a new reference to the result,
+// awaiting it if run is a coroutine function.
+func invokeRun(w *worker, runfn pyObject, parsedInput pyObject) (pyObject, error) {
+	runArgs := pyTuple_New(1)
+	if runArgs == 0 {
+		return 0, fmt.Errorf("%w: failed to create run args tuple", ErrRunFailed)
+	}
+	py_IncRef(parsedInput)
+	pyTuple_SetItem(runArgs, 0, parsedInput)
+
+	result := pyObject_Call(runfn, runArgs, 0)
+	py_DecRef(runArgs)
+	if result == 0 {
+		if pyErr_Occurred() != 0 {
+			return 0, fetchPythonError()
+		}
+		return 0, fmt.Errorf("%w: run() returned NULL", ErrRunFailed)
+	}
+
+	return w.resolve(result)
+}
+
+// callObject calls obj with the arguments in the JSON array and returns the JSON-serialized result,
+// awaiting it if obj is a coroutine function.
+func callObject(w *worker, obj pyObject, jsonArgs string) (string, error) {
+	args, err := loadJSON(jsonArgs)
+	if err != nil {
+		return "", err
+	}
+	defer py_DecRef(args)
+
+	result := evalObject("f(*args)", map[string]pyObject{"f": obj, "args": args})
+	if result == 0 {
+		return "", fetchPythonError()
+	}
+	result, err = w.resolve(result)
+	if err != nil {
+		return "", err
+	}
+	defer py_DecRef(result)
+
+	return dumpJSON(w, result)
+}
+
+// resolve returns the value of result, running it to completion first if it is awaitable. It takes
+// ownership of result and returns a new reference.
+func (w *worker) resolve(result pyObject) (pyObject, error) {
+	if pyObject_HasAttrString(result, "__await__") == 0 {
+		return result, nil
 	}
+	defer py_DecRef(result)
+	return w.await(result)
+}
 
-	json := pyImport_ImportModule("json")
+// jsonFunc imports the json module and returns a new reference to the named function.
+func jsonFunc(name string) (pyObject, error) {
+	json := jsonModule()
 	if json == 0 {
-		if pyErr_Occurred() {
-			return "", fetchPythonError()
+		msg := "failed to import json module"
+		if pyErr_Occurred() != 0 {
+			msg = fetchPythonError().Error()
 		}
-		return "", fmt.Errorf("%w: failed to import json module", ErrRunFailed)
+		return 0, fmt.Errorf("%w: %s; check that PYTHONHOME and sys.path locate the standard library",
+			ErrStdlibUnavailable, msg)
 	}
 	defer py_DecRef(json)
 
-	loadsfn := pyObject_GetAttrString(json, "loads")
-	if loadsfn == 0 {
-		if pyErr_Occurred() {
-			return "", fetchPythonError()
+	fn := pyObject_GetAttrString(json, name)
+	if fn == 0 {
+		if pyErr_Occurred() != 0 {
+			return 0, fetchPythonError()
 		}
-		return "", fmt.Errorf("%w: failed to get json.loads", ErrRunFailed)
+		return 0, fmt.Errorf("%w: failed to get json.%s", ErrRunFailed, name)
 	}
-	defer py_DecRef(loadsfn)
+	return fn, nil
+}
 
-	dumpsfn := pyObject_GetAttrString(json, "dumps")
-	if dumpsfn == 0 {
-		if pyErr_Occurred() {
-			return "", fetchPythonError()
+// jsonModule returns a new reference to the module which encodes and decodes JSON in the current
+// interpreter: the module selected with WithJSONModule, recorded as _serpent_go._json by the worker
+// initialization code, or the json module.
+func jsonModule() pyObject {
+	if serpent := pyImport_ImportModule("_serpent_go"); serpent != 0 {
+		defer py_DecRef(serpent)
+		if pyObject_HasAttrString(serpent, "_json") != 0 {
+			return pyObject_GetAttrString(serpent, "_json")
 		}
-		return "", fmt.Errorf("%w: failed to get json.dumps", ErrRunFailed)
+	} else {
+		pyErr_Clear()
 	}
-	defer py_DecRef(dumpsfn)
+	return pyImport_ImportModule("json")
+}
+
+// jsonModuleCode selects the module named by the %s placeholder, a Python string literal, as the JSON
+// module of the worker. orjson takes options as flags rather than keyword arguments and encodes to bytes,
+// so it is wrapped to accept the keyword arguments of json.dumps and to return a str; non-string keys are
+// converted to strings as json.dumps does. orjson has no option to escape non-ASCII characters, so
+// ensure_ascii is ignored, and it encodes NaN and infinite floats as null rather than failing, so unless
+// allow_nan is set an output holding null is checked by json.dumps, which raises the ValueError the json
+// module would. Other modules are used as they are. If the module cannot be imported the json module
+// remains in use.
+const jsonModuleCode = `
+def _select_json_module(name):
+    import importlib, json, types
+    try:
+        module = importlib.import_module(name)
+    except ImportError:
+        return
+    if name == "orjson":
+        orjson = module
+        def dumps(obj, sort_keys=False, ensure_ascii=True, allow_nan=True, default=None):
+            option = orjson.OPT_NON_STR_KEYS | (orjson.OPT_SORT_KEYS if sort_keys else 0)
+            data = orjson.dumps(obj, default=default, option=option)
+            if not allow_nan and b"null" in data:
+                try:
+                    json.dumps(obj, allow_nan=False, default=default)
+                except TypeError:
+                    pass
+            return data.decode()
+        module = types.SimpleNamespace(loads=orjson.loads, dumps=dumps)
+    sys.modules["_serpent_go"]._json = module
+_select_json_module(%s)
+`
+
+// loadJSON parses the JSON document using json.loads and returns a new reference to the result.
+func loadJSON(jsonInput string) (pyObject, error) {
+	loadsfn, err := jsonFunc("loads")
+	if err != nil {
+		return 0, err
+	}
+	defer py_DecRef(loadsfn)
 
 	input := pyUnicode_FromString(jsonInput)
 	if input == 0 {
-		if pyErr_Occurred() {
-			return "", fetchPythonError()
+		if pyErr_Occurred() != 0 {
+			return 0, fetchPythonError()
 		}
-		return "", fmt.Errorf("%w: failed to create input string", ErrRunFailed)
+		return 0, fmt.Errorf("%w: failed to create input string", ErrRunFailed)
 	}
 	defer py_DecRef(input)
 
 	loadsArgs := pyTuple_New(1)
 	if loadsArgs == 0 {
-		return "", fmt.Errorf("%w: failed to create loads args tuple", ErrRunFailed)
+		return 0, fmt.Errorf("%w: failed to create loads args tuple", ErrRunFailed)
 	}
 	py_IncRef(input)
 	pyTuple_SetItem(loadsArgs, 0, input)
 
-	parsedInput := pyObject_Call(loadsfn, loadsArgs, 0)
+	parsed := pyObject_Call(loadsfn, loadsArgs, 0)
 	py_DecRef(loadsArgs)
-	if parsedInput == 0 {
-		if pyErr_Occurred() {
-			return "", fetchPythonError()
+	if parsed == 0 {
+		if pyErr_Occurred() != 0 {
+			return 0, fetchPythonError()
 		}
-		return "", fmt.Errorf("%w: failed to parse input JSON", ErrRunFailed)
+		return 0, fmt.Errorf("%w: failed to parse input JSON", ErrRunFailed)
 	}
-	defer py_DecRef(parsedInput)
+	return parsed, nil
+}
 
-	runArgs := pyTuple_New(1)
-	if runArgs == 0 {
-		return "", fmt.Errorf("%w: failed to create run args tuple", ErrRunFailed)
+// dumpJSON serializes the object to a JSON string using json.dumps with the configured flags and the
+// worker's default serializer.
+func dumpJSON(w *worker, obj pyObject) (string, error) {
+	jsonResult, err := dumpJSONObject(w, obj)
+	if err != nil {
+		return "", err
 	}
-	py_IncRef(parsedInput)
-	pyTuple_SetItem(runArgs, 0, parsedInput)
+	defer py_DecRef(jsonResult)
 
-	result := pyObject_Call(runfn, runArgs, 0)
-	py_DecRef(runArgs)
-	if result == 0 {
-		if pyErr_Occurred() {
-			return "", fetchPythonError()
+	var size int
+	data := pyUnicode_AsUTF8AndSize(jsonResult, &size)
+	if data == nil {
+		return "", fetchPythonError()
+	}
+	return string(unsafe.Slice(data, size)), nil
+}
+
+// dumpJSONObject serializes the object using json.dumps and returns a new reference to the resulting
+// str, failing if it exceeds the configured size limit.
+func dumpJSONObject(w *worker, obj pyObject) (pyObject, error) {
+	dumpsfn, err := jsonFunc("dumps")
+	if err != nil {
+		return 0, err
+	}
+	defer py_DecRef(dumpsfn)
+
+	if w.config.bigIntAsString || w.config.namedTuples {
+		if _, err := w.defaultSerializer(); err != nil {
+			return 0, err
 		}
-		return "", fmt.Errorf("%w: run() returned NULL", ErrRunFailed)
+		obj = evalObject("f(o)", map[string]pyObject{"f": w.jsonConvert, "o": obj})
+		if obj == 0 {
+			return 0, fmt.Errorf("%w: %w", ErrResultNotSerializable, fetchPythonError())
+		}
+		defer py_DecRef(obj)
 	}
-	defer py_DecRef(result)
 
 	dumpsArgs := pyTuple_New(1)
 	if dumpsArgs == 0 {
-		return "", fmt.Errorf("%w: failed to create dumps args tuple", ErrRunFailed)
+		return 0, fmt.Errorf("%w: failed to create dumps args tuple", ErrRunFailed)
 	}
-	py_IncRef(result)
-	pyTuple_SetItem(dumpsArgs, 0, result)
+	py_IncRef(obj)
+	pyTuple_SetItem(dumpsArgs, 0, obj)
 
-	jsonResult := pyObject_Call(dumpsfn, dumpsArgs, 0)
+	dumpsKwargs, err := dumpsKeywords(w)
+	if err != nil {
+		py_DecRef(dumpsArgs)
+		return 0, err
+	}
+
+	jsonResult := pyObject_Call(dumpsfn, dumpsArgs, dumpsKwargs)
 	py_DecRef(dumpsArgs)
+	py_DecRef(dumpsKwargs)
 	if jsonResult == 0 {
-		if pyErr_Occurred() {
+		// Circular references, excessive nesting, NaN and infinite floats and unsupported types are all
+		// reported here.
+		if pyErr_Occurred() != 0 {
+			return 0, fmt.Errorf("%w: %w", ErrResultNotSerializable, fetchPythonError())
+		}
+		return 0, ErrResultNotSerializable
+	}
+
+	// The size is checked before the result is copied out of the interpreter.
+	var size int
+	if pyUnicode_AsUTF8AndSize(jsonResult, &size) == nil {
+		py_DecRef(jsonResult)
+		return 0, fetchPythonError()
+	}
+	if limit := w.config.maxResultBytes; limit > 0 && size > limit {
+		py_DecRef(jsonResult)
+		return 0, fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrResultTooLarge, size, limit)
+	}
+	return jsonResult, nil
+}
+
+// dumpsKeywords returns a new reference to the keyword arguments dict passed to json.dumps.
+func dumpsKeywords(w *worker) (pyObject, error) {
+	defaultfn, err := w.defaultSerializer()
+	if err != nil {
+		return 0, err
+	}
+
+	kwargs := pyDict_New()
+	if kwargs == 0 {
+		return 0, fmt.Errorf("%w: failed to create dumps kwargs dict", ErrRunFailed)
+	}
+	setBoolItem(kwargs, "sort_keys", w.config.sortKeys)
+	setBoolItem(kwargs, "ensure_ascii", w.config.ensureASCII)
+	// NaN and infinite floats would be written as literals which are not valid JSON and which Go cannot
+	// decode, so they are rejected while the failing value can still be reported.
+	setBoolItem(kwargs, "allow_nan", false)
+	pyDict_SetItemString(kwargs, "default", defaultfn)
+	return kwargs, nil
+}
+
+// defaultSerializerCode defines the default function passed to json.dumps, which converts objects that
+// the json module cannot serialize into ones it can, such as dataclasses into dicts of their fields and
+// fractions and decimals into strings when exact is set for WithExactNumbers. It also defines convert,
+// which is applied to a result before it is encoded to replace the integers a float64 cannot represent
+// exactly with strings for WithBigIntAsString, and NamedTuples, which the json module encodes as arrays
+// without consulting default, with dicts for WithNamedTuplesAsObjects.
+const defaultSerializerCode = `
+import sys
+
+# exact is set for WithExactNumbers, and big_ints and named_tuples for the conversions applied by convert.
+exact = False
+big_ints = False
+named_tuples = False
+
+def fields(o):
+    # numpy, fractions, decimal and dataclasses are only consulted when a program has already imported them.
+    dataclasses = sys.modules.get("dataclasses")
+    if dataclasses is not None and dataclasses.is_dataclass(o) and not isinstance(o, type):
+        return {f.name: getattr(o, f.name) for f in dataclasses.fields(o)}
+    if isinstance(o, tuple) and hasattr(o, "_asdict"):
+        return o._asdict()
+    return None
+
+def default(o):
+    numpy = sys.modules.get("numpy")
+    if numpy is not None and isinstance(o, numpy.generic):
+        return o.item()
+    d = fields(o)
+    if d is not None:
+        return d
+    if exact:
+        fractions = sys.modules.get("fractions")
+        if fractions is not None and isinstance(o, fractions.Fraction):
+            return str(o)
+        decimal = sys.modules.get("decimal")
+        if decimal is not None and isinstance(o, decimal.Decimal):
+            if not o.is_finite():
+                raise ValueError(f"Out of range decimal values are not JSON compliant: {o}")
+            return str(o)
+    raise TypeError(f"Object of type {type(o).__name__} is not JSON serializable")
+
+def convert(o):
+    if isinstance(o, int) and not isinstance(o, bool):
+        return str(o) if big_ints and abs(o) > 9007199254740991 else o
+    if isinstance(o, dict):
+        return {k: convert(v) for k, v in o.items()}
+    if named_tuples and isinstance(o, tuple) and hasattr(o, "_asdict"):
+        return {k: convert(v) for k, v in o._asdict().items()}
+    if isinstance(o, (list, tuple)):
+        return [convert(v) for v in o]
+    numpy = sys.modules.get("numpy")
+    if numpy is not None and isinstance(o, numpy.integer):
+        return convert(o.item())
+    d = fields(o)
+    if d is not None:
+        return {k: convert(v) for k, v in d.items()}
+    return o
+`
+
+// defaultSerializer returns a borrowed reference to the worker's default serializer, defining it and
+// convert in the worker's interpreter on first use.
+func (w *worker) defaultSerializer() (pyObject, error) {
+	if w.jsonDefault != 0 {
+		return w.jsonDefault, nil
+	}
+
+	globals := pyDict_New()
+	defer py_DecRef(globals)
+	pyDict_SetItemString(globals, "__builtins__", pyEval_GetBuiltins())
+
+	result := pyRun_String(defaultSerializerCode, pyFileInput, globals, globals)
+	if result == 0 {
+		return 0, fetchPythonError()
+	}
+	py_DecRef(result)
+	setBoolItem(globals, "exact", w.config.exactNumbers)
+	setBoolItem(globals, "big_ints", w.config.bigIntAsString)
+	setBoolItem(globals, "named_tuples", w.config.namedTuples)
+
+	w.jsonConvert = pyDict_GetItemString(globals, "convert")
+	py_IncRef(w.jsonConvert)
+	fn := pyDict_GetItemString(globals, "default")
+	py_IncRef(fn)
+	w.jsonDefault = fn
+	return fn, nil
+}
+
+// setBoolItem sets the key in dict to the Python bool corresponding to value.
+func setBoolItem(dict pyObject, key string, value bool) {
+	var v int
+	if value {
+		v = 1
+	}
+	obj := pyBool_FromLong(v)
+	pyDict_SetItemString(dict, key, obj)
+	py_DecRef(obj)
+}
+
+// getGlobal returns the JSON-serialized value of the named global defined in globals.
+func getGlobal(w *worker, globals pyObject, name string) (string, error) {
+	value := pyDict_GetItemString(globals, name)
+	if value == 0 {
+		return "", fmt.Errorf("%w: global %q not defined", ErrRunFailed, name)
+	}
+	return dumpJSON(w, value)
+}
+
+// getGlobals returns the named variables defined in globals as a JSON-serialized object.
+func getGlobals(w *worker, globals pyObject, names []string) (string, error) {
+	values := pyDict_New()
+	if values == 0 {
+		return "", fetchPythonError()
+	}
+	defer py_DecRef(values)
+
+	for _, name := range names {
+		value := pyDict_GetItemString(globals, name)
+		if value == 0 {
+			return "", fmt.Errorf("%w: global %q not defined", ErrRunFailed, name)
+		}
+		if pyDict_SetItemString(values, name, value) != 0 {
 			return "", fetchPythonError()
 		}
-		return "", fmt.Errorf("%w: failed to serialize result to JSON", ErrRunFailed)
 	}
-	defer py_DecRef(jsonResult)
+	return dumpJSON(w, values)
+}
 
-	resultStr := pyUnicode_AsUTF8(jsonResult)
-	return resultStr, nil
+// metadataExpr is a Python expression which collects the conventional metadata globals from g.
+const metadataExpr = `{k.strip("_"): g[k] for k in ("__doc__", "__version__", "__author__", "__license__", ` +
+	`"__copyright__", "__email__", "__status__") if g.get(k) is not None}`
+
+// getMetadata returns the JSON-serialized metadata defined in globals.
+func getMetadata(w *worker, globals pyObject) (string, error) {
+	metadata := evalObject(metadataExpr, map[string]pyObject{"g": globals})
+	if metadata == 0 {
+		return "", fetchPythonError()
+	}
+	defer py_DecRef(metadata)
+	return dumpJSON(w, metadata)
 }
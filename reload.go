@@ -0,0 +1,50 @@
+package serpent
+
+// Reload replaces the executable's program with program, such as after editing its source during
+// development, without restarting the pool. The new module body is run on the worker the executable is
+// pinned to, in fresh module-level state which replaces the old once it succeeds; modules imported by the
+// old program stay cached in the worker's interpreter, so edits to them are not picked up. If the new
+// program fails to compile or its module body raises, the error is returned and the old program remains
+// loaded, with its state as it was.
+func (e *Executable[TInput, TResult]) Reload(program Program[TInput, TResult]) error {
+	return e.reload(string(program))
+}
+
+// Reload replaces the writer program like [Executable.Reload].
+func (e *WriterExecutable[TInput]) Reload(program Program[TInput, Writer]) error {
+	return e.reload(generateWriterCode(string(program)))
+}
+
+// Reload replaces the pipe program like [Executable.Reload].
+func (e *PipeExecutable[TInput]) Reload(program Program[TInput, Pipe]) error {
+	return e.reload(generatePipeCode(string(program)))
+}
+
+// reload runs code on the pinned worker in new globals and, if it succeeds, makes them the executable's
+// state in place of the old, which is released.
+func (b *executable) reload(code string) error {
+	if b.worker == nil {
+		return ErrNotInitialized
+	}
+
+	state, w := b.state, b.worker
+	_, err := b.dispatch(&execContext{
+		call: func(old pyObject) (string, error) {
+			globals := pyDict_New()
+			pyDict_SetItemString(globals, "__builtins__", pyEval_GetBuiltins())
+			if err := execProgram(w.config, code, globals); err != nil {
+				py_DecRef(globals)
+				return "", err
+			}
+			py_DecRef(old)
+			state.globals = globals
+			state.code = code
+			return "", nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	b.code = code
+	return nil
+}
@@ -0,0 +1,93 @@
+package serpent
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrResultNotOK is returned by [RunResult] when a program returns a result with "ok" set to false. See
+// [ResultError].
+var ErrResultNotOK = errors.New("result not ok")
+
+// ErrInvalidEnum is returned by [RunEnum] when a program returns a value which is not one of the allowed
+// values.
+var ErrInvalidEnum = errors.New("invalid enum value")
+
+// ResultError is returned by [RunResult] when a program reports a failure in its result rather than by
+// raising an exception.
+type ResultError struct {
+	// Message is the "error" field of the result.
+	Message string
+}
+
+// Error implements the error interface.
+func (e *ResultError) Error() string {
+	if e.Message == "" {
+		return ErrResultNotOK.Error()
+	}
+	return fmt.Sprintf("%v: %s", ErrResultNotOK, e.Message)
+}
+
+// Unwrap returns [ErrResultNotOK].
+func (e *ResultError) Unwrap() error {
+	return ErrResultNotOK
+}
+
+// resultEnvelope is the result of a program run with RunResult.
+type resultEnvelope[T any] struct {
+	OK    *bool  `json:"ok"`
+	Value T      `json:"value"`
+	Error string `json:"error"`
+}
+
+// RunResult runs a [Program] like [Run] for programs which report failures as values rather than by
+// raising exceptions. The program's run() function returns an object with the fields:
+//
+//   - "ok": true if the run succeeded and false otherwise; required.
+//   - "value": the result, decoded into TVal when ok is true; it may be omitted.
+//   - "error": a message describing the failure when ok is false.
+//
+// A result with ok set to false is returned as a [*ResultError] carrying the message. Exceptions raised
+// by the program still fail the run as with [Run].
+//
+// Example Python program:
+//
+//	def run(input):
+//	    if input < 0:
+//	        return {"ok": False, "error": "input must not be negative"}
+//	    return {"ok": True, "value": input ** 0.5}
+func RunResult[TInput, TVal any](program Program[TInput, TVal], arg TInput) (TVal, error) {
+	result, err := Run(Program[TInput, resultEnvelope[TVal]](program), arg)
+	if err != nil {
+		return *new(TVal), err
+	}
+	if result.OK == nil {
+		return *new(TVal), fmt.Errorf("unmarshal result: missing \"ok\" field")
+	}
+	if !*result.OK {
+		return *new(TVal), &ResultError{Message: result.Error}
+	}
+	return result.Value, nil
+}
+
+// RunEnum runs a [Program] like [Run] for programs which return one of a fixed set of string values, such
+// as classification labels. A result which is not in allowed fails the run with [ErrInvalidEnum], so
+// unexpected values are rejected at the boundary rather than passed on to the caller.
+//
+// Example:
+//
+//	type Sentiment string
+//
+//	label, err := serpent.RunEnum(program, text, []Sentiment{"positive", "negative", "neutral"})
+func RunEnum[TInput any, T ~string](program Program[TInput, T], arg TInput, allowed []T) (T, error) {
+	result, err := Run(program, arg)
+	if err != nil {
+		return "", err
+	}
+	for _, value := range allowed {
+		if result == value {
+			return result, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrInvalidEnum, result)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package serpent
+
+// setAddressSpaceLimit does nothing on platforms other than Linux, where memory limits are not enforced.
+func setAddressSpaceLimit(limit uint64) (uint64, error) {
+	return 0, nil
+}
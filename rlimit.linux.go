@@ -0,0 +1,20 @@
+//go:build linux
+
+package serpent
+
+import "syscall"
+
+// setAddressSpaceLimit sets the soft RLIMIT_AS of the process to limit bytes and returns the previous
+// soft limit.
+func setAddressSpaceLimit(limit uint64) (uint64, error) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_AS, &rlim); err != nil {
+		return 0, err
+	}
+	prev := rlim.Cur
+	rlim.Cur = limit
+	if err := syscall.Setrlimit(syscall.RLIMIT_AS, &rlim); err != nil {
+		return 0, err
+	}
+	return prev, nil
+}
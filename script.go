@@ -0,0 +1,72 @@
+package serpent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrNoResult is returned by [Script.Run] when the script does not assign result.
+var ErrNoResult = errors.New("no result")
+
+// scriptCode is the program which runs a script. The script's source, substituted as a string literal, is
+// compiled once when the program is loaded and executed by each run in a fresh module namespace.
+const scriptCode = `__serpent_script__ = compile(%s, "<script>", "exec")
+
+def run(input):
+    scope = {"__builtins__": __builtins__, "__name__": "__main__", "input": input}
+    exec(__serpent_script__, scope)
+    if "result" not in scope:
+        return {"assigned": False, "result": None}
+    return {"assigned": True, "result": scope["result"]}
+`
+
+// scriptResult is the result of scriptCode.
+type scriptResult[TResult any] struct {
+	Assigned bool    `json:"assigned"`
+	Result   TResult `json:"result"`
+}
+
+// Script is a program written in the module-level style, which reads the global input and assigns its
+// output to the global result instead of defining run(). The source is compiled into a code object once,
+// when the script is loaded, and each run executes it with the new input, so repeated runs pay only for
+// executing the code. Like an [Executable], a Script is pinned to a single worker and is not safe for
+// concurrent use. Each run starts from a fresh namespace holding only input; modules imported by the
+// script stay cached in the worker's interpreter between runs.
+//
+// Example:
+//
+//	script, err := serpent.LoadScript(serpent.Program[int, int]("result = input * 2"))
+type Script[TInput, TResult any] struct {
+	exec *Executable[TInput, scriptResult[TResult]]
+}
+
+// LoadScript compiles a program written in the module-level style on a worker of the default pool and
+// returns a [Script] which runs it. A script with a syntax error is rejected by LoadScript.
+func LoadScript[TInput, TResult any](program Program[TInput, TResult]) (*Script[TInput, TResult], error) {
+	// A JSON string is also a valid Python string literal.
+	source, _ := json.Marshal(string(program))
+	exec, err := Load(Program[TInput, scriptResult[TResult]](fmt.Sprintf(scriptCode, source)))
+	if err != nil {
+		return nil, err
+	}
+	return &Script[TInput, TResult]{exec: exec}, nil
+}
+
+// Run executes the script with arg bound to input and returns the value it assigned to result. A script
+// which does not assign result fails with [ErrNoResult].
+func (s *Script[TInput, TResult]) Run(arg TInput) (TResult, error) {
+	value, err := s.exec.Run(arg)
+	if err != nil {
+		return *new(TResult), err
+	}
+	if !value.Assigned {
+		return *new(TResult), fmt.Errorf("%w: result not assigned by the script", ErrNoResult)
+	}
+	return value.Result, nil
+}
+
+// Close releases the worker state of the script. The script must not be used afterwards.
+func (s *Script[TInput, TResult]) Close() error {
+	return s.exec.Close()
+}
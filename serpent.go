@@ -7,8 +7,9 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -20,55 +21,194 @@ var (
 	ErrSubInterpreterFailed = errors.New("sub-interpreter creation failed")
 	// ErrNoHealthyWorkers is returned when all workers have failed.
 	ErrNoHealthyWorkers = errors.New("no healthy workers available")
-	// ErrNotInitialized is returned when Close is called before Init.
+	// ErrNotInitialized is returned when serpent is used or closed before Init.
 	ErrNotInitialized = errors.New("not initialized")
+	// ErrStdlibUnavailable is returned when the Python standard library cannot be imported, or by [Init]
+	// when PYTHONHOME is set but does not contain it, which CPython would otherwise report by aborting the
+	// process. This almost always means that PYTHONHOME or sys.path does not point at the standard library
+	// of the loaded Python shared library.
+	ErrStdlibUnavailable = errors.New("standard library unavailable")
+	// ErrResultNotSerializable is returned when the result of a program cannot be serialized to JSON, such
+	// as when it contains a circular reference, is nested too deeply or contains an unsupported type.
+	ErrResultNotSerializable = errors.New("result not serializable")
+	// ErrInvalidInput is returned when the input to a program is invalid.
+	ErrInvalidInput = errors.New("invalid input")
+	// ErrDaemonThreadsDisabled is returned when a program starts a daemon thread in a sub-interpreter
+	// which was not created with [WithDaemonThreads].
+	ErrDaemonThreadsDisabled = errors.New("daemon threads disabled")
+	// ErrResultTooLarge is returned when the serialized result of a program exceeds the limit set with
+	// [WithMaxResultBytes].
+	ErrResultTooLarge = errors.New("result too large")
+	// ErrSourceTooLarge is returned when the source of a program exceeds the limit set with
+	// [WithMaxSourceBytes].
+	ErrSourceTooLarge = errors.New("source too large")
+	// ErrProgramExited is returned when a program calls sys.exit(). See [ExitError].
+	ErrProgramExited = errors.New("program exited")
+	// ErrWorkerExited is returned for requests to a worker which exited abnormally. See [NotifyWorkerExit].
+	ErrWorkerExited = errors.New("worker exited")
+	// ErrModeUnsupported is returned by [InitMode] when the requested mode is not supported by the Python
+	// library or the platform.
+	ErrModeUnsupported = errors.New("mode unsupported")
+	// ErrInitTimeout is returned for workers which did not initialize within the timeout set with
+	// [WithInitTimeout].
+	ErrInitTimeout = errors.New("worker initialization timed out")
+	// ErrStreamResult is returned by [Run], [Load] and the other functions which return the value of a
+	// program when given a program with a [Writer] or [Pipe] result, which must instead be run with
+	// [RunWrite] or [RunPipe] so that it is passed its streams.
+	ErrStreamResult = errors.New("stream result")
 )
 
+// errAborted is returned for requests which were abandoned before they started.
+var errAborted = errors.New("aborted")
+
+// ExitError is returned when a program calls sys.exit() or otherwise raises SystemExit. The exit does not
+// affect the host process or the worker, which continues to serve later runs.
+type ExitError struct {
+	// Code is the exit status the interpreter would exit with: the integer passed to sys.exit(), 0 when
+	// no argument or None is passed, and 1 for other values such as a message.
+	Code int
+	// Message is the text of a value other than an integer or None passed to sys.exit(), such as
+	// sys.exit("config missing"), which the interpreter would print to stderr on exit. It is empty
+	// otherwise.
+	Message string
+}
+
+// Error implements the error interface.
+func (e *ExitError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%v: exit code %d: %s", ErrProgramExited, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%v: exit code %d", ErrProgramExited, e.Code)
+}
+
+// Unwrap returns [ErrProgramExited].
+func (e *ExitError) Unwrap() error {
+	return ErrProgramExited
+}
+
+// PythonError is returned when a program fails with an uncaught exception. It carries the traceback
+// which the interpreter would print to stderr, so a failure can be logged from the error alone.
+type PythonError struct {
+	// Type is the name of the exception class, such as "ValueError".
+	Type string
+	// Message is the formatted exception: its message alone, or the full traceback for chained
+	// exceptions.
+	Message string
+	// Traceback is the traceback of the exception as traceback.print_exception would print it,
+	// including any chained exceptions.
+	Traceback string
+}
+
+// Error implements the error interface. The traceback is not included; see [PythonError.Traceback].
+func (e *PythonError) Error() string {
+	if e.Message == "" {
+		return ErrRunFailed.Error()
+	}
+	return fmt.Sprintf("%v: %s", ErrRunFailed, e.Message)
+}
+
+// Unwrap returns [ErrRunFailed].
+func (e *PythonError) Unwrap() error {
+	return ErrRunFailed
+}
+
 // PythonNotInitialized is a panic type indicating that the Python interpreter has not been initialized.
+//
+// Deprecated: functions no longer panic when serpent is not initialized; they return [ErrNotInitialized].
 type PythonNotInitialized string
 
 // Init initializes the Python interpreter with runtime.NumCPU() workers. This must be called before
 // any other functions in this package. When using packages that are incompatible with sub-interpreters,
 // use [InitSingleWorker] instead.
-func Init(libraryPath string) error {
-	supportsSubInterpreters, err := initPython(libraryPath)
-	if err != nil {
-		return err
-	}
-
-	numWorkers := runtime.NumCPU()
-	workerPool = &pool{
-		workers: make([]*worker, 0, numWorkers),
-	}
-	if supportsSubInterpreters && numWorkers > 1 {
-		return initWithSubInterpreters(numWorkers)
-	}
-	return initSingleWorker()
+func Init(libraryPath string, opts ...Option) error {
+	return initDefaultPool(libraryPath, poolSubInterpreters, opts)
 }
 
 // InitSingleWorker initializes the Python interpreter with a single worker, disabling sub-interpreters.
 // Use this when running Python code that uses C extension modules incompatible with sub-interpreters.
 // This must be called before any other functions in this package. Use [Init] for normal usage.
-func InitSingleWorker(libraryPath string) error {
-	if _, err := initPython(libraryPath); err != nil {
-		return err
+func InitSingleWorker(libraryPath string, opts ...Option) error {
+	return initDefaultPool(libraryPath, poolSingleWorker, opts)
+}
+
+// Mode selects how [InitMode] runs programs.
+type Mode int
+
+const (
+	// ModeAuto uses a sub-interpreter per CPU when they are supported and a single worker otherwise, as
+	// [Init] does.
+	ModeAuto Mode = iota
+	// ModeSingleWorker uses a single worker in the main interpreter, as [InitSingleWorker] does.
+	ModeSingleWorker
+	// ModeSubInterpreters uses a sub-interpreter per CPU, even on a single CPU.
+	ModeSubInterpreters
+	// ModeFreeThreaded uses a worker per CPU, even on a single CPU, in the one interpreter of a
+	// free-threaded build, as [WithFreeThreaded] does when such a build is loaded.
+	ModeFreeThreaded
+)
+
+// InitMode initializes the Python interpreter in the given mode regardless of what the platform
+// supports, making the choice explicit rather than implied by the function called. [ErrModeUnsupported]
+// is returned, leaving serpent uninitialized and the library unloaded, if the mode is not supported, such
+// as ModeSubInterpreters with a Python library older than 3.12 or ModeFreeThreaded with a build which has a
+// GIL.
+func InitMode(libraryPath string, mode Mode, opts ...Option) error {
+	switch mode {
+	case ModeAuto:
+		return initDefaultPool(libraryPath, poolSubInterpreters, opts)
+	case ModeSingleWorker:
+		return initDefaultPool(libraryPath, poolSingleWorker, opts)
+	case ModeSubInterpreters:
+		return initDefaultPool(libraryPath, poolRequireSubInterpreters, opts)
+	case ModeFreeThreaded:
+		return initDefaultPool(libraryPath, poolRequireFreeThreaded, append(opts[:len(opts):len(opts)], WithFreeThreaded()))
+	default:
+		return fmt.Errorf("%w: unknown mode %d", ErrModeUnsupported, mode)
+	}
+}
+
+// AttachExisting attaches to a Python interpreter which has already been initialized by the host
+// process, for example by another embedding linked into the same program. The library at libraryPath
+// must be the one the host has loaded; opening it again returns the existing handle. The interpreter
+// is not initialized or finalized by this package and a single worker is used which acquires the GIL
+// for each request, so the host must not hold the GIL while serpent runs programs. [Close] detaches from
+// the interpreter, leaving it running, and releases the handle to the library opened by AttachExisting.
+func AttachExisting(libraryPath string, opts ...Option) error {
+	return initDefaultPool(libraryPath, poolAttached, opts)
+}
+
+// initDefaultPool creates the default pool used by the package-level functions.
+func initDefaultPool(libraryPath string, mode poolMode, opts []Option) error {
+	if workerPool != nil {
+		return ErrAlreadyInitialized
 	}
 
-	workerPool = &pool{
-		workers: make([]*worker, 0, 1),
+	pool, err := newPool(libraryPath, mode, opts)
+	if pool != nil {
+		workerPool = pool
 	}
-	return initSingleWorker()
+	return err
 }
 
 // Run runs a [Program] with the supplied argument and returns the result. The Python code must
-// define a run() function that accepts the input and returns a JSON-serializable value.
+// define a run() function that accepts the input and returns a JSON-serializable value. The result is
+// decoded with encoding/json, so a pointer TResult is nil when run() returns None, and fields of a struct
+// whose keys are missing from a returned dict are left as their zero value.
 //
 // Example Python program:
 //
 //	def run(input):
 //	    return input + 1
 func Run[TInput, TResult any](program Program[TInput, TResult], arg TInput) (TResult, error) {
-	exec, err := Load(program)
+	if cache := defaultCache(); cache != nil && cacheable[TResult](arg) {
+		input, err := json.Marshal(arg)
+		if err != nil {
+			return *new(TResult), fmt.Errorf("marshal input: %w", err)
+		}
+		return runCached(cache, program, input)
+	}
+
+	exec, err := newExecutable(program)
 	if err != nil {
 		return *new(TResult), err
 	}
@@ -76,8 +216,39 @@ func Run[TInput, TResult any](program Program[TInput, TResult], arg TInput) (TRe
 	return exec.Run(arg)
 }
 
+// RunWithInfo runs a [Program] like [Run] and additionally returns a [RunInfo] describing where the
+// time was spent.
+func RunWithInfo[TInput, TResult any](program Program[TInput, TResult], arg TInput) (TResult, RunInfo, error) {
+	exec, err := newExecutable(program)
+	if err != nil {
+		return *new(TResult), RunInfo{}, err
+	}
+	defer exec.Close()
+	return exec.RunWithInfo(arg)
+}
+
+// RunJSON runs a [Program] with input which is already encoded as JSON and returns the result. This avoids
+// decoding and re-encoding input which arrives as JSON, such as the body of an HTTP request. The input
+// must be well-formed JSON; [ErrInvalidInput] is returned otherwise.
+func RunJSON[TInput, TResult any](program Program[TInput, TResult], input json.RawMessage) (TResult, error) {
+	if cache := defaultCache(); cache != nil && cacheable[TResult](nil) {
+		if !json.Valid(input) {
+			return *new(TResult), fmt.Errorf("%w: malformed JSON", ErrInvalidInput)
+		}
+		return runCached(cache, program, input)
+	}
+
+	exec, err := newExecutable(program)
+	if err != nil {
+		return *new(TResult), err
+	}
+	defer exec.Close()
+	return exec.RunJSON(input)
+}
+
 // RunWrite runs a [Program] with the supplied argument with the Python program writing to the supplied writer.
-// The Python code must define a run() function that accepts the input and a writer object.
+// The Python code must define a run() function that accepts the input and a writer object. A program which
+// also reads a stream, such as a binary blob alongside a JSON configuration, is run with [RunPipe].
 //
 // Example Python program:
 //
@@ -92,28 +263,67 @@ func RunWrite[TInput any](w io.Writer, program Program[TInput, Writer], arg TInp
 	return exec.Run(w, arg)
 }
 
-// Close shuts down the Python interpreter and all workers.
-func Close() error {
-	if python == 0 {
-		return ErrNotInitialized
+// RunPipe runs a [Program] with the supplied argument, with the Python program reading from r and writing
+// to w. The Python code must define a run() function that accepts the input, a reader object and a writer
+// object. r is read until EOF or until the program returns, whichever comes first; see [PipeExecutable.Run].
+//
+// Example Python program:
+//
+//	def run(input, reader, writer):
+//	    writer.write(reader.read().upper())
+func RunPipe[TInput any](r io.Reader, w io.Writer, program Program[TInput, Pipe], arg TInput) error {
+	exec, err := LoadPipe(program)
+	if err != nil {
+		return err
 	}
+	defer exec.Close()
+	return exec.Run(r, w, arg)
+}
 
-	if workerPool == nil {
-		return ErrNotInitialized
+// Broadcast runs a [Program] with the supplied argument once on every worker in the pool. Because each
+// worker has its own interpreter state, this is the way to touch all of them, e.g. to reload configuration
+// or run gc.collect(). The returned slice holds the error from each worker in pool order, with nil for
+// workers where the program succeeded. If serpent is not initialized, it holds only [ErrNotInitialized].
+func Broadcast[TInput any](program Program[TInput, struct{}], arg TInput) []error {
+	if err := checkInit(); err != nil {
+		return []error{err}
 	}
+	_, errs := broadcast(workerPool, program, arg)
+	return errs
+}
 
-	workerPool.closed.Store(true)
-	for _, w := range workerPool.workers {
-		close(w.requests)
+// broadcast runs program with arg once on every worker in the pool and returns the result and error of
+// each in pool order.
+func broadcast[TInput, TResult any](pool *Pool, program Program[TInput, TResult], arg TInput) ([]TResult, []error) {
+	results := make([]TResult, len(pool.workers))
+	errs := make([]error, len(pool.workers))
+	var wg sync.WaitGroup
+	wg.Add(len(pool.workers))
+	for i, w := range pool.workers {
+		go func(i int, w *worker) {
+			defer wg.Done()
+			exec := &Executable[TInput, TResult]{
+				executable: executable{code: string(program)},
+			}
+			exec.pinTo(w)
+			defer exec.Close()
+			results[i], errs[i] = exec.Run(arg)
+		}(i, w)
 	}
-	for _, w := range workerPool.workers {
-		<-w.done
+	wg.Wait()
+	return results, errs
+}
+
+// Close shuts down the default pool and, unless pools created with [NewPool] are still running, the
+// Python interpreter.
+func Close() error {
+	if workerPool == nil {
+		return ErrNotInitialized
 	}
 
-	python = 0
+	err := workerPool.Shutdown()
 	workerPool = nil
-
-	return nil
+	return err
 }
 
 // Executable represents a loaded Python program that can be called multiple times.
@@ -123,12 +333,33 @@ type Executable[TInput, TResult any] struct {
 	executable
 }
 
-// Load loads a Python program and returns an [Executable] that can be called multiple times.
-// The executable is pinned to a worker on first Run(), and all subsequent calls use the same worker.
+// Load loads a Python program and returns an [Executable] that can be called multiple times. The
+// executable is pinned to a worker, on which the program's module body is run before Load returns, so a
+// program with a syntax error or a failing import is rejected by Load rather than by its first run. All
+// calls use the same worker.
 func Load[TInput, TResult any](program Program[TInput, TResult]) (*Executable[TInput, TResult], error) {
-	checkInit()
+	exec, err := newExecutable(program)
+	if err != nil {
+		return nil, err
+	}
+	if err := exec.load(); err != nil {
+		return nil, err
+	}
+	return exec, nil
+}
+
+// newExecutable returns an [Executable] for the program pinned to a worker of the default pool, without
+// running its module body. It is used by functions which run the program once, where the body is run
+// with the first request instead.
+func newExecutable[TInput, TResult any](program Program[TInput, TResult]) (*Executable[TInput, TResult], error) {
+	if err := checkInit(); err != nil {
+		return nil, err
+	}
+	if err := checkValueResult[TResult](); err != nil {
+		return nil, err
+	}
 	exec := &Executable[TInput, TResult]{
-		executable: executable{code: string(program)},
+		executable: executable{code: string(program), pool: workerPool},
 	}
 	if err := exec.pin(); err != nil {
 		return nil, fmt.Errorf("pin: %w", err)
@@ -140,45 +371,326 @@ func Load[TInput, TResult any](program Program[TInput, TResult]) (*Executable[TI
 // On first call, the program is loaded on a worker and pinned to it.
 // Subsequent calls reuse the same worker and loaded state.
 func (e *Executable[TInput, TResult]) Run(arg TInput) (TResult, error) {
+	value, _, err := e.runWithInfo(arg, false, nil)
+	return value, err
+}
+
+// RunWithInfo executes the loaded program like [Executable.Run] and additionally returns a [RunInfo]
+// describing where the time was spent.
+func (e *Executable[TInput, TResult]) RunWithInfo(arg TInput) (TResult, RunInfo, error) {
+	return e.runWithInfo(arg, true, nil)
+}
+
+// runWithInfo executes the loaded program, recording the time spent on the worker in the returned RunInfo
+// if timed is set and the output and warnings of the run in capture if it is not nil.
+func (e *Executable[TInput, TResult]) runWithInfo(arg TInput, timed bool, capture *runCapture) (TResult, RunInfo, error) {
+	info := RunInfo{WorkerID: e.worker.id}
+	var timing *RunInfo
+	if timed {
+		timing = &info
+	}
+	_, handle := any(*new(TResult)).(Handle)
+
+	if m, ok := any(arg).(Marshaler); ok {
+		start := time.Now()
+		data, err := m.MarshalPython()
+		info.MarshalDuration = time.Since(start)
+		if err != nil {
+			return *new(TResult), info, fmt.Errorf("marshal input: %w", err)
+		}
+		if handle {
+			h, err := e.runHandle(func() (pyObject, error) { return newBytes(data) }, &info)
+			return any(h).(TResult), info, err
+		}
+
+		w := e.worker
+		value, err := e.run(&execContext{
+			call: func(globals pyObject) (string, error) {
+				return callRunBytes(w, globals, data)
+			},
+			timing:  timing,
+			capture: capture,
+		}, &info)
+		return value, info, err
+	}
+
+	start := time.Now()
 	input, err := json.Marshal(arg)
+	info.MarshalDuration = time.Since(start)
 	if err != nil {
-		return *new(TResult), fmt.Errorf("marshal input: %w", err)
+		return *new(TResult), info, fmt.Errorf("marshal input: %w", err)
 	}
+	if handle {
+		h, err := e.runHandle(func() (pyObject, error) { return loadJSON(string(input)) }, &info)
+		return any(h).(TResult), info, err
+	}
+
+	value, err := e.run(&execContext{input: string(input), timing: timing, capture: capture}, &info)
+	return value, info, err
+}
 
-	result, err := e.runOnWorker(string(input))
+// RunJSON executes the loaded program with input which is already encoded as JSON, skipping the
+// marshaling performed by [Executable.Run]. The input must be well-formed JSON.
+func (e *Executable[TInput, TResult]) RunJSON(input json.RawMessage) (TResult, error) {
+	if !json.Valid(input) {
+		return *new(TResult), fmt.Errorf("%w: malformed JSON", ErrInvalidInput)
+	}
+	var info RunInfo
+	return e.run(&execContext{input: string(input)}, &info)
+}
+
+// run dispatches the request and unmarshals the result, recording timings in info.
+func (e *Executable[TInput, TResult]) run(ctx *execContext, info *RunInfo) (TResult, error) {
+	result, err := e.result(ctx, info)
 	if err != nil {
 		return *new(TResult), err
 	}
 
+	start := time.Now()
 	var value TResult
-	if err := json.Unmarshal([]byte(result), &value); err != nil {
+	err = json.Unmarshal([]byte(result), &value)
+	info.UnmarshalDuration += time.Since(start)
+	if err != nil {
 		return *new(TResult), fmt.Errorf("unmarshal result: %w", err)
 	}
 
 	return value, nil
 }
 
+// result dispatches the request and returns the JSON result, recording timings in info.
+func (e *Executable[TInput, TResult]) result(ctx *execContext, info *RunInfo) (string, error) {
+	start := time.Now()
+	compressed := ctx.call == nil && e.worker.config.compression
+	if compressed {
+		timing, capture := ctx.timing, ctx.capture
+		var err error
+		if ctx, err = compressedContext(e.worker, ctx.input); err != nil {
+			return "", err
+		}
+		ctx.timing, ctx.capture = timing, capture
+	}
+	result, err := e.dispatch(ctx)
+	info.PythonDuration = time.Since(start)
+	if err != nil || !compressed {
+		return result, err
+	}
+
+	start = time.Now()
+	result, err = decompressResult(result)
+	info.UnmarshalDuration = time.Since(start)
+	return result, err
+}
+
+// RunInfo describes a single run of a program.
+type RunInfo struct {
+	// WorkerID identifies the worker which ran the program.
+	WorkerID int
+	// MarshalDuration is the time spent encoding the input as JSON in Go.
+	MarshalDuration time.Duration
+	// PythonDuration is the time spent dispatching the run to the worker and executing it, including
+	// decoding the input and encoding the result as JSON in Python.
+	PythonDuration time.Duration
+	// QueueDuration is the part of PythonDuration spent waiting for the worker to start the run, such as
+	// behind earlier runs on the same worker. It is only recorded by RunWithInfo.
+	QueueDuration time.Duration
+	// ExecDuration is the part of PythonDuration spent executing the run on the worker, during which the
+	// worker holds the GIL of its interpreter. It is only recorded by RunWithInfo.
+	ExecDuration time.Duration
+	// UnmarshalDuration is the time spent decoding the JSON result in Go.
+	UnmarshalDuration time.Duration
+}
+
+// slowRunHook is the callback registered with OnSlowRun.
+type slowRunHook struct {
+	threshold time.Duration
+	fn        func(info RunInfo)
+}
+
+// slowRun holds the registered slowRunHook, if any.
+var slowRun atomic.Pointer[slowRunHook]
+
+// OnSlowRun registers fn to be called when a run is still in flight threshold after it was dispatched to
+// its worker. The run is not cancelled. fn is called from a watchdog goroutine with the WorkerID of the run
+// and its PythonDuration so far; the other fields of the [RunInfo] are not set. fn is called at most once
+// per run, applies to every kind of run, and must be safe for concurrent use. Registering a new callback
+// replaces the previous one; a nil fn or non-positive threshold removes it.
+func OnSlowRun(threshold time.Duration, fn func(info RunInfo)) {
+	if fn == nil || threshold <= 0 {
+		slowRun.Store(nil)
+		return
+	}
+	slowRun.Store(&slowRunHook{threshold: threshold, fn: fn})
+}
+
+// codeTransform holds the function registered with SetCodeTransform, if any.
+var codeTransform atomic.Pointer[func(code string) string]
+
+// SetCodeTransform registers fn to transform the source of every program before it is compiled, such as
+// to instrument programs with coverage, tracing or profiling. fn is called with the program source each
+// time a program is loaded on a worker, and must return a program which still defines run() with the
+// same signature; line numbers in tracebacks refer to the transformed source. fn is called on the
+// worker's thread while it holds the GIL, and for runs cached with [WithCache] also to key their results
+// by the transformed source, so it must not call into this package, and must be safe for concurrent use.
+// Registering a new transform replaces the previous one and applies to programs loaded afterwards; a nil
+// fn removes it.
+//
+// Example wrapping every run in a profiler:
+//
+//	serpent.SetCodeTransform(func(code string) string {
+//	    return code + "\nimport cProfile\n_run = run\n" +
+//	        "def run(*args):\n    with cProfile.Profile() as p:\n        return _run(*args)\n"
+//	})
+func SetCodeTransform(fn func(code string) string) {
+	if fn == nil {
+		codeTransform.Store(nil)
+		return
+	}
+	codeTransform.Store(&fn)
+}
+
+// transformCode applies the function registered with SetCodeTransform, if any, to code.
+func transformCode(code string) string {
+	if transform := codeTransform.Load(); transform != nil {
+		return (*transform)(code)
+	}
+	return code
+}
+
+// stderrSink is the writer registered with SetStderr.
+type stderrSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// stderr holds the registered stderrSink, if any.
+var stderr atomic.Pointer[stderrSink]
+
+// SetStderr sets w as the writer to which the traceback of each failed run is written, as the interpreter
+// would print it to stderr, so failures can be followed in a log without inspecting every error. Tracebacks
+// are never written to the output of a [Writer] or [Pipe] program, which only receives what the program
+// writes. w is written from the goroutine which made the run, one traceback at a time, and a nil w, the
+// default, stops writing them. The traceback is also available from the returned [PythonError].
+func SetStderr(w io.Writer) {
+	if w == nil {
+		stderr.Store(nil)
+		return
+	}
+	stderr.Store(&stderrSink{w: w})
+}
+
+// writeTraceback writes the traceback of err to the writer registered with SetStderr, if any.
+func writeTraceback(err error) {
+	sink := stderr.Load()
+	var pyErr *PythonError
+	if sink == nil || !errors.As(err, &pyErr) || pyErr.Traceback == "" {
+		return
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	io.WriteString(sink.w, pyErr.Traceback+"\n")
+}
+
+// Global reads the module-level variable name from the program loaded by exec and returns it
+// unmarshaled into T. The program's module body is executed first if it has not yet been run, which
+// allows declarative values such as configuration or supported features to be read without calling
+// run().
+//
+// Example:
+//
+//	config, err := serpent.Global[map[string]any](exec, "CONFIG")
+func Global[T any](exec interface{ global(string) (string, error) }, name string) (T, error) {
+	result, err := exec.global(name)
+	if err != nil {
+		return *new(T), err
+	}
+
+	var value T
+	if err := json.Unmarshal([]byte(result), &value); err != nil {
+		return *new(T), fmt.Errorf("unmarshal global: %w", err)
+	}
+
+	return value, nil
+}
+
+// Globals reads the module-level variables names from the program loaded by exec and returns them
+// unmarshaled into a map keyed by name, failing if any is not defined. It is the equivalent of [Global] for
+// programs which leave several outputs in separate variables rather than building a result dict, and
+// reads them in one request, so the values are consistent with each other. Variables assigned by the
+// module body are available once the program is loaded, and those assigned by run() after it is called.
+//
+// Example:
+//
+//	// a = compute_a()
+//	// b = compute_b()
+//	values, err := serpent.Globals[float64](exec, "a", "b")
+func Globals[T any](exec interface {
+	globals([]string) (string, error)
+}, names ...string) (map[string]T, error) {
+	result, err := exec.globals(names)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]T
+	if err := json.Unmarshal([]byte(result), &values); err != nil {
+		return nil, fmt.Errorf("unmarshal globals: %w", err)
+	}
+
+	return values, nil
+}
+
+// SetGlobal sets the module-level variable name of the program loaded by exec to value, encoded as JSON
+// in Go and decoded into a Python object on the worker, replacing any existing value. The value is placed
+// directly in the program's globals and never appears in its source, so secrets such as API keys can be
+// passed to a program without being embedded in code which may be logged, transformed by
+// [SetCodeTransform] or shown in tracebacks. As module-level state, the variable is visible to later runs
+// of exec and not to other executables.
+//
+// Example:
+//
+//	err := serpent.SetGlobal(exec, "API_KEY", os.Getenv("API_KEY"))
+func SetGlobal[T any](exec interface {
+	setGlobal(string, string) error
+}, name string, value T) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("marshal global: %w", err)
+	}
+	return exec.setGlobal(name, string(data))
+}
+
 // WriterExecutable represents a loaded Python program that writes to an output stream.
 // A [WriterExecutable] is not safe for concurrent use; create a separate instance for each goroutine.
 type WriterExecutable[TInput any] struct {
 	executable
 }
 
-// LoadWriter loads a Python program that writes to an output stream.
+// LoadWriter loads a Python program that writes to an output stream. As with [Load], the program's module
+// body is run before it returns.
 func LoadWriter[TInput any](program Program[TInput, Writer]) (*WriterExecutable[TInput], error) {
-	checkInit()
+	if err := checkInit(); err != nil {
+		return nil, err
+	}
 	exec := &WriterExecutable[TInput]{
-		executable: executable{code: generateWriterCode(string(program))},
+		executable: executable{code: generateWriterCode(string(program)), pool: workerPool},
 	}
-	if err := exec.pin(); err != nil {
-		return nil, fmt.Errorf("pin: %w", err)
+	if err := exec.load(); err != nil {
+		return nil, err
 	}
 	return exec, nil
 }
 
-// Run executes the loaded program, writing output to the provided writer.
+// Run executes the loaded program, writing output to the provided writer. The write end of the output
+// stream is owned by serpent and closed once run() returns, so the program does not need to close the
+// writer; closing it early, via writer.close() or its file descriptor, is also safe.
 func (e *WriterExecutable[TInput]) Run(w io.Writer, arg TInput) error {
-	pr, pw, err := os.Pipe()
+	// Marshal the argument before creating the pipe so a marshal failure does not need to unwind it.
+	data, err := json.Marshal(arg)
+	if err != nil {
+		return fmt.Errorf("marshal input: %w", err)
+	}
+
+	pr, pw, err := newPipe(e.worker.config)
 	if err != nil {
 		return fmt.Errorf("pipe: %w", err)
 	}
@@ -191,9 +703,9 @@ func (e *WriterExecutable[TInput]) Run(w io.Writer, arg TInput) error {
 	}()
 
 	input, err := json.Marshal(struct {
-		Input TInput
+		Input json.RawMessage
 		Fd    uintptr
-	}{arg, pw.Fd()})
+	}{data, pw.Fd()})
 	if err != nil {
 		pw.Close()
 		wg.Wait()
@@ -216,10 +728,110 @@ func (e *WriterExecutable[TInput]) Run(w io.Writer, arg TInput) error {
 	return nil
 }
 
+// PipeExecutable represents a loaded Python program that reads from an input stream and writes to an
+// output stream. A [PipeExecutable] is not safe for concurrent use; create a separate instance for each
+// goroutine.
+type PipeExecutable[TInput any] struct {
+	executable
+}
+
+// LoadPipe loads a Python program that reads from an input stream and writes to an output stream. As with
+// [Load], the program's module body is run before it returns.
+func LoadPipe[TInput any](program Program[TInput, Pipe]) (*PipeExecutable[TInput], error) {
+	if err := checkInit(); err != nil {
+		return nil, err
+	}
+	exec := &PipeExecutable[TInput]{
+		executable: executable{code: generatePipeCode(string(program)), pool: workerPool},
+	}
+	if err := exec.load(); err != nil {
+		return nil, err
+	}
+	return exec, nil
+}
+
+// Run executes the loaded program, reading input from r and writing output to w. Both streams are
+// copied concurrently with the program's execution so neither pipe can fill and block the program. r is
+// read until EOF or until the program returns, whichever comes first. Run does not wait for a read of r
+// which is still blocked when the program returns: it completes in the background, and what it read is
+// discarded.
+func (e *PipeExecutable[TInput]) Run(r io.Reader, w io.Writer, arg TInput) error {
+	data, err := json.Marshal(arg)
+	if err != nil {
+		return fmt.Errorf("marshal input: %w", err)
+	}
+
+	inR, inW, err := newPipe(e.worker.config)
+	if err != nil {
+		return fmt.Errorf("pipe: %w", err)
+	}
+	outR, outW, err := newPipe(e.worker.config)
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return fmt.Errorf("pipe: %w", err)
+	}
+
+	go func() {
+		defer inW.Close()
+		// The copy stops with EPIPE once the program returns, as the read end is then closed.
+		io.Copy(inW, r)
+	}()
+	outDone := make(chan struct{})
+	go func() {
+		defer close(outDone)
+		defer outR.Close()
+		io.Copy(w, outR)
+	}()
+
+	input, err := json.Marshal(struct {
+		Input json.RawMessage
+		InFd  uintptr
+		OutFd uintptr
+	}{data, inR.Fd(), outW.Fd()})
+	if err == nil {
+		_, err = e.runOnWorker(string(input))
+	} else {
+		err = fmt.Errorf("marshal input: %w", err)
+	}
+
+	inR.Close()
+	if closeErr := outW.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("close writer: %w", closeErr)
+	}
+	<-outDone
+
+	return err
+}
+
+// newPipe returns a connected pair of files, resizing the pipe when a buffer size is configured.
+func newPipe(cfg *config) (r *os.File, w *os.File, err error) {
+	r, w, err = os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.pipeBufferSize > 0 {
+		if err := setPipeSize(w, cfg.pipeBufferSize); err != nil {
+			r.Close()
+			w.Close()
+			return nil, nil, fmt.Errorf("set pipe size: %w", err)
+		}
+	}
+	return r, w, nil
+}
+
 // execContext identifies the context of an Executable run.
 type execContext struct {
-	exec  *execState
-	input string
+	exec   *execState
+	worker *worker
+	input  string
+	call   func(globals pyObject) (string, error)
+	abort  <-chan struct{}
+	// timing, if set, receives the QueueDuration and ExecDuration of the request, measured from submitted.
+	timing    *RunInfo
+	submitted time.Time
+	// capture, if set, receives the output and warnings of the run, including its module body.
+	capture *runCapture
 
 	cond *sync.Cond
 	done bool
@@ -232,11 +844,48 @@ type execContext struct {
 func (ctx *execContext) execute() {
 	ctx.cond.L.Lock()
 	defer func() {
+		if r := recover(); r != nil {
+			ctx.err = fmt.Errorf("%w: panic: %v", ErrWorkerExited, r)
+			defer panic(r)
+		}
+		if ctx.worker != nil {
+			ctx.err = daemonThreadError(ctx.worker, ctx.err)
+			ctx.err = memoryLimitError(ctx.worker.config, ctx.err)
+		}
 		ctx.done = true
 		ctx.cond.Signal()
 		ctx.cond.L.Unlock()
 	}()
 
+	if ctx.timing != nil {
+		start := time.Now()
+		ctx.timing.QueueDuration = start.Sub(ctx.submitted)
+		defer func() { ctx.timing.ExecDuration = time.Since(start) }()
+	}
+
+	// Abandoned request
+	if ctx.abort != nil {
+		select {
+		case <-ctx.abort:
+			ctx.err = errAborted
+			return
+		default:
+		}
+	}
+
+	if ctx.worker != nil && ctx.exec != nil {
+		defer ctx.worker.track(ctx.exec)()
+	}
+	if ctx.worker != nil && ctx.worker.config.cpuLimit > 0 {
+		defer ctx.worker.watchCPU(ctx.worker.config.cpuLimit)()
+	}
+
+	// Request which is not tied to a program, such as a call on a Handle
+	if ctx.exec == nil {
+		ctx.value, ctx.err = ctx.call(0)
+		return
+	}
+
 	// Cleanup request (empty code signals cleanup)
 	if ctx.exec.code == "" {
 		if ctx.exec.globals != 0 {
@@ -246,14 +895,21 @@ func (ctx *execContext) execute() {
 		return
 	}
 
+	if ctx.capture != nil {
+		if err := beginCapture(); err != nil {
+			ctx.err = err
+			return
+		}
+		defer ctx.capture.end()
+	}
+
 	// Load the program if not already loaded
 	if ctx.exec.globals == 0 {
 		globals := pyDict_New()
 		pyDict_SetItemString(globals, "__builtins__", pyEval_GetBuiltins())
 
-		pyRun_String(ctx.exec.code, pyFileInput, globals, globals)
-		if pyErr_Occurred() {
-			ctx.err = fetchPythonError()
+		if err := execProgram(ctx.worker.config, ctx.exec.code, globals); err != nil {
+			ctx.err = err
 			py_DecRef(globals)
 			return
 		}
@@ -261,7 +917,21 @@ func (ctx *execContext) execute() {
 		ctx.exec.globals = globals
 	}
 
-	ctx.value, ctx.err = callRun(ctx.exec.globals, ctx.input)
+	if ctx.call != nil {
+		ctx.value, ctx.err = ctx.call(ctx.exec.globals)
+		return
+	}
+	ctx.value, ctx.err = callRun(ctx.worker, ctx.exec.globals, ctx.input)
+}
+
+// fail completes the request with err without executing it.
+func (ctx *execContext) fail(err error) {
+	ctx.cond.L.Lock()
+	defer ctx.cond.L.Unlock()
+
+	ctx.err = err
+	ctx.done = true
+	ctx.cond.Signal()
 }
 
 // execState holds the loaded state of an Executable on a worker.
@@ -273,6 +943,7 @@ type execState struct {
 // executable holds common state and methods for Executable and WriterExecutable.
 type executable struct {
 	code   string
+	pool   *Pool
 	worker *worker
 	state  *execState
 }
@@ -280,40 +951,188 @@ type executable struct {
 // pin assigns this executable to a worker if not already pinned.
 func (b *executable) pin() error {
 	if b.worker == nil {
-		if workerPool == nil || len(workerPool.workers) == 0 {
-			return ErrNoHealthyWorkers
+		if b.pool == nil || b.pool.closed.Load() {
+			return ErrNotInitialized
 		}
-		idx := workerPool.next.Add(1) % uint64(len(workerPool.workers))
-		b.worker = workerPool.workers[idx]
-		b.state = &execState{code: b.code}
+		for range b.pool.workers {
+			idx := b.pool.next.Add(1) % uint64(len(b.pool.workers))
+			if w := b.pool.workers[idx]; !w.exited.Load() {
+				b.pinTo(w)
+				return nil
+			}
+		}
+		return ErrNoHealthyWorkers
+	}
+	return nil
+}
+
+// load pins the executable to a worker and runs the program's module body there, closing the executable
+// if the body fails.
+func (b *executable) load() error {
+	if err := b.pin(); err != nil {
+		return fmt.Errorf("pin: %w", err)
+	}
+	if _, err := b.dispatch(&execContext{
+		call: func(pyObject) (string, error) { return "", nil },
+	}); err != nil {
+		b.Close()
+		return fmt.Errorf("load: %w", err)
 	}
 	return nil
 }
 
+// pinTo assigns this executable to the given worker.
+func (b *executable) pinTo(w *worker) {
+	b.worker = w
+	b.state = &execState{code: b.code}
+}
+
+// InterpreterID returns the identifier of the worker interpreter the executable is pinned to, which is
+// also the WorkerID of its runs. The identifier is stable for the lifetime of the executable and unique
+// within the process, across pools and re-initialization, so it can be used to key resources kept per
+// interpreter outside of Python. It returns 0 once the executable is closed.
+func (b *executable) InterpreterID() uintptr {
+	if b.worker == nil {
+		return 0
+	}
+	return uintptr(b.worker.id)
+}
+
 // runOnWorker sends a request to the pinned worker.
 func (b *executable) runOnWorker(input string) (string, error) {
+	return b.dispatch(&execContext{input: input})
+}
+
+// global returns the JSON-serialized value of the named module-level variable.
+func (b *executable) global(name string) (string, error) {
+	w := b.worker
+	return b.dispatch(&execContext{
+		call: func(globals pyObject) (string, error) {
+			return getGlobal(w, globals, name)
+		},
+	})
+}
+
+// globals returns the named module-level variables as a JSON-serialized object.
+func (b *executable) globals(names []string) (string, error) {
+	w := b.worker
+	return b.dispatch(&execContext{
+		call: func(globals pyObject) (string, error) {
+			return getGlobals(w, globals, names)
+		},
+	})
+}
+
+// setGlobal sets the named module-level variable to the value decoded from the JSON data.
+func (b *executable) setGlobal(name, data string) error {
+	_, err := b.dispatch(&execContext{
+		call: func(globals pyObject) (string, error) {
+			value, err := loadJSON(data)
+			if err != nil {
+				return "", err
+			}
+			defer py_DecRef(value)
+			if pyDict_SetItemString(globals, name, value) != 0 {
+				return "", fetchPythonError()
+			}
+			return "", nil
+		},
+	})
+	return err
+}
+
+// Metadata returns the module docstring and conventional metadata globals of the loaded program, such as
+// __version__ and __author__, executing the program's module body first if it has not yet run. The keys
+// of the returned map are the names without the surrounding underscores ("doc", "version", "author",
+// "license", "copyright", "email" and "status"); fields which the program does not define are omitted.
+func (b *executable) Metadata() (map[string]any, error) {
+	w := b.worker
+	result, err := b.dispatch(&execContext{
+		call: func(globals pyObject) (string, error) {
+			return getMetadata(w, globals)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata map[string]any
+	if err := json.Unmarshal([]byte(result), &metadata); err != nil {
+		return nil, fmt.Errorf("unmarshal metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// dispatch sends the request to the pinned worker and waits for it to complete.
+func (b *executable) dispatch(ctx *execContext) (string, error) {
 	if b.worker.initErr != nil {
 		return "", fmt.Errorf("%w: %v", ErrSubInterpreterFailed, b.worker.initErr)
 	}
 
+	ctx.exec = b.state
+	return b.worker.submit(ctx)
+}
+
+// submit sends the request to the worker and waits for it to complete. Requests without an exec are
+// not tied to a program and only run their call.
+func (w *worker) submit(ctx *execContext) (string, error) {
 	var mu sync.Mutex
-	cond := sync.NewCond(&mu)
-	cond.L.Lock()
-	defer cond.L.Unlock()
+	ctx.worker = w
+	ctx.cond = sync.NewCond(&mu)
+	ctx.cond.L.Lock()
+	defer ctx.cond.L.Unlock()
 
-	ctx := &execContext{
-		exec:  b.state,
-		input: input,
-		cond:  cond,
+	if hook := slowRun.Load(); hook != nil {
+		start := time.Now()
+		id := w.id
+		watchdog := time.AfterFunc(hook.threshold, func() {
+			hook.fn(RunInfo{WorkerID: id, PythonDuration: time.Since(start)})
+		})
+		defer watchdog.Stop()
+	}
+
+	if ctx.timing != nil {
+		ctx.submitted = time.Now()
+	}
+	w.pending.Add(1)
+	if err := w.send(ctx); err != nil {
+		w.pending.Add(-1)
+		return "", err
 	}
-	b.worker.requests <- ctx
 	for !ctx.done {
-		cond.Wait()
+		ctx.cond.Wait()
 	}
+	w.pending.Add(-1)
 
+	if ctx.err != nil {
+		writeTraceback(ctx.err)
+		reportException(ctx.err)
+	}
 	return ctx.value, ctx.err
 }
 
+// send queues the request on the worker, failing with [ErrNotInitialized] if the worker has been stopped.
+func (w *worker) send(ctx *execContext) error {
+	w.sendMu.RLock()
+	defer w.sendMu.RUnlock()
+	if w.requestsClosed {
+		return ErrNotInitialized
+	}
+	w.requests <- ctx
+	return nil
+}
+
+// closeRequests closes the worker's request channel, after which the worker finishes the queued requests
+// and exits. Requests sent afterwards fail with [ErrNotInitialized].
+func (w *worker) closeRequests() {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+	if !w.requestsClosed {
+		w.requestsClosed = true
+		close(w.requests)
+	}
+}
+
 // Close releases resources associated with the executable.
 func (b *executable) Close() error {
 	if b.state != nil && b.worker != nil {
@@ -328,9 +1147,11 @@ func (b *executable) Close() error {
 			cond:  cond,
 		}
 		ctx.exec.code = ""
-		b.worker.requests <- ctx
-		for !ctx.done {
-			cond.Wait()
+		// A worker stopped by Shutdown has already released the state along with its interpreter.
+		if err := b.worker.send(ctx); err == nil {
+			for !ctx.done {
+				cond.Wait()
+			}
 		}
 	}
 
@@ -2,13 +2,31 @@ package serpent_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"math/big"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/adamkeys/serpent"
+	"github.com/adamkeys/serpent/serpenttest"
+	"github.com/ebitengine/purego"
 )
 
 func TestLoad_SingleCall(t *testing.T) {
@@ -107,6 +125,262 @@ def run(input):
 	}
 }
 
+func TestLoad_InterpreterID(t *testing.T) {
+	program := serpent.Program[int, int]("def run(input): return input")
+	exec, err := serpent.Load(program)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	id := exec.InterpreterID()
+	if id == 0 {
+		t.Fatalf("unexpected interpreter id: %d", id)
+	}
+	if _, info, err := exec.RunWithInfo(1); err != nil {
+		t.Fatalf("run: %v", err)
+	} else if uintptr(info.WorkerID) != id {
+		t.Errorf("expected run on interpreter %d; got: %d", id, info.WorkerID)
+	}
+
+	exec.Close()
+	if id := exec.InterpreterID(); id != 0 {
+		t.Errorf("expected 0 after close; got: %d", id)
+	}
+}
+
+func TestLoadPool_InterpreterID(t *testing.T) {
+	program := serpent.Program[int, int]("def run(input): return input")
+	exec, err := serpent.Load(program)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	pool := newTestPool(t)
+	other, err := serpent.LoadPool(pool, program)
+	if err != nil {
+		t.Fatalf("load pool: %v", err)
+	}
+	defer other.Close()
+
+	if exec.InterpreterID() == other.InterpreterID() {
+		t.Errorf("expected distinct interpreter ids across pools; got: %d", exec.InterpreterID())
+	}
+}
+
+func TestLoadFSWithModules(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app/main.py": {Data: []byte(`
+import fshelpers
+from fspkg import util
+from fsnamespace.inner import VALUE
+
+def run(input):
+    if input == "fail":
+        util.fail()
+    return fshelpers.greet(input) + util.suffix() + VALUE
+`)},
+		"app/fshelpers.py":         {Data: []byte("def greet(name): return 'hello ' + name\n")},
+		"app/fspkg/__init__.py":    {Data: []byte("PREFIX = '!'\n")},
+		"app/fspkg/util.py":        {Data: []byte("from fspkg import PREFIX\ndef suffix(): return PREFIX\ndef fail():\n    raise ValueError('from util')\n")},
+		"app/fsnamespace/inner.py": {Data: []byte("VALUE = '?'\n")},
+		"app/data.txt":             {Data: []byte("not a module")},
+	}
+
+	exec, err := serpent.LoadFSWithModules[string, string](fsys, "app/main.py")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	result, err := exec.Run("world")
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if result != "hello world!?" {
+		t.Errorf("expected %q; got: %q", "hello world!?", result)
+	}
+
+	_, err = exec.Run("fail")
+	var pyErr *serpent.PythonError
+	if !errors.As(err, &pyErr) {
+		t.Fatalf("expected a PythonError; got: %v", err)
+	}
+	for _, exp := range []string{`File "app/main.py", line 8`, `File "app/fspkg/util.py", line 4`} {
+		if !contains(pyErr.Traceback, exp) {
+			t.Errorf("expected traceback containing %q; got: %s", exp, pyErr.Traceback)
+		}
+	}
+
+	if _, err := serpent.LoadFSWithModules[string, string](fsys, "app/missing.py"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist for a missing entry; got: %v", err)
+	}
+}
+
+func TestGlobal(t *testing.T) {
+	program := serpent.Program[int, int](`
+CONFIG = {"name": "test", "features": ["a", "b"]}
+def run(input):
+    return input
+`)
+	exec, err := serpent.Load(program)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	config, err := serpent.Global[struct {
+		Name     string   `json:"name"`
+		Features []string `json:"features"`
+	}](exec, "CONFIG")
+	if err != nil {
+		t.Fatalf("global: %v", err)
+	}
+	if config.Name != "test" || len(config.Features) != 2 {
+		t.Errorf("unexpected config: %+v", config)
+	}
+
+	_, err = serpent.Global[int](exec, "MISSING")
+	if !errors.Is(err, serpent.ErrRunFailed) {
+		t.Errorf("expected ErrRunFailed; got: %v", err)
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	program := serpent.Program[int, struct{}](`
+a = 1
+b = 2
+def run(input):
+    global b
+    b = input
+`)
+	exec, err := serpent.Load(program)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	values, err := serpent.Globals[int](exec, "a", "b")
+	if err != nil {
+		t.Fatalf("globals: %v", err)
+	}
+	if exp := map[string]int{"a": 1, "b": 2}; !reflect.DeepEqual(values, exp) {
+		t.Errorf("expected %v; got: %v", exp, values)
+	}
+
+	if _, err := exec.Run(3); err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	values, err = serpent.Globals[int](exec, "a", "b")
+	if err != nil {
+		t.Fatalf("globals: %v", err)
+	}
+	if exp := map[string]int{"a": 1, "b": 3}; !reflect.DeepEqual(values, exp) {
+		t.Errorf("expected %v after run; got: %v", exp, values)
+	}
+
+	if _, err := serpent.Globals[int](exec, "a", "MISSING"); !errors.Is(err, serpent.ErrRunFailed) {
+		t.Errorf("expected ErrRunFailed; got: %v", err)
+	}
+}
+
+func TestSetGlobal(t *testing.T) {
+	var source string
+	serpent.SetCodeTransform(func(code string) string {
+		source = code
+		return code
+	})
+	defer serpent.SetCodeTransform(nil)
+
+	exec, err := serpent.Load(serpent.Program[string, bool]("API_KEY = None\ndef run(input): return API_KEY == input"))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	const secret = "s3cr3t-token"
+	if err := serpent.SetGlobal(exec, "API_KEY", secret); err != nil {
+		t.Fatalf("set global: %v", err)
+	}
+	result, err := exec.Run(secret)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if !result {
+		t.Errorf("expected the program to see the global")
+	}
+	if contains(source, secret) {
+		t.Errorf("expected the secret not to appear in the program source")
+	}
+}
+
+func TestLoad_Reload(t *testing.T) {
+	const code = `
+calls = 0
+def run(input):
+    global calls
+    calls += 1
+    return [VERSION, calls]
+`
+	exec, err := serpent.Load(serpent.Program[*struct{}, []int]("VERSION = 1" + code))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	run := func(exp []int) {
+		t.Helper()
+		result, err := exec.Run(nil)
+		if err != nil {
+			t.Fatalf("run: %v", err)
+		}
+		if !reflect.DeepEqual(result, exp) {
+			t.Errorf("expected %v; got: %v", exp, result)
+		}
+	}
+	run([]int{1, 1})
+	run([]int{1, 2})
+
+	// The module-level state of the old program is replaced.
+	if err := exec.Reload(serpent.Program[*struct{}, []int]("VERSION = 2" + code)); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	run([]int{2, 1})
+
+	// A failed reload keeps the loaded program and its state.
+	var pyErr *serpent.PythonError
+	if err := exec.Reload(serpent.Program[*struct{}, []int]("VERSION = (")); !errors.As(err, &pyErr) || pyErr.Type != "SyntaxError" {
+		t.Errorf("expected SyntaxError; got: %v", err)
+	}
+	if err := exec.Reload(serpent.Program[*struct{}, []int]("raise ImportError('missing')")); !errors.As(err, &pyErr) || pyErr.Type != "ImportError" {
+		t.Errorf("expected ImportError; got: %v", err)
+	}
+	run([]int{2, 2})
+}
+
+func TestLoad_Metadata(t *testing.T) {
+	program := serpent.Program[int, int](`"""Adds one to the input."""
+__version__ = "1.2.0"
+__author__ = "Serpent"
+def run(input):
+    return input + 1
+`)
+	exec, err := serpent.Load(program)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	metadata, err := exec.Metadata()
+	if err != nil {
+		t.Fatalf("metadata: %v", err)
+	}
+	exp := map[string]any{"doc": "Adds one to the input.", "version": "1.2.0", "author": "Serpent"}
+	if !reflect.DeepEqual(metadata, exp) {
+		t.Errorf("unexpected metadata: %v; got: %v", exp, metadata)
+	}
+}
+
 func TestLoadWriter_MultipleCalls(t *testing.T) {
 	program := serpent.Program[int, serpent.Writer](`
 def run(input, writer):
@@ -178,6 +452,168 @@ func TestRun_Struct(t *testing.T) {
 	}
 }
 
+func TestRun_Int64(t *testing.T) {
+	program := serpent.Program[int64, int64]("def run(input): return input + 1")
+	for _, arg := range []int64{9007199254740992, math.MaxInt64 - 1, math.MinInt64} {
+		result, err := serpent.Run(program, arg)
+		if err != nil {
+			t.Fatalf("run(%d): %v", arg, err)
+		}
+		if exp := arg + 1; result != exp {
+			t.Errorf("run(%d): expected %d; got: %d", arg, exp, result)
+		}
+	}
+}
+
+func TestRun_Bool(t *testing.T) {
+	program := serpent.Program[*struct{}, bool]("def run(input): return input is None")
+	result, err := serpent.Run(program, nil)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if !result {
+		t.Errorf("expected true; got: %v", result)
+	}
+}
+
+func TestRun_BoolPointer(t *testing.T) {
+	program := serpent.Program[*bool, *bool]("def run(input): return input")
+
+	result, err := serpent.Run(program, nil)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if result != nil {
+		t.Errorf("expected nil; got: %v", *result)
+	}
+
+	for _, exp := range []bool{true, false} {
+		result, err := serpent.Run(program, &exp)
+		if err != nil {
+			t.Fatalf("run(%v): %v", exp, err)
+		}
+		if result == nil || *result != exp {
+			t.Errorf("run(%v): expected %v; got: %v", exp, exp, result)
+		}
+	}
+}
+
+func TestRun_StructPointer(t *testing.T) {
+	type point struct {
+		X, Y  int
+		Label *string
+	}
+	program := serpent.Program[string, *point](`
+def run(input):
+    if input == "none":
+        return None
+    if input == "partial":
+        return {"X": 1}
+    return {"X": 1, "Y": 2, "Label": "a"}
+`)
+	exec, err := serpent.Load(program)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	label := "a"
+	tests := []struct {
+		input string
+		exp   *point
+	}{
+		{"none", nil},
+		{"partial", &point{X: 1}},
+		{"full", &point{X: 1, Y: 2, Label: &label}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result, err := serpent.Run(program, tt.input)
+			if err != nil {
+				t.Fatalf("run result: %v", err)
+			}
+			if !reflect.DeepEqual(result, tt.exp) {
+				t.Errorf("run: expected %+v; got: %+v", tt.exp, result)
+			}
+
+			result, err = exec.Run(tt.input)
+			if err != nil {
+				t.Fatalf("run result: %v", err)
+			}
+			if !reflect.DeepEqual(result, tt.exp) {
+				t.Errorf("executable: expected %+v; got: %+v", tt.exp, result)
+			}
+		})
+	}
+}
+
+// optimizeProgram reports whether __debug__ is set, whether asserts run and whether docstrings are kept.
+const optimizeProgram = serpent.Program[struct{}, []bool](`
+def run(input):
+	"""Docstring."""
+	asserted = False
+	try:
+		assert False
+	except AssertionError:
+		asserted = True
+	return [__debug__, asserted, run.__doc__ is not None]
+`)
+
+func TestRun_Optimize(t *testing.T) {
+	result, err := serpent.Run(optimizeProgram, struct{}{})
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	// By default programs are compiled at the interpreter's level, which keeps asserts and docstrings.
+	if exp := []bool{true, true, true}; !reflect.DeepEqual(result, exp) {
+		t.Errorf("default: expected %v; got: %v", exp, result)
+	}
+}
+
+func TestRun_OptimizeLevel(t *testing.T) {
+	for _, tc := range []struct {
+		level int
+		exp   []bool
+	}{
+		// Level 1 compiles __debug__ as False and strips asserts; level 2 also strips docstrings.
+		{1, []bool{false, false, true}},
+		{2, []bool{false, false, false}},
+	} {
+		t.Run(strconv.Itoa(tc.level), func(t *testing.T) {
+			inSubprocess(t, func(t *testing.T) {
+				initSubprocess(t, serpent.WithOptimize(tc.level))
+
+				result, err := serpent.Run(optimizeProgram, struct{}{})
+				if err != nil {
+					t.Fatalf("run result: %v", err)
+				}
+				if !reflect.DeepEqual(result, tc.exp) {
+					t.Errorf("expected %v; got: %v", tc.exp, result)
+				}
+			})
+		})
+	}
+}
+
+type rawInput []byte
+
+func (r rawInput) MarshalPython() ([]byte, error) {
+	return r, nil
+}
+
+func TestRun_Marshaler(t *testing.T) {
+	program := serpent.Program[rawInput, string]("def run(input): return type(input).__name__ + ':' + input.hex()")
+	result, err := serpent.Run(program, rawInput{0x00, 0x01, 0xff})
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+
+	const exp = "bytes:0001ff"
+	if result != exp {
+		t.Errorf("unexpected result: %q; got: %q", exp, result)
+	}
+}
+
 func TestRun_EscapedString(t *testing.T) {
 	const exp = "\"test\""
 	program := serpent.Program[string, string]("def run(input): return input")
@@ -229,6 +665,11 @@ func TestRun_InvalidProgram(t *testing.T) {
 			"def run(input): return 'string' + 1",
 			"can only concatenate str",
 		},
+		{
+			"ChainedError",
+			"def run(input):\n    try:\n        1 / 0\n    except ZeroDivisionError as e:\n        raise ValueError('wrapped') from e",
+			"The above exception was the direct cause of the following exception",
+		},
 	}
 
 	for _, tc := range cases {
@@ -245,55 +686,406 @@ func TestRun_InvalidProgram(t *testing.T) {
 	}
 }
 
-func TestRun_NoRunFunction(t *testing.T) {
-	program := serpent.Program[string, string]("x = 1")
-	_, err := serpent.Run(program, "test")
-	if !errors.Is(err, serpent.ErrRunFailed) {
-		t.Errorf("expected error: %v; got: %v", serpent.ErrRunFailed, err)
+func TestRun_PythonError(t *testing.T) {
+	program := serpent.Program[string, string](`
+def fail(input):
+    raise ValueError(input)
+
+def run(input):
+    return fail(input)
+`)
+	_, err := serpent.Run(program, "bad input")
+	var pyErr *serpent.PythonError
+	if !errors.As(err, &pyErr) || !errors.Is(err, serpent.ErrRunFailed) {
+		t.Fatalf("expected PythonError; got: %v", err)
 	}
-	if err == nil || !contains(err.Error(), "run() function not defined") {
-		t.Errorf("expected error containing 'run() function not defined'; got: %v", err)
+	if pyErr.Type != "ValueError" {
+		t.Errorf("expected type ValueError; got: %q", pyErr.Type)
 	}
-}
-
-func TestRun_SlowExecution(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping slow test")
+	if exp := "run failed: bad input"; err.Error() != exp {
+		t.Errorf("expected error %q; got: %q", exp, err.Error())
+	}
+	for _, exp := range []string{"Traceback (most recent call last):", "in fail", "ValueError: bad input"} {
+		if !contains(pyErr.Traceback, exp) {
+			t.Errorf("expected traceback containing: %q; got: %q", exp, pyErr.Traceback)
+		}
 	}
+}
 
-	program := serpent.Program[string, string](`
-import time
-def run(input):
-    time.sleep(1)
-    return input
+func TestRun_Async(t *testing.T) {
+	program := serpent.Program[int, int](`
+import asyncio
+async def run(input):
+    await asyncio.sleep(0)
+    return input + 1
 `)
-	result, err := serpent.Run(program, "test")
+	result, err := serpent.Run(program, 1)
 	if err != nil {
 		t.Fatalf("run result: %v", err)
 	}
-	if result != "test" {
-		t.Errorf("expected result: %q; got: %q", "test", result)
+
+	const exp = 2
+	if result != exp {
+		t.Errorf("unexpected result: %d; got: %d", exp, result)
 	}
 }
 
-func TestRun_MultiExecution(t *testing.T) {
-	program := serpent.Program[*struct{}, int]("def run(input): return 1 + 1")
-	results := make([]int, 10)
-	errCh := make(chan error, len(results))
-	var wg sync.WaitGroup
-	wg.Add(len(results))
-	for i := 0; i < len(results); i++ {
-		go func(i int) {
-			defer wg.Done()
-			result, err := serpent.Run(program, nil)
+func TestLoad_AsyncEventLoop(t *testing.T) {
+	program := serpent.Program[*struct{}, bool](`
+import asyncio
+loop = None
+async def run(input):
+    global loop
+    current = asyncio.get_running_loop()
+    same = loop is None or loop is current
+    loop = current
+    return same
+`)
+	run := func(exec *serpent.Executable[*struct{}, bool]) bool {
+		t.Helper()
+		defer exec.Close()
+
+		reused := true
+		for i := 0; i < 3; i++ {
+			same, err := exec.Run(nil)
 			if err != nil {
-				errCh <- err
-				return
+				t.Fatalf("run(%d): %v", i, err)
 			}
-			results[i] = result
-		}(i)
+			reused = reused && same
+		}
+		return reused
 	}
-	wg.Wait()
+
+	// By default each run creates a new event loop with asyncio.run.
+	exec, err := serpent.Load(program)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if run(exec) {
+		t.Errorf("expected a new event loop for each run by default")
+	}
+
+	exec, err = serpent.LoadPool(newTestPool(t, serpent.WithEventLoop()), program)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !run(exec) {
+		t.Errorf("expected the event loop to be reused")
+	}
+}
+
+func TestRun_NotSerializable(t *testing.T) {
+	cases := []struct {
+		name string
+		code string
+		exp  string
+	}{
+		{"Circular", "def run(input):\n    d = {}\n    d['self'] = d\n    return d", "Circular reference"},
+		{"Type", "def run(input): return object()", "not JSON serializable"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			program := serpent.Program[*struct{}, any](tc.code)
+			_, err := serpent.Run(program, nil)
+			if !errors.Is(err, serpent.ErrResultNotSerializable) {
+				t.Errorf("expected ErrResultNotSerializable; got: %v", err)
+			}
+			if err == nil || !contains(err.Error(), tc.exp) {
+				t.Errorf("expected error containing: %q; got: %v", tc.exp, err)
+			}
+		})
+	}
+}
+
+func TestRun_ResultNotJSON(t *testing.T) {
+	program := serpent.Program[*struct{}, float64]("def run(input): return float('nan')")
+	_, err := serpent.Run(program, nil)
+	if !errors.Is(err, serpent.ErrResultNotSerializable) {
+		t.Errorf("expected ErrResultNotSerializable; got: %v", err)
+	}
+
+	// The result is taken from the value returned by run, so a global holding a non-JSON string has no
+	// effect on it.
+	result, err := serpent.Run(serpent.Program[*struct{}, string]("_result = 'notjson'\ndef run(input): return 'ok'"), nil)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if result != "ok" {
+		t.Errorf("unexpected result: %q; got: %q", "ok", result)
+	}
+}
+
+func TestRun_MaxResultBytes(t *testing.T) {
+	// Results are not limited by default.
+	program := serpent.Program[int, string]("def run(input): return 'x' * input")
+	if _, err := serpent.Run(program, 1<<20); err != nil {
+		t.Errorf("run result without a limit: %v", err)
+	}
+
+}
+
+func TestRun_MaxResultBytesLimit(t *testing.T) {
+	inSubprocess(t, func(t *testing.T) {
+		initSubprocess(t, serpent.WithMaxResultBytes(1<<10))
+
+		// The JSON result includes two quotes.
+		program := serpent.Program[int, string]("def run(input): return 'x' * input")
+		if _, err := serpent.Run(program, 1<<10-2); err != nil {
+			t.Errorf("run result at limit: %v", err)
+		}
+		if _, err := serpent.Run(program, 1<<10-1); !errors.Is(err, serpent.ErrResultTooLarge) {
+			t.Errorf("expected ErrResultTooLarge; got: %v", err)
+		}
+	})
+}
+
+func TestRun_MaxSourceBytes(t *testing.T) {
+	pool := newTestPool(t, serpent.WithMaxSourceBytes(1<<10))
+
+	// Data formatted into a program's code is limited before the program is compiled.
+	code := "def run(input): return 1\n#" + strings.Repeat("x", 1<<10)
+	if _, err := serpent.LoadPool(pool, serpent.Program[int, int](code)); !errors.Is(err, serpent.ErrSourceTooLarge) {
+		t.Errorf("expected ErrSourceTooLarge; got: %v", err)
+	}
+	exec, err := serpent.LoadPool(pool, serpent.Program[int, int](code[:1<<10]))
+	if err != nil {
+		t.Fatalf("load program at limit: %v", err)
+	}
+	defer exec.Close()
+	if result, err := exec.Run(0); err != nil || result != 1 {
+		t.Errorf("expected 1; got: %d, %v", result, err)
+	}
+}
+
+func TestRun_NumpyScalar(t *testing.T) {
+	// A stand-in for numpy is used when it is not installed; the default serializer only needs
+	// numpy.generic and item().
+	program := serpent.Program[*struct{}, []any](`
+try:
+    import numpy
+except ImportError:
+    import sys, types
+    numpy = types.ModuleType("numpy")
+    class generic:
+        def __init__(self, value): self.value = value
+        def item(self): return self.value
+    numpy.generic = numpy.float32 = numpy.int64 = numpy.bool_ = generic
+    sys.modules["numpy"] = numpy
+
+def run(input):
+    return [numpy.float32(1.5), numpy.int64(2), numpy.bool_(True)]
+`)
+	result, err := serpent.Run(program, nil)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+
+	exp := []any{1.5, float64(2), true}
+	if !reflect.DeepEqual(result, exp) {
+		t.Errorf("unexpected result: %v; got: %v", exp, result)
+	}
+}
+
+func TestRun_SysExit(t *testing.T) {
+	program := serpent.Program[string, int](`
+import sys
+def run(input):
+    if input == "exit":
+        sys.exit(3)
+    if input == "message":
+        sys.exit("failed")
+    return 1
+`)
+	exec, err := serpent.Load(program)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	for input, exp := range map[string]serpent.ExitError{"exit": {Code: 3}, "message": {Code: 1, Message: "failed"}} {
+		_, err := exec.Run(input)
+		var exitErr *serpent.ExitError
+		if !errors.As(err, &exitErr) || !errors.Is(err, serpent.ErrProgramExited) {
+			t.Fatalf("run(%q): expected ExitError; got: %v", input, err)
+		}
+		if *exitErr != exp {
+			t.Errorf("run(%q): expected %+v; got: %+v", input, exp, *exitErr)
+		}
+	}
+
+	// The worker continues to serve runs after the program exits.
+	result, err := exec.Run("")
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if result != 1 {
+		t.Errorf("expected 1; got: %d", result)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	// The intermediate results are not JSON-serializable, so they must be passed as Python objects.
+	pipeline, err := serpent.LoadPipeline[string, map[string]int](
+		"def run(input): return set(input.split())",
+		`
+class Counts:
+    def __init__(self, words):
+        self.words = words
+def run(input): return Counts(input)
+`,
+		`
+runs = 0
+def run(input):
+    global runs
+    runs += 1
+    if not input.words:
+        raise ValueError("no words")
+    return {"words": len(input.words), "runs": runs}
+`,
+	)
+	if err != nil {
+		t.Fatalf("load pipeline: %v", err)
+	}
+	defer pipeline.Close()
+
+	for i := 1; i <= 2; i++ {
+		result, err := pipeline.Run("a b a c")
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+		if exp := map[string]int{"words": 3, "runs": i}; !reflect.DeepEqual(result, exp) {
+			t.Errorf("expected %v; got: %v", exp, result)
+		}
+	}
+
+	_, err = pipeline.Run("")
+	var pyErr *serpent.PythonError
+	if !errors.As(err, &pyErr) || pyErr.Type != "ValueError" || !contains(err.Error(), "stage 2") {
+		t.Errorf("expected a ValueError from stage 2; got: %v", err)
+	}
+
+	if _, err := serpent.LoadPipeline[string, string]("def run(input): return input", "import serpent_missing_module"); err == nil || !contains(err.Error(), "stage 1") {
+		t.Errorf("expected stage 1 to fail to load; got: %v", err)
+	}
+}
+
+func TestRunBatchReader(t *testing.T) {
+	program := serpent.Program[int, int]("def run(input): return input * 2")
+	input := strings.NewReader("1\n2\n\n\"x\"\n{\n3")
+	results, err := serpent.RunBatchReader(context.Background(), program, input)
+	if err != nil {
+		t.Fatalf("run batch: %v", err)
+	}
+
+	var indexes, values []int
+	var failed []int
+	for result := range results {
+		indexes = append(indexes, result.Index)
+		if result.Err != nil {
+			failed = append(failed, result.Index)
+			continue
+		}
+		values = append(values, result.Value)
+	}
+
+	if exp := []int{0, 1, 3, 4, 5}; !reflect.DeepEqual(indexes, exp) {
+		t.Errorf("unexpected indexes: %v; got: %v", exp, indexes)
+	}
+	if exp := []int{2, 4, 6}; !reflect.DeepEqual(values, exp) {
+		t.Errorf("unexpected values: %v; got: %v", exp, values)
+	}
+	// "x" fails in Python and { is not valid JSON.
+	if exp := []int{3, 4}; !reflect.DeepEqual(failed, exp) {
+		t.Errorf("unexpected failures: %v; got: %v", exp, failed)
+	}
+}
+
+func TestRunBatchReader_Cancel(t *testing.T) {
+	// The reader never ends, so the batch only stops when it is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	program := serpent.Program[int, int]("def run(input): return input")
+	results, err := serpent.RunBatchReader(ctx, program, infiniteReader("1\n"))
+	if err != nil {
+		t.Fatalf("run batch: %v", err)
+	}
+	if result := <-results; result.Err != nil || result.Value != 1 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	cancel()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-results:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("expected the results channel to be closed after cancellation")
+		}
+	}
+}
+
+// infiniteReader is an io.Reader which repeats its string forever.
+type infiniteReader string
+
+func (r infiniteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r[i%len(r)]
+	}
+	return len(p) - len(p)%len(r), nil
+}
+
+func TestRun_NoRunFunction(t *testing.T) {
+	program := serpent.Program[string, string]("x = 1")
+	_, err := serpent.Run(program, "test")
+	if !errors.Is(err, serpent.ErrRunFailed) {
+		t.Errorf("expected error: %v; got: %v", serpent.ErrRunFailed, err)
+	}
+	if err == nil || !contains(err.Error(), "run() function not defined") {
+		t.Errorf("expected error containing 'run() function not defined'; got: %v", err)
+	}
+}
+
+func TestRun_SlowExecution(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping slow test")
+	}
+
+	program := serpent.Program[string, string](`
+import time
+def run(input):
+    time.sleep(1)
+    return input
+`)
+	result, err := serpent.Run(program, "test")
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if result != "test" {
+		t.Errorf("expected result: %q; got: %q", "test", result)
+	}
+}
+
+func TestRun_MultiExecution(t *testing.T) {
+	program := serpent.Program[*struct{}, int]("def run(input): return 1 + 1")
+	results := make([]int, 10)
+	errCh := make(chan error, len(results))
+	var wg sync.WaitGroup
+	wg.Add(len(results))
+	for i := 0; i < len(results); i++ {
+		go func(i int) {
+			defer wg.Done()
+			result, err := serpent.Run(program, nil)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			results[i] = result
+		}(i)
+	}
+	wg.Wait()
 	close(errCh)
 
 	for err := range errCh {
@@ -327,42 +1119,2930 @@ def run(input):
 	}
 }
 
-func TestRunWrite_WriteOK(t *testing.T) {
-	var buf bytes.Buffer
-	program := serpent.Program[*struct{}, serpent.Writer](`
-def run(input, writer):
-    writer.write(b'OK')
+func TestRunWithInfo(t *testing.T) {
+	program := serpent.Program[int, int](`
+import time
+def run(input):
+    time.sleep(0.05)
+    return input + 1
 `)
-	err := serpent.RunWrite(&buf, program, nil)
+	result, info, err := serpent.RunWithInfo(program, 1)
 	if err != nil {
 		t.Fatalf("run result: %v", err)
 	}
-
-	const exp = "OK"
-	if s := buf.String(); s != exp {
-		t.Errorf("unexpected result: %q; got: %q", exp, s)
+	if result != 2 {
+		t.Errorf("unexpected result: 2; got: %d", result)
+	}
+	if info.PythonDuration < 50*time.Millisecond {
+		t.Errorf("expected python duration of at least 50ms; got: %v", info.PythonDuration)
+	}
+	if info.ExecDuration < 50*time.Millisecond || info.QueueDuration+info.ExecDuration > info.PythonDuration {
+		t.Errorf("expected queue and exec durations within the python duration; got: %+v", info)
 	}
 }
 
-func TestMain(m *testing.M) {
-	// Test that running without Init panics with PythonNotInitialized. This is considered to
-	// be a test case but cannot be in its own test function as the library initialization is global.
-	func() {
-		defer func() {
-			if _, ok := recover().(serpent.PythonNotInitialized); !ok {
-				panic("expected PythonNotInitialized panic")
+func TestRunDiagnostic(t *testing.T) {
+	program := serpent.Program[int, int](`
+import sys, warnings
+warnings.warn("imported", DeprecationWarning)
+
+def run(input):
+    print("out", input)
+    print("err", input, file=sys.stderr)
+    warnings.warn(f"run {input}")
+    if input < 0:
+        raise ValueError("negative")
+    return input * 2
+`)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result, diag, err := serpent.RunDiagnostic(program, i)
+			if err != nil {
+				t.Errorf("run %d: %v", i, err)
+				return
 			}
-		}()
-		program := serpent.Program[int, int]("result = input + 2")
-		serpent.Run(program, 1)
-	}()
+			if result != i*2 {
+				t.Errorf("run %d: expected %d; got: %d", i, i*2, result)
+			}
+			if exp := fmt.Sprintf("out %d\n", i); diag.Stdout != exp {
+				t.Errorf("run %d: expected stdout %q; got: %q", i, exp, diag.Stdout)
+			}
+			if exp := fmt.Sprintf("err %d\n", i); diag.Stderr != exp {
+				t.Errorf("run %d: expected stderr %q; got: %q", i, exp, diag.Stderr)
+			}
+			if len(diag.Warnings) != 2 || diag.Warnings[0].Category != "DeprecationWarning" ||
+				diag.Warnings[1].Message != fmt.Sprintf("run %d", i) || diag.Warnings[1].Lineno != 8 {
+				t.Errorf("run %d: unexpected warnings: %+v", i, diag.Warnings)
+			}
+			if diag.Info.ExecDuration <= 0 {
+				t.Errorf("run %d: expected the execution to be timed", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	_, diag, err := serpent.RunDiagnostic(program, -1)
+	if !errors.Is(err, serpent.ErrRunFailed) {
+		t.Errorf("expected ErrRunFailed; got: %v", err)
+	}
+	if diag.Stdout != "out -1\n" {
+		t.Errorf("expected the output before the failure; got: %q", diag.Stdout)
+	}
+}
 
-	lib, err := serpent.Lib()
+func TestRunJSON(t *testing.T) {
+	program := serpent.Program[struct{ Name string }, string]("def run(input): return input['Name']")
+	result, err := serpent.RunJSON(program, json.RawMessage(`{"Name": "test"}`))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "set LIBPYTHON_PATH: %v", err)
-		os.Exit(1)
+		t.Fatalf("run result: %v", err)
+	}
+
+	const exp = "test"
+	if result != exp {
+		t.Errorf("unexpected result: %q; got: %q", exp, result)
 	}
-	if err := serpent.Init(lib); err != nil && !errors.Is(err, serpent.ErrAlreadyInitialized) {
+
+	_, err = serpent.RunJSON(program, json.RawMessage(`{"Name": `))
+	if !errors.Is(err, serpent.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput; got: %v", err)
+	}
+}
+
+func TestRun_SortKeys(t *testing.T) {
+	program := serpent.Program[*struct{}, json.RawMessage]("def run(input): return {'b': 1, 'a': 2, 'c': {'z': 1, 'y': 2}}")
+	result, err := serpent.Run(program, nil)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	// Keys are serialized in insertion order by default.
+	if exp := `{"b": 1, "a": 2, "c": {"z": 1, "y": 2}}`; string(result) != exp {
+		t.Errorf("unexpected result: %s; got: %s", exp, result)
+	}
+
+}
+
+func TestRun_SortKeysOption(t *testing.T) {
+	inSubprocess(t, func(t *testing.T) {
+		initSubprocess(t, serpent.WithSortKeys(true))
+
+		program := serpent.Program[*struct{}, json.RawMessage]("def run(input): return {'b': 1, 'a': 2, 'c': {'z': 1, 'y': 2}}")
+		result, err := serpent.Run(program, nil)
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+		if exp := `{"a": 2, "b": 1, "c": {"y": 2, "z": 1}}`; string(result) != exp {
+			t.Errorf("unexpected result: %s; got: %s", exp, result)
+		}
+	})
+}
+
+func TestRun_EnsureASCII(t *testing.T) {
+	program := serpent.Program[*struct{}, json.RawMessage]("def run(input): return 'é'")
+
+	// Non-ASCII characters are escaped by default.
+	t.Run("Default", func(t *testing.T) {
+		result, err := serpent.Run(program, nil)
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+		if exp := `"\u00e9"`; string(result) != exp {
+			t.Errorf("unexpected result: %s; got: %s", exp, result)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		inSubprocess(t, func(t *testing.T) {
+			initSubprocess(t, serpent.WithEnsureASCII(false))
+
+			result, err := serpent.Run(program, nil)
+			if err != nil {
+				t.Fatalf("run result: %v", err)
+			}
+			if exp := `"é"`; string(result) != exp {
+				t.Errorf("unexpected result: %s; got: %s", exp, result)
+			}
+		})
+	})
+}
+
+func TestRun_Faulthandler(t *testing.T) {
+	// faulthandler cannot be imported in sub-interpreters, so it is tested in the main interpreter.
+	inSubprocess(t, func(t *testing.T) {
+		lib := testLib
+		if err := serpent.InitSingleWorker(lib, serpent.WithFaulthandler()); err != nil {
+			t.Fatalf("init: %v", err)
+		}
+		defer serpent.Close()
+
+		program := serpent.Program[*struct{}, bool]("import faulthandler\ndef run(input): return faulthandler.is_enabled()")
+		enabled, err := serpent.Run(program, nil)
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+		if !enabled {
+			t.Error("expected faulthandler to be enabled")
+		}
+	})
+}
+
+func TestRun_Argv(t *testing.T) {
+	program := serpent.Program[*struct{}, string]("import sys\ndef run(input): return sys.argv[0]")
+	result, err := serpent.Run(program, nil)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+
+	// Each worker is given an empty program name by default.
+	if result != "" {
+		t.Errorf("expected an empty program name; got: %q", result)
+	}
+
+}
+
+func TestRun_ProgramName(t *testing.T) {
+	inSubprocess(t, func(t *testing.T) {
+		initSubprocess(t, serpent.WithProgramName("serpent-test"))
+
+		program := serpent.Program[*struct{}, string]("import sys\ndef run(input): return sys.argv[0]")
+		result, err := serpent.Run(program, nil)
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+		const exp = "serpent-test"
+		if result != exp {
+			t.Errorf("unexpected result: %q; got: %q", exp, result)
+		}
+	})
+}
+
+func TestRun_Stdin(t *testing.T) {
+	inSubprocess(t, func(t *testing.T) {
+		initSubprocess(t, serpent.WithStdin(strings.NewReader("hello\nworld\n")))
+
+		exec, err := serpent.Load(serpent.Program[*struct{}, string]("def run(_): return input()"))
+		if err != nil {
+			t.Fatalf("load: %v", err)
+		}
+		defer exec.Close()
+
+		for _, exp := range []string{"hello", "world"} {
+			result, err := exec.Run(nil)
+			if err != nil {
+				t.Fatalf("run result: %v", err)
+			}
+			if result != exp {
+				t.Errorf("unexpected result: %q; got: %q", exp, result)
+			}
+		}
+
+		if _, err := exec.Run(nil); !errors.Is(err, serpent.ErrRunFailed) || !strings.Contains(err.Error(), "EOF") {
+			t.Errorf("expected EOFError at the end of stdin; got: %v", err)
+		}
+	})
+}
+
+func TestRun_ParseDatetime(t *testing.T) {
+	type Input struct {
+		UTC   time.Time
+		Local time.Time
+	}
+	program := serpent.Program[Input, []float64](`
+import _serpent_go
+
+def run(input):
+	utc = _serpent_go.parse_datetime(input["UTC"])
+	local = _serpent_go.parse_datetime(input["Local"])
+	return [utc.year, utc.microsecond, utc.utcoffset().total_seconds(), local.utcoffset().total_seconds()]
+`)
+	result, err := serpent.Run(program, Input{
+		UTC:   time.Date(2024, 2, 29, 12, 30, 45, 123456789, time.UTC),
+		Local: time.Date(2024, 2, 29, 12, 30, 45, 500000000, time.FixedZone("IST", 5*3600+1800)),
+	})
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+
+	exp := []float64{2024, 123456, 0, 5*3600 + 1800}
+	if !reflect.DeepEqual(result, exp) {
+		t.Errorf("unexpected result: %v; got: %v", exp, result)
+	}
+}
+
+func TestLoad_SyntaxError(t *testing.T) {
+	exec, err := serpent.Load(serpent.Program[int, int]("("))
+	if !errors.Is(err, serpent.ErrRunFailed) {
+		t.Errorf("expected a syntax error from Load; got: %v", err)
+	}
+	if exec != nil {
+		t.Errorf("expected a nil executable")
+	}
+
+	if _, err := serpent.LoadWriter(serpent.Program[int, serpent.Writer]("import serpent_missing_module")); !errors.Is(err, serpent.ErrRunFailed) {
+		t.Errorf("expected an import error from LoadWriter; got: %v", err)
+	}
+}
+
+func TestRunResult(t *testing.T) {
+	program := serpent.Program[float64, float64](`
+def run(input):
+    if input < 0:
+        return {"ok": False, "error": "input must not be negative"}
+    if input == 0:
+        return {"value": 0}
+    return {"ok": True, "value": input * 2}
+`)
+	result, err := serpent.RunResult(program, 1.5)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if result != 3 {
+		t.Errorf("expected 3; got: %v", result)
+	}
+
+	_, err = serpent.RunResult(program, -1)
+	var resultErr *serpent.ResultError
+	if !errors.As(err, &resultErr) || !errors.Is(err, serpent.ErrResultNotOK) {
+		t.Fatalf("expected ResultError; got: %v", err)
+	}
+	if resultErr.Message != "input must not be negative" {
+		t.Errorf("unexpected message: %q", resultErr.Message)
+	}
+
+	if _, err := serpent.RunResult(program, 0); err == nil || !contains(err.Error(), `missing "ok" field`) {
+		t.Errorf("expected an error for a result without ok; got: %v", err)
+	}
+}
+
+func TestRunEnum(t *testing.T) {
+	type label string
+	allowed := []label{"positive", "negative"}
+	program := serpent.Program[string, label]("def run(input): return input")
+
+	result, err := serpent.RunEnum(program, "negative", allowed)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if result != "negative" {
+		t.Errorf("expected negative; got: %q", result)
+	}
+
+	result, err = serpent.RunEnum(program, "neutral", allowed)
+	if !errors.Is(err, serpent.ErrInvalidEnum) {
+		t.Fatalf("expected ErrInvalidEnum; got: %v", err)
+	}
+	if result != "" || !contains(err.Error(), `"neutral"`) {
+		t.Errorf("unexpected result: %q, %v", result, err)
+	}
+}
+
+func TestRun_Pairs(t *testing.T) {
+	names := map[int]string{1: "one", 2: "two", 10: "ten"}
+
+	program := serpent.Program[serpent.Pairs[int, string], map[int]string](`
+def run(input):
+    names = dict(input)
+    if not all(isinstance(id, int) for id in names):
+        raise TypeError("expected integer keys")
+    return {id * 2: name.upper() for id, name in names.items()}
+`)
+	result, err := serpent.Run(program, serpent.Pairs[int, string](names))
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if exp := map[int]string{2: "ONE", 4: "TWO", 20: "TEN"}; !reflect.DeepEqual(result, exp) {
+		t.Errorf("expected %v; got: %v", exp, result)
+	}
+
+	identity := serpent.Program[serpent.Pairs[int, string], serpent.Pairs[int, string]]("def run(input): return list(dict(input).items())")
+	pairs, err := serpent.Run(identity, serpent.Pairs[int, string](names))
+	if err != nil {
+		t.Fatalf("run pairs: %v", err)
+	}
+	if !reflect.DeepEqual(map[int]string(pairs), names) {
+		t.Errorf("expected %v; got: %v", names, pairs)
+	}
+
+	data, err := json.Marshal(serpent.Pairs[int, string](names))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if exp := `[[1,"one"],[10,"ten"],[2,"two"]]`; string(data) != exp {
+		t.Errorf("expected pairs ordered by encoded key %s; got: %s", exp, data)
+	}
+}
+
+func TestRun_Table(t *testing.T) {
+	// The result is the dict returned by DataFrame.to_dict("list") for a small dataframe.
+	program := serpent.Program[*struct{}, serpent.Table[any]](`
+def run(input):
+	return {"name": ["a", "b", "c"], "price": [1.5, 2, None]}
+`)
+	table, err := serpent.Run(program, nil)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+
+	exp := serpent.Table[any]{
+		Columns: []string{"name", "price"},
+		Data: map[string][]any{
+			"name":  {"a", "b", "c"},
+			"price": {1.5, 2.0, nil},
+		},
+	}
+	if !reflect.DeepEqual(table, exp) {
+		t.Errorf("unexpected result: %v; got: %v", exp, table)
+	}
+	if n := table.Len(); n != 3 {
+		t.Errorf("expected 3 rows; got: %d", n)
+	}
+
+	ragged := serpent.Program[*struct{}, serpent.Table[int]](`def run(input): return {"a": [1, 2], "b": [1]}`)
+	if _, err := serpent.Run(ragged, nil); !errors.Is(err, serpent.ErrInvalidTable) {
+		t.Errorf("expected ErrInvalidTable; got: %v", err)
+	}
+}
+
+func TestRun_ThreadEnv(t *testing.T) {
+	inSubprocess(t, func(t *testing.T) {
+		initSubprocess(t, serpent.WithThreadEnv(map[string]string{"OMP_NUM_THREADS": "1"}))
+
+		program := serpent.Program[string, string]("import os\ndef run(input): return os.environ.get(input)")
+		result, err := serpent.Run(program, "OMP_NUM_THREADS")
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+
+		const exp = "1"
+		if result != exp {
+			t.Errorf("unexpected result: %q; got: %q", exp, result)
+		}
+	})
+}
+
+func TestRunStream(t *testing.T) {
+	program := serpent.Program[int, string](`
+def run(input):
+    for i in range(input):
+        yield str(i)
+    if input == 3:
+        raise ValueError("stream failed")
+`)
+	items, err := serpent.RunStream(context.Background(), program, 2, 0)
+	if err != nil {
+		t.Fatalf("run stream: %v", err)
+	}
+	var values []string
+	for item := range items {
+		if item.Err != nil {
+			t.Fatalf("item: %v", item.Err)
+		}
+		values = append(values, item.Value)
+	}
+	if exp := []string{"0", "1"}; !reflect.DeepEqual(values, exp) {
+		t.Errorf("expected items %v; got: %v", exp, values)
+	}
+
+	items, err = serpent.RunStream(context.Background(), program, 3, 0)
+	if err != nil {
+		t.Fatalf("run stream: %v", err)
+	}
+	var last serpent.StreamItem[string]
+	for item := range items {
+		last = item
+	}
+	if !errors.Is(last.Err, serpent.ErrRunFailed) || !contains(last.Err.Error(), "stream failed") {
+		t.Errorf("expected the stream to end with the program's error; got: %v", last.Err)
+	}
+}
+
+func TestRunStream_Backpressure(t *testing.T) {
+	// The generator records how many items it has produced, which stays within the buffer of the
+	// items received however fast it runs.
+	program := serpent.Program[string, int](`
+import itertools
+def run(path):
+    try:
+        for i in itertools.count():
+            with open(path, "w") as f:
+                f.write(str(i))
+            yield i
+    finally:
+        with open(path, "w") as f:
+            f.write("closed")
+`)
+	path := filepath.Join(t.TempDir(), "produced")
+	const buffer = 4
+	ctx, cancel := context.WithCancel(context.Background())
+	items, err := serpent.RunStream(ctx, program, path, buffer)
+	if err != nil {
+		t.Fatalf("run stream: %v", err)
+	}
+
+	for received := 1; received <= 10; received++ {
+		item := <-items
+		if item.Err != nil || item.Value != received-1 {
+			t.Fatalf("expected item %d; got: %+v", received-1, item)
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read produced: %v", err)
+		}
+		// An item may be waiting to be sent in addition to those buffered.
+		if produced, _ := strconv.Atoi(string(data)); produced > received+buffer {
+			t.Fatalf("expected at most %d items produced after receiving %d; got: %d", received+buffer, received, produced)
+		}
+	}
+
+	cancel()
+	for range items {
+	}
+	if data, _ := os.ReadFile(path); string(data) != "closed" {
+		t.Errorf("expected the generator to be closed when the stream is cancelled; got: %s", data)
+	}
+}
+
+func TestRunWrite_WriteOK(t *testing.T) {
+	var buf bytes.Buffer
+	program := serpent.Program[*struct{}, serpent.Writer](`
+def run(input, writer):
+    writer.write(b'OK')
+`)
+	err := serpent.RunWrite(&buf, program, nil)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+
+	const exp = "OK"
+	if s := buf.String(); s != exp {
+		t.Errorf("unexpected result: %q; got: %q", exp, s)
+	}
+}
+
+func TestRun_WriterResult(t *testing.T) {
+	program := serpent.Program[*struct{}, serpent.Writer](`
+def run(input, writer):
+    writer.write(b'OK')
+`)
+	_, err := serpent.Run(program, nil)
+	if !errors.Is(err, serpent.ErrStreamResult) || !contains(err.Error(), "RunWrite") {
+		t.Errorf("expected ErrStreamResult naming RunWrite; got: %v", err)
+	}
+	if _, err := serpent.Load(program); !errors.Is(err, serpent.ErrStreamResult) {
+		t.Errorf("expected ErrStreamResult from Load; got: %v", err)
+	}
+
+	pipe := serpent.Program[*struct{}, serpent.Pipe]("def run(input, reader, writer): pass")
+	if _, err := serpent.Run(pipe, nil); !errors.Is(err, serpent.ErrStreamResult) || !contains(err.Error(), "RunPipe") {
+		t.Errorf("expected ErrStreamResult naming RunPipe; got: %v", err)
+	}
+}
+
+func TestRunWrite_Traceback(t *testing.T) {
+	var stderr bytes.Buffer
+	serpent.SetStderr(&stderr)
+	defer serpent.SetStderr(nil)
+
+	var buf bytes.Buffer
+	program := serpent.Program[*struct{}, serpent.Writer](`
+def run(input, writer):
+    writer.write(b"partial")
+    raise ValueError("failed after writing")
+`)
+	err := serpent.RunWrite(&buf, program, nil)
+	if !errors.Is(err, serpent.ErrRunFailed) {
+		t.Fatalf("expected ErrRunFailed; got: %v", err)
+	}
+
+	if s := buf.String(); s != "partial" {
+		t.Errorf("expected only the written bytes; got: %q", s)
+	}
+	for _, exp := range []string{"Traceback (most recent call last):", "ValueError: failed after writing"} {
+		if !contains(stderr.String(), exp) {
+			t.Errorf("expected stderr containing %q; got: %q", exp, stderr.String())
+		}
+	}
+}
+
+func TestSetExceptHook(t *testing.T) {
+	errs := make(chan *serpent.PythonError, 10)
+	serpent.SetExceptHook(func(pyErr *serpent.PythonError) { errs <- pyErr })
+	defer serpent.SetExceptHook(nil)
+
+	// The thread fails after the run has returned, with a message longer than a single report chunk.
+	program := serpent.Program[int, int](`
+import threading, time
+def run(input):
+    def fail():
+        time.sleep(0.05)
+        raise LookupError("x" * input)
+    threading.Thread(target=fail).start()
+    return input
+`)
+	if _, err := serpent.Run(program, 1000); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	select {
+	case pyErr := <-errs:
+		if pyErr.Type != "LookupError" || len(pyErr.Message) != 1000 || !contains(pyErr.Traceback, "in fail") {
+			t.Errorf("unexpected thread exception: %s: %.20s", pyErr.Type, pyErr.Message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the thread's exception to be reported")
+	}
+
+	_, err := serpent.Run(serpent.Program[int, int]("def run(input): raise KeyError('run failed')"), 0)
+	var runErr *serpent.PythonError
+	if !errors.As(err, &runErr) {
+		t.Fatalf("expected PythonError; got: %v", err)
+	}
+	select {
+	case pyErr := <-errs:
+		if pyErr != runErr {
+			t.Errorf("expected the run's error to be reported; got: %v", pyErr)
+		}
+	default:
+		t.Error("expected the run's error to be reported")
+	}
+}
+
+func TestRunWrite_Close(t *testing.T) {
+	cases := []struct {
+		name string
+		code string
+	}{
+		{"Implicit", "def run(input, writer):\n    writer.write(b'OK')"},
+		{"Writer", "def run(input, writer):\n    writer.write(b'OK')\n    writer.close()"},
+		{"Descriptor", "import os\ndef run(input, writer):\n    writer.write(b'OK')\n    os.close(writer.fileno())"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			program := serpent.Program[*struct{}, serpent.Writer](tc.code)
+			if err := serpent.RunWrite(&buf, program, nil); err != nil {
+				t.Fatalf("run result: %v", err)
+			}
+
+			const exp = "OK"
+			if s := buf.String(); s != exp {
+				t.Errorf("unexpected result: %q; got: %q", exp, s)
+			}
+		})
+	}
+}
+
+func TestRunWrite_CloseReusedDescriptor(t *testing.T) {
+	// The program closes the writer's descriptor and reuses its number for another file, which closing
+	// the writer must leave open.
+	exec, err := serpent.LoadWriter(serpent.Program[bool, serpent.Writer](`
+import os
+reused, stat = None, None
+def run(check, writer):
+    global reused, stat
+    if check:
+        try:
+            writer.write(b'open' if os.path.samestat(os.fstat(reused), stat) else b'reused')
+        except OSError:
+            writer.write(b'closed')
+        return
+    reused = writer.fileno()
+    os.close(reused)
+    fd = os.open(os.devnull, os.O_RDONLY)
+    if fd != reused:
+        os.dup2(fd, reused)
+        os.close(fd)
+    stat = os.fstat(reused)
+`))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	if err := exec.Run(io.Discard, false); err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := exec.Run(&buf, true); err != nil {
+		t.Fatalf("run check: %v", err)
+	}
+	if s := buf.String(); s != "open" {
+		t.Errorf("unexpected result: %q; got: %q", "open", s)
+	}
+}
+
+func TestRunWrite_NameCollision(t *testing.T) {
+	var buf bytes.Buffer
+	program := serpent.Program[string, serpent.Writer](`
+class Writer:
+    pass
+
+_user_run = None
+os = None
+
+def run(input, writer):
+    writer.write(input)
+`)
+	if err := serpent.RunWrite(&buf, program, "OK"); err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+
+	const exp = "OK"
+	if s := buf.String(); s != exp {
+		t.Errorf("unexpected result: %q; got: %q", exp, s)
+	}
+}
+
+func TestRunWrite_MarshalErrorNoLeak(t *testing.T) {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("descriptor count unavailable: ", err)
+	}
+
+	program := serpent.Program[chan int, serpent.Writer]("def run(input, writer): pass")
+	for i := 0; i < 10; i++ {
+		var buf bytes.Buffer
+		if err := serpent.RunWrite(&buf, program, make(chan int)); err == nil {
+			t.Fatal("expected marshal error")
+		}
+	}
+
+	after, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatalf("read fds: %v", err)
+	}
+	if len(after) > len(fds) {
+		t.Errorf("leaked descriptors: %d before; %d after", len(fds), len(after))
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	// Each worker records the run in its own interpreter's builtins so the count can be read back.
+	program := serpent.Program[int, struct{}](`
+import builtins
+def run(input):
+    builtins.serpent_broadcast_count = getattr(builtins, 'serpent_broadcast_count', 0) + input
+`)
+	errs := serpent.Broadcast(program, 1)
+	if len(errs) == 0 {
+		t.Fatal("expected at least one worker")
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("worker %d: %v", i, err)
+		}
+	}
+
+	check := serpent.Program[*struct{}, struct{}](`
+import builtins
+def run(input):
+    if builtins.serpent_broadcast_count != 1:
+        raise ValueError(f"ran {builtins.serpent_broadcast_count} times")
+`)
+	for i, err := range serpent.Broadcast(check, nil) {
+		if err != nil {
+			t.Errorf("worker %d: %v", i, err)
+		}
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	program := serpent.Program[int, int]("import json\ndef run(input): return input")
+	if err := serpent.Warmup(program); err != nil {
+		t.Fatalf("warmup: %v", err)
+	}
+
+	failing := serpent.Program[int, int]("raise ValueError('warmup failed')")
+	err := serpent.Warmup(failing)
+	var warmupErr *serpent.WarmupError
+	if !errors.As(err, &warmupErr) {
+		t.Fatalf("expected WarmupError; got: %v", err)
+	}
+	if len(warmupErr.Completed) != 0 || !errors.Is(err, serpent.ErrRunFailed) {
+		t.Errorf("unexpected warmup error: %+v", warmupErr)
+	}
+}
+
+func TestWarmupPool(t *testing.T) {
+	pool := newTestPool(t)
+	program := serpent.Program[int, int]("import json\ndef run(input): return input")
+	if err := serpent.WarmupPool(pool, program); err != nil {
+		t.Fatalf("warmup: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	slow := serpent.Program[int, int]("import time\ntime.sleep(0.2)\ndef run(input): return input")
+	err := serpent.WarmupPoolContext(ctx, pool, slow)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Canceled; got: %v", err)
+	}
+
+	pool.Shutdown()
+	if err := serpent.WarmupPool(pool, program); !errors.Is(err, serpent.ErrNotInitialized) {
+		t.Errorf("expected ErrNotInitialized on a shut down pool; got: %v", err)
+	}
+}
+
+func TestWarmupContext_Cancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	program := serpent.Program[int, int]("import time\ntime.sleep(0.2)\ndef run(input): return input")
+	err := serpent.WarmupContext(ctx, program)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected DeadlineExceeded; got: %v", err)
+	}
+}
+
+func TestRunPipe_Transform(t *testing.T) {
+	var buf bytes.Buffer
+	program := serpent.Program[string, serpent.Pipe](`
+def run(input, reader, writer):
+    writer.write(input)
+    writer.write(reader.read().upper())
+`)
+	err := serpent.RunPipe(strings.NewReader("hello"), &buf, program, "> ")
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+
+	const exp = "> HELLO"
+	if s := buf.String(); s != exp {
+		t.Errorf("unexpected result: %q; got: %q", exp, s)
+	}
+}
+
+func TestRunPipe_BinaryWithConfig(t *testing.T) {
+	// A JSON configuration alongside a binary stream, which is not valid UTF-8.
+	type config struct {
+		Key  byte `json:"key"`
+		Skip int  `json:"skip"`
+	}
+	data := make([]byte, 1<<16)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	var buf bytes.Buffer
+	program := serpent.Program[config, serpent.Pipe](`
+def run(input, reader, writer):
+    reader.read(input["skip"])
+    while chunk := reader.read(4096):
+        writer.write(bytes(b ^ input["key"] for b in chunk))
+`)
+	if err := serpent.RunPipe(bytes.NewReader(data), &buf, program, config{Key: 0xff, Skip: 16}); err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+
+	exp := make([]byte, len(data)-16)
+	for i := range exp {
+		exp[i] = data[i+16] ^ 0xff
+	}
+	if !bytes.Equal(buf.Bytes(), exp) {
+		t.Errorf("unexpected result of %d bytes", buf.Len())
+	}
+}
+
+func TestRunPipe_LargeStreams(t *testing.T) {
+	// Larger than the default pipe buffer in both directions to ensure neither side deadlocks.
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+
+	var buf bytes.Buffer
+	program := serpent.Program[*struct{}, serpent.Pipe](`
+def run(input, reader, writer):
+    while True:
+        chunk = reader.read(4096)
+        if not chunk:
+            break
+        writer.write(chunk)
+`)
+	if err := serpent.RunPipe(bytes.NewReader(data), &buf, program, nil); err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("unexpected result length: %d; got: %d", len(data), buf.Len())
+	}
+}
+
+func BenchmarkRun_Trivial(b *testing.B) {
+	program := serpent.Program[int, int]("def run(input): return input + 1")
+	for i := 0; i < b.N; i++ {
+		if _, err := serpent.Run(program, i); err != nil {
+			b.Fatalf("run result: %v", err)
+		}
+	}
+}
+
+func BenchmarkExecutable_Trivial(b *testing.B) {
+	exec, err := serpent.Load(serpent.Program[int, int]("def run(input): return input + 1"))
+	if err != nil {
+		b.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	// The timings of each run are reported to track where the time is spent.
+	var total serpent.RunInfo
+	for i := 0; i < b.N; i++ {
+		_, info, err := exec.RunWithInfo(i)
+		if err != nil {
+			b.Fatalf("run result: %v", err)
+		}
+		total.MarshalDuration += info.MarshalDuration
+		total.QueueDuration += info.QueueDuration
+		total.ExecDuration += info.ExecDuration
+		total.UnmarshalDuration += info.UnmarshalDuration
+	}
+	b.ReportMetric(float64(total.MarshalDuration.Nanoseconds())/float64(b.N), "marshal-ns/op")
+	b.ReportMetric(float64(total.QueueDuration.Nanoseconds())/float64(b.N), "queue-ns/op")
+	b.ReportMetric(float64(total.ExecDuration.Nanoseconds())/float64(b.N), "exec-ns/op")
+	b.ReportMetric(float64(total.UnmarshalDuration.Nanoseconds())/float64(b.N), "unmarshal-ns/op")
+}
+
+func TestLoadScript(t *testing.T) {
+	script, err := serpent.LoadScript(serpent.Program[int, int](`
+runs = globals().get("runs", 0) + 1
+if input > 0:
+    result = input * 2 + runs
+`))
+	if err != nil {
+		t.Fatalf("load script: %v", err)
+	}
+	defer script.Close()
+
+	// Each run starts from a fresh namespace, so runs is always 1.
+	for _, input := range []int{1, 2} {
+		result, err := script.Run(input)
+		if err != nil {
+			t.Fatalf("run %d: %v", input, err)
+		}
+		if exp := input*2 + 1; result != exp {
+			t.Errorf("run %d: expected %d; got: %d", input, exp, result)
+		}
+	}
+	if _, err := script.Run(0); !errors.Is(err, serpent.ErrNoResult) {
+		t.Errorf("expected ErrNoResult; got: %v", err)
+	}
+
+	var pyErr *serpent.PythonError
+	if _, err := serpent.LoadScript(serpent.Program[int, int]("result = (")); !errors.As(err, &pyErr) || pyErr.Type != "SyntaxError" {
+		t.Errorf("expected SyntaxError; got: %v", err)
+	}
+}
+
+// scriptBenchmarkCode is a script with enough code for its compilation to be measurable.
+var scriptBenchmarkCode = strings.Repeat("x = [i * 2 for i in range(3)]\n", 50) + "result = input + 1\n"
+
+func BenchmarkScript(b *testing.B) {
+	script, err := serpent.LoadScript(serpent.Program[int, int](scriptBenchmarkCode))
+	if err != nil {
+		b.Fatalf("load script: %v", err)
+	}
+	defer script.Close()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := script.Run(i); err != nil {
+			b.Fatalf("run result: %v", err)
+		}
+	}
+}
+
+// BenchmarkScript_Recompile runs the same script as BenchmarkScript, compiling it on every run.
+func BenchmarkScript_Recompile(b *testing.B) {
+	exec, err := serpent.Load(serpent.Program[map[string]any, int](`
+def run(input):
+    scope = {"input": input["input"]}
+    exec(compile(input["code"], "<script>", "exec"), scope)
+    return scope["result"]
+`))
+	if err != nil {
+		b.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := exec.Run(map[string]any{"code": scriptBenchmarkCode, "input": i}); err != nil {
+			b.Fatalf("run result: %v", err)
+		}
+	}
+}
+
+// BenchmarkRun_LargeResult compares the JSON modules selected with WithJSONModule on a result of about
+// 4MB. orjson falls back to the json module where it is not installed.
+func BenchmarkRun_LargeResult(b *testing.B) {
+	program := serpent.Program[int, []map[string]any](`
+def run(input):
+    return [{"id": i, "name": f"item {i}", "score": i / 3, "tags": ["a", "b"]} for i in range(input)]
+`)
+	for _, module := range []string{"json", "orjson"} {
+		b.Run(module, func(b *testing.B) {
+			pool := newTestPool(b, serpent.WithJSONModule(module))
+			exec, err := serpent.LoadPool(pool, program)
+			if err != nil {
+				b.Fatalf("load: %v", err)
+			}
+			defer exec.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := exec.Run(50000); err != nil {
+					b.Fatalf("run result: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRunBatch(b *testing.B) {
+	program := serpent.Program[int, int]("def run(input): return input + 1")
+	batch := strings.Repeat("1\n", 1000)
+	for i := 0; i < b.N; i++ {
+		results, err := serpent.RunBatchReader(context.Background(), program, strings.NewReader(batch))
+		if err != nil {
+			b.Fatalf("run batch: %v", err)
+		}
+		for result := range results {
+			if result.Err != nil {
+				b.Fatalf("run result %d: %v", result.Index, result.Err)
+			}
+		}
+	}
+}
+
+// BenchmarkRunWrite measures the throughput of a writer program writing 100MB through a pipe of the
+// default size.
+func BenchmarkRunWrite(b *testing.B) {
+	program := serpent.Program[int, serpent.Writer](`
+def run(input, writer):
+    chunk = b"x" * (1 << 16)
+    for _ in range(input // len(chunk)):
+        writer.write(chunk)
+`)
+	const size = 100 << 20
+	b.SetBytes(size)
+	for i := 0; i < b.N; i++ {
+		if err := serpent.RunWrite(io.Discard, program, size); err != nil {
+			b.Fatalf("run result: %v", err)
+		}
+	}
+}
+
+// pipeSizeProgram writes the size of the pipe it writes to, or nothing where pipe sizes cannot be read.
+const pipeSizeProgram = serpent.Program[*struct{}, serpent.Writer](`
+import fcntl
+def run(input, writer):
+    if hasattr(fcntl, "F_GETPIPE_SZ"):
+        writer.write(str(fcntl.fcntl(writer.fileno(), fcntl.F_GETPIPE_SZ)))
+`)
+
+func TestRunWrite_PipeBufferSizeDefault(t *testing.T) {
+	var buf bytes.Buffer
+	if err := serpent.RunWrite(&buf, pipeSizeProgram, nil); err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	// Pipes keep the operating system's default size unless the option is given.
+	if s := buf.String(); s == strconv.Itoa(1<<20) {
+		t.Errorf("expected the default pipe size; got: %s", s)
+	}
+}
+
+func TestRunWrite_PipeBufferSize(t *testing.T) {
+	inSubprocess(t, func(t *testing.T) {
+		initSubprocess(t, serpent.WithPipeBufferSize(1<<20))
+
+		var buf bytes.Buffer
+		if err := serpent.RunWrite(&buf, pipeSizeProgram, nil); err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+		// Pipes are only resized on Linux; elsewhere the option is ignored.
+		if runtime.GOOS != "linux" {
+			return
+		}
+		if s := buf.String(); s != strconv.Itoa(1<<20) {
+			t.Errorf("expected a pipe of %d bytes; got: %s", 1<<20, s)
+		}
+	})
+}
+
+func TestRunPipe_UnreadInput(t *testing.T) {
+	var buf bytes.Buffer
+	program := serpent.Program[*struct{}, serpent.Pipe]("def run(input, reader, writer): writer.write(reader.read(2))")
+	data := bytes.Repeat([]byte("x"), 1<<20)
+	if err := serpent.RunPipe(bytes.NewReader(data), &buf, program, nil); err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+
+	const exp = "xx"
+	if s := buf.String(); s != exp {
+		t.Errorf("unexpected result: %q; got: %q", exp, s)
+	}
+}
+
+func TestRunPipe_BlockedInput(t *testing.T) {
+	// The reader never produces data, so its read is still blocked when the program returns.
+	r, w := io.Pipe()
+	defer w.Close()
+	program := serpent.Program[*struct{}, serpent.Pipe]("def run(input, reader, writer): writer.write(b'done')")
+	var buf bytes.Buffer
+	errs := make(chan error)
+	go func() { errs <- serpent.RunPipe(r, &buf, program, nil) }()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected RunPipe to return without waiting for the blocked read")
+	}
+	if s := buf.String(); s != "done" {
+		t.Errorf("unexpected result: %q; got: %q", "done", s)
+	}
+}
+
+func TestGenerateCode(t *testing.T) {
+	const code = "def run(input, writer): pass"
+	if s, err := serpent.GenerateCode(serpent.Program[int, int](code), 1); err != nil || s != code {
+		t.Errorf("unexpected code: %q; got: %q, %v", code, s, err)
+	}
+
+	s, err := serpent.GenerateCode(serpent.Program[int, serpent.Writer](code), 1)
+	if err != nil || !contains(s, code) || !contains(s, "__serpent_run__(raw_input['Input'], writer)") {
+		t.Errorf("expected wrapped writer program; got: %q, %v", s, err)
+	}
+
+	if _, err := serpent.GenerateCode(serpent.Program[chan int, int](code), make(chan int)); err == nil {
+		t.Errorf("expected an input which cannot be encoded to fail")
+	}
+
+	serpent.SetCodeTransform(func(code string) string { return "# transformed\n" + code })
+	defer serpent.SetCodeTransform(nil)
+	if s, err := serpent.GenerateCode(serpent.Program[int, int](code), 1); err != nil || s != "# transformed\n"+code {
+		t.Errorf("expected the transformed code; got: %q, %v", s, err)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	for _, code := range []string{
+		"def run(input): return input",
+		"async def run(input): return input",
+		"run = lambda input: input",
+		"from json import loads as run",
+		"if True:\n    def run(input): return input",
+		"result = input",
+		"if input > 0:\n    result = input",
+	} {
+		if err := serpent.Compile(serpent.Program[int, int](code)); err != nil {
+			t.Errorf("compile %q: %v", code, err)
+		}
+	}
+	if err := serpent.Compile(serpent.Program[int, serpent.Writer]("def run(input, writer): pass")); err != nil {
+		t.Errorf("compile writer: %v", err)
+	}
+
+	for _, code := range []string{
+		"value = input",
+		"def main(input): return input",
+		"def helper():\n    return input",
+	} {
+		if err := serpent.Compile(serpent.Program[int, int](code)); !errors.Is(err, serpent.ErrNoEntrypoint) {
+			t.Errorf("compile %q: expected ErrNoEntrypoint; got: %v", code, err)
+		}
+	}
+
+	var pyErr *serpent.PythonError
+	if err := serpent.Compile(serpent.Program[int, int]("def run(input) return input")); !errors.As(err, &pyErr) || pyErr.Type != "SyntaxError" {
+		t.Errorf("expected SyntaxError; got: %v", err)
+	}
+}
+
+func TestProgramStyle(t *testing.T) {
+	for _, tc := range []struct {
+		code string
+		exp  serpent.Style
+	}{
+		{"def run(input): return input", serpent.StyleRun},
+		{"result = input * 2", serpent.StyleResult},
+		{"result = 0\ndef run(input): return result", serpent.StyleRun},
+	} {
+		style, err := serpent.ProgramStyle(serpent.Program[int, int](tc.code))
+		if err != nil {
+			t.Fatalf("style of %q: %v", tc.code, err)
+		}
+		if style != tc.exp {
+			t.Errorf("style of %q: expected %d; got: %d", tc.code, tc.exp, style)
+		}
+	}
+
+	if _, err := serpent.ProgramStyle(serpent.Program[int, int]("value = input")); !errors.Is(err, serpent.ErrNoEntrypoint) {
+		t.Errorf("expected ErrNoEntrypoint; got: %v", err)
+	}
+}
+
+func TestRun_Handle(t *testing.T) {
+	program := serpent.Program[int, serpent.Handle](`
+def run(input):
+    return lambda x, y=0: x * input + y
+`)
+	handle, err := serpent.Run(program, 3)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+
+	for _, tc := range []struct {
+		args []any
+		exp  string
+	}{
+		{[]any{2}, "6"},
+		{[]any{2, 1}, "7"},
+	} {
+		result, err := handle.Call(tc.args...)
+		if err != nil {
+			t.Fatalf("call%v: %v", tc.args, err)
+		}
+		if string(result) != tc.exp {
+			t.Errorf("call%v: expected %s; got: %s", tc.args, tc.exp, result)
+		}
+	}
+
+	if err := handle.Release(); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if _, err := handle.Call(2); !errors.Is(err, serpent.ErrHandleReleased) {
+		t.Errorf("expected ErrHandleReleased; got: %v", err)
+	}
+}
+
+func TestRun_HandleAfterShutdown(t *testing.T) {
+	inSubprocess(t, func(t *testing.T) {
+		initSubprocess(t)
+
+		program := serpent.Program[int, serpent.Handle]("def run(input): return lambda x: x * input")
+		handle, err := serpent.Run(program, 3)
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+		exec, err := serpent.Load(program)
+		if err != nil {
+			t.Fatalf("load: %v", err)
+		}
+
+		if err := serpent.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		if _, err := handle.Call(2); !errors.Is(err, serpent.ErrNotInitialized) {
+			t.Errorf("expected ErrNotInitialized calling after close; got: %v", err)
+		}
+		if err := handle.Release(); !errors.Is(err, serpent.ErrNotInitialized) {
+			t.Errorf("expected ErrNotInitialized releasing after close; got: %v", err)
+		}
+		if _, err := exec.Run(1); !errors.Is(err, serpent.ErrNotInitialized) {
+			t.Errorf("expected ErrNotInitialized running after close; got: %v", err)
+		}
+		if err := exec.Close(); err != nil {
+			t.Errorf("close executable: %v", err)
+		}
+	})
+}
+
+func TestSetCodeTransform(t *testing.T) {
+	serpent.SetCodeTransform(func(code string) string {
+		return code + "\n_run = run\ndef run(input):\n    return _run(input) * 10\n"
+	})
+	defer serpent.SetCodeTransform(nil)
+
+	program := serpent.Program[int, int]("def run(input): return input + 1")
+	result, err := serpent.Run(program, 1)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if result != 20 {
+		t.Errorf("expected the transformed result 20; got: %d", result)
+	}
+
+	serpent.SetCodeTransform(nil)
+	result, err = serpent.Run(program, 1)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if result != 2 {
+		t.Errorf("expected 2 once the transform is removed; got: %d", result)
+	}
+}
+
+func TestOnSlowRun(t *testing.T) {
+	slow := make(chan serpent.RunInfo, 1)
+	serpent.OnSlowRun(50*time.Millisecond, func(info serpent.RunInfo) {
+		slow <- info
+	})
+	defer serpent.OnSlowRun(0, nil)
+
+	program := serpent.Program[float64, struct{}]("import time\ndef run(input): time.sleep(input)")
+	exec, err := serpent.Load(program)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	if _, err := exec.Run(0); err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	select {
+	case info := <-slow:
+		t.Fatalf("unexpected slow run: %+v", info)
+	default:
+	}
+
+	if _, err := exec.Run(0.2); err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	select {
+	case info := <-slow:
+		if uintptr(info.WorkerID) != exec.InterpreterID() || info.PythonDuration < 50*time.Millisecond {
+			t.Errorf("unexpected slow run info: %+v", info)
+		}
+	default:
+		t.Error("expected slow run callback")
+	}
+}
+
+func TestPackages(t *testing.T) {
+	dir := t.TempDir()
+	distInfo := filepath.Join(dir, "serpent_fake-1.2.3.dist-info")
+	if err := os.Mkdir(distInfo, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	metadata := "Metadata-Version: 2.1\nName: serpent-fake\nVersion: 1.2.3\n"
+	if err := os.WriteFile(filepath.Join(distInfo, "METADATA"), []byte(metadata), 0o644); err != nil {
+		t.Fatalf("write metadata: %v", err)
+	}
+
+	// Add the directory to sys.path on every worker.
+	path := serpent.Program[string, struct{}]("import sys\ndef run(input): sys.path.append(input)")
+	for _, err := range serpent.Broadcast(path, dir) {
+		if err != nil {
+			t.Fatalf("broadcast: %v", err)
+		}
+	}
+	defer serpent.Broadcast(serpent.Program[string, struct{}]("import sys\ndef run(input): sys.path.remove(input)"), dir)
+
+	packages, err := serpent.Packages()
+	if err != nil {
+		t.Fatalf("packages: %v", err)
+	}
+	exp := serpent.PackageInfo{Name: "serpent-fake", Version: "1.2.3"}
+	for _, p := range packages {
+		if p == exp {
+			return
+		}
+	}
+	t.Errorf("expected %v in packages; got: %v", exp, packages)
+}
+
+func TestEnvironment(t *testing.T) {
+	env, err := serpent.Environment()
+	if err != nil {
+		t.Fatalf("environment: %v", err)
+	}
+	if info, err := os.Stat(env.Prefix); err != nil || !info.IsDir() {
+		t.Errorf("expected prefix to be a directory; got: %q", env.Prefix)
+	}
+	// A shared build records the shared library it built.
+	if env.Shared && runtime.GOOS != "windows" && strings.HasSuffix(env.Library, ".a") {
+		t.Errorf("expected a shared library for a shared build; got: %q", env.Library)
+	}
+	// The standard library must be on the path.
+	for _, dir := range env.Path {
+		if _, err := os.Stat(filepath.Join(dir, "os.py")); err == nil {
+			return
+		}
+	}
+	t.Errorf("expected the standard library in path; got: %v", env.Path)
+}
+
+func TestWorkerCount(t *testing.T) {
+	// Broadcast runs the program once on every worker.
+	errs := serpent.Broadcast(serpent.Program[*struct{}, struct{}]("def run(input): pass"), nil)
+	if n := serpent.WorkerCount(); n != len(errs) {
+		t.Errorf("expected %d workers; got: %d", len(errs), n)
+	}
+}
+
+func TestWarmImports(t *testing.T) {
+	if errs := serpent.WarmImports([]string{"json", "textwrap"}); len(errs) != 0 {
+		t.Fatalf("warm imports: %v", errs)
+	}
+
+	errs := serpent.WarmImports([]string{"json", "serpent_missing_module"})
+	if len(errs) != serpent.WorkerCount() {
+		t.Fatalf("expected an error per worker; got: %v", errs)
+	}
+	for _, err := range errs {
+		var pyErr *serpent.PythonError
+		if !errors.As(err, &pyErr) || pyErr.Type != "ModuleNotFoundError" {
+			t.Errorf("expected a ModuleNotFoundError; got: %v", err)
+		}
+		if !contains(err.Error(), "import serpent_missing_module") {
+			t.Errorf("expected the error to name the module; got: %v", err)
+		}
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	before, err := serpent.GCStats()
+	if err != nil {
+		t.Fatalf("gc stats: %v", err)
+	}
+	if len(before) != serpent.WorkerCount() {
+		t.Fatalf("expected stats for %d workers; got: %d", serpent.WorkerCount(), len(before))
+	}
+
+	if err := serpent.CollectGarbage(); err != nil {
+		t.Fatalf("collect garbage: %v", err)
+	}
+
+	after, err := serpent.GCStats()
+	if err != nil {
+		t.Fatalf("gc stats: %v", err)
+	}
+	for i, stats := range after {
+		if !stats.Enabled || len(stats.Generations) != 3 {
+			t.Fatalf("unexpected stats: %+v", stats)
+		}
+		if stats.WorkerID != before[i].WorkerID || stats.Generations[2].Collections <= before[i].Generations[2].Collections {
+			t.Errorf("expected a full collection on worker %d; got: %+v before %+v", stats.WorkerID, stats, before[i])
+		}
+	}
+}
+
+func TestSwitchInterval(t *testing.T) {
+	before, err := serpent.SwitchInterval()
+	if err != nil {
+		t.Fatalf("switch interval: %v", err)
+	}
+	if before != 5*time.Millisecond {
+		t.Errorf("expected the default interval of 5ms; got: %v", before)
+	}
+	defer serpent.SetSwitchInterval(before)
+
+	if err := serpent.SetSwitchInterval(1500 * time.Microsecond); err != nil {
+		t.Fatalf("set switch interval: %v", err)
+	}
+	for i := 0; i < serpent.WorkerCount(); i++ {
+		interval, err := serpent.SwitchInterval()
+		if err != nil {
+			t.Fatalf("switch interval: %v", err)
+		}
+		if interval != 1500*time.Microsecond {
+			t.Errorf("expected an interval of 1.5ms; got: %v", interval)
+		}
+	}
+
+	if err := serpent.SetSwitchInterval(0); !errors.Is(err, serpent.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for a zero interval; got: %v", err)
+	}
+}
+
+func TestNewPool_GC(t *testing.T) {
+	pool := newTestPool(t, serpent.WithGC(false))
+	stats, err := pool.GCStats()
+	if err != nil {
+		t.Fatalf("gc stats: %v", err)
+	}
+	for _, s := range stats {
+		if s.Enabled {
+			t.Errorf("expected automatic collection to be disabled on worker %d", s.WorkerID)
+		}
+	}
+	if err := pool.CollectGarbage(); err != nil {
+		t.Errorf("collect garbage: %v", err)
+	}
+}
+
+func TestNewPool_NoBytecode(t *testing.T) {
+	pool := newTestPool(t, serpent.WithNoBytecode())
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "serpent_nobytecode.py"), []byte("VALUE = 1\n"), 0o644); err != nil {
+		t.Fatalf("write module: %v", err)
+	}
+
+	exec, err := serpent.LoadPool(pool, serpent.Program[string, bool](`
+import sys
+def run(input):
+    sys.path.insert(0, input)
+    try:
+        import serpent_nobytecode
+    finally:
+        sys.path.remove(input)
+    return sys.dont_write_bytecode
+`))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	result, err := exec.Run(dir)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if !result {
+		t.Errorf("expected sys.dont_write_bytecode to be set")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "__pycache__")); !os.IsNotExist(err) {
+		t.Errorf("expected no bytecode to be written; got: %v", err)
+	}
+}
+
+func TestOnWorkerShutdown(t *testing.T) {
+	pool := newTestPool(t)
+	workers := pool.WorkerCount()
+
+	// Each worker appends its interpreter's id to the file.
+	path := filepath.Join(t.TempDir(), "shutdown")
+	name, _ := json.Marshal(path)
+	serpent.OnWorkerShutdown(fmt.Sprintf(`
+try:
+    import _interpreters as interpreters
+except ImportError:
+    import _xxsubinterpreters as interpreters
+with open(%s, "a") as f:
+    f.write(f"{int(interpreters.get_current())}\n")
+`, name))
+	defer serpent.OnWorkerShutdown("")
+
+	if err := pool.Shutdown(); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	ids := strings.Fields(string(data))
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		seen[id] = true
+	}
+	if len(ids) != workers || len(seen) != workers {
+		t.Errorf("expected the code to run once in each of %d workers; got: %v", workers, ids)
+	}
+}
+
+func TestNewPool_Workdir(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("workers only have their own working directory on linux")
+	}
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("eval symlinks: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	hostDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+
+	pool := newTestPool(t, serpent.WithWorkdir(dir))
+	program := serpent.Program[*struct{}, []string]("import os\ndef run(input): return [os.getcwd(), open('data.txt').read()]")
+	exec, err := serpent.LoadPool(pool, program)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	result, err := exec.Run(nil)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if exp := []string{dir, "hello"}; !reflect.DeepEqual(result, exp) {
+		t.Errorf("expected %v; got: %v", exp, result)
+	}
+
+	// The working directory of the host and the default pool is unchanged.
+	if wd, err := os.Getwd(); err != nil || wd != hostDir {
+		t.Errorf("expected the host to remain in %s; got: %s, %v", hostDir, wd, err)
+	}
+	cwd, err := serpent.Run(serpent.Program[*struct{}, string]("import os\ndef run(input): return os.getcwd()"), nil)
+	if err != nil || cwd != hostDir {
+		t.Errorf("expected the default pool to remain in %s; got: %s, %v", hostDir, cwd, err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	if err := serpent.Ping(); err != nil {
+		t.Errorf("ping: %v", err)
+	}
+}
+
+func TestPing_Busy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping slow test")
+	}
+
+	program := serpent.Program[*struct{}, struct{}]("import time\ndef run(input): time.sleep(2)")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serpent.Broadcast(program, nil)
+	}()
+	defer func() { <-done }()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := serpent.Ping(); !errors.Is(err, serpent.ErrPingTimeout) {
+		t.Errorf("expected ErrPingTimeout; got: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := serpent.PingContext(ctx); !errors.Is(err, serpent.ErrPingTimeout) {
+		t.Errorf("expected ErrPingTimeout; got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the ping to end with its context; took: %v", elapsed)
+	}
+}
+
+func TestPoolPing(t *testing.T) {
+	pool := newTestPool(t)
+	if err := pool.Ping(); err != nil {
+		t.Errorf("ping: %v", err)
+	}
+
+	pool.Shutdown()
+	if err := pool.Ping(); !errors.Is(err, serpent.ErrNotInitialized) {
+		t.Errorf("expected ErrNotInitialized on a shut down pool; got: %v", err)
+	}
+}
+
+func TestRun_Dataclass(t *testing.T) {
+	// NamedTuples are encoded as arrays by the json module unless WithNamedTuplesAsObjects is set.
+	program := serpent.Program[int, json.RawMessage](`
+from dataclasses import dataclass
+from typing import NamedTuple
+
+class Point(NamedTuple):
+    x: int
+    y: int
+
+@dataclass
+class Box:
+    name: str
+    corner: Point
+    children: list
+
+def run(input):
+    return Box("outer", Point(input, 2), [Box("inner", Point(3, 4), [])])
+`)
+	result, err := serpent.Run(program, 1)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if exp := `{"name": "outer", "corner": [1, 2], "children": [{"name": "inner", "corner": [3, 4], "children": []}]}`; string(result) != exp {
+		t.Errorf("expected %s; got: %s", exp, result)
+	}
+}
+
+func TestNewPool_NamedTuplesAsObjects(t *testing.T) {
+	pool := newTestPool(t, serpent.WithNamedTuplesAsObjects())
+	exec, err := serpent.LoadPool(pool, serpent.Program[int, json.RawMessage](`
+from dataclasses import dataclass
+from typing import NamedTuple
+
+class Point(NamedTuple):
+    x: int
+    y: int
+
+@dataclass
+class Shape:
+    points: list
+
+def run(input):
+    return {"point": Point(input, 2), "shape": Shape([Point(3, 4)]), "pair": (5, 6)}
+`))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	result, err := exec.Run(1)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if exp := `{"point": {"x": 1, "y": 2}, "shape": {"points": [{"x": 3, "y": 4}]}, "pair": [5, 6]}`; string(result) != exp {
+		t.Errorf("expected %s; got: %s", exp, result)
+	}
+}
+
+func TestNewPool_BigIntAsString(t *testing.T) {
+	pool := newTestPool(t, serpent.WithBigIntAsString())
+	exec, err := serpent.LoadPool(pool, serpent.Program[serpent.BigInt, json.RawMessage](`
+def run(input):
+    return {"id": input, "ids": [-input, 2**53 - 1, 2**53], "small": 5, "flag": True}
+`))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	var input serpent.BigInt
+	input.Exp(big.NewInt(10), big.NewInt(30), nil)
+	raw, err := exec.Run(input)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if want := `{"id": "1000000000000000000000000000000", "ids": ["-1000000000000000000000000000000", 9007199254740991, "9007199254740992"], "small": 5, "flag": true}`; string(raw) != want {
+		t.Errorf("expected result %s; got: %s", want, raw)
+	}
+
+	var result struct {
+		ID    serpent.BigInt   `json:"id"`
+		IDs   []serpent.BigInt `json:"ids"`
+		Small serpent.BigInt   `json:"small"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if result.ID.Cmp(&input.Int) != 0 {
+		t.Errorf("expected id %v; got: %v", &input.Int, result.ID.Big())
+	}
+	if !result.IDs[1].IsInt64() || result.IDs[1].Int64() != 1<<53-1 {
+		t.Errorf("expected ids[1] %d; got: %v", int64(1<<53-1), result.IDs[1].Big())
+	}
+	if result.Small.Int64() != 5 {
+		t.Errorf("expected small 5; got: %v", result.Small.Big())
+	}
+
+	var invalid serpent.BigInt
+	if err := json.Unmarshal([]byte(`"1.5"`), &invalid); err == nil {
+		t.Errorf("expected an error decoding a non-integer")
+	}
+}
+
+// lockedBuffer is a bytes.Buffer which is safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestNewPool_ExactNumbers(t *testing.T) {
+	pool := newTestPool(t, serpent.WithExactNumbers())
+	// decimal is imported on a single worker, as it cannot be imported into several sub-interpreters on
+	// every Python version.
+	exec, err := serpent.LoadPool(pool, serpent.Program[string, json.RawMessage](`
+from decimal import Decimal
+from fractions import Fraction
+
+def run(input):
+    if input == "nan":
+        return Decimal("NaN")
+    return {"third": Fraction(1, 3), "tenth": Decimal("0.1"), "precise": Decimal("12345678901234567890.123456789")}
+`))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	raw, err := exec.Run("")
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if want := `{"third": "1/3", "tenth": "0.1", "precise": "12345678901234567890.123456789"}`; string(raw) != want {
+		t.Errorf("expected result %s; got: %s", want, raw)
+	}
+
+	var exact struct {
+		Third   serpent.Rat   `json:"third"`
+		Tenth   serpent.Rat   `json:"tenth"`
+		Precise serpent.Float `json:"precise"`
+	}
+	if err := json.Unmarshal(raw, &exact); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if exact.Third.Cmp(big.NewRat(1, 3)) != 0 {
+		t.Errorf("expected 1/3; got: %v", exact.Third.String())
+	}
+	if exact.Tenth.Cmp(big.NewRat(1, 10)) != 0 {
+		t.Errorf("expected 1/10; got: %v", exact.Tenth.String())
+	}
+	if s := exact.Precise.Text('f', 9); s != "12345678901234567890.123456789" {
+		t.Errorf("expected every digit to be kept; got: %s", s)
+	}
+
+	if _, err := exec.Run("nan"); !errors.Is(err, serpent.ErrResultNotSerializable) {
+		t.Errorf("expected ErrResultNotSerializable for a NaN decimal; got: %v", err)
+	}
+}
+
+func TestNewPool_DeadlockDetector(t *testing.T) {
+	var stderr lockedBuffer
+	serpent.SetStderr(&stderr)
+	defer serpent.SetStderr(nil)
+
+	pool := newTestPool(t, serpent.WithDeadlockDetector(200*time.Millisecond))
+	exec, err := serpent.LoadPool(pool, serpent.Program[float64, struct{}](`
+import time
+def run(input):
+    time.sleep(input)
+`))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	if _, err := exec.Run(0.05); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if s := stderr.String(); s != "" {
+		t.Fatalf("expected no report for a run which completes in time; got: %s", s)
+	}
+
+	if _, err := exec.Run(1); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	report := stderr.String()
+	for _, exp := range []string{"no request completed for", "running a request for", "in run", "goroutine "} {
+		if !contains(report, exp) {
+			t.Errorf("expected report containing %q; got: %s", exp, report)
+		}
+	}
+	if n := strings.Count(report, "no request completed for"); n != 1 {
+		t.Errorf("expected one report for the stall; got: %d", n)
+	}
+}
+
+func TestInitModelPool(t *testing.T) {
+	lib := testLib
+	program := serpent.Program[*struct{}, int](`
+runs = 0
+def run(input):
+    global runs
+    runs += 1
+    return runs
+`)
+	if _, err := serpent.InitModelPool(lib, 0, program); !errors.Is(err, serpent.ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for no replicas; got: %v", err)
+	}
+
+	models, err := serpent.InitModelPool(lib, 2, program)
+	if errors.Is(err, serpent.ErrAlreadyInitialized) {
+		t.Skip("additional pools require sub-interpreters")
+	}
+	if err != nil {
+		t.Fatalf("init model pool: %v", err)
+	}
+	if n := models.Capacity(); n != 2 {
+		t.Errorf("expected a capacity of 2; got: %d", n)
+	}
+
+	// Runs alternate between the replicas, each of which counts its own runs.
+	var results []int
+	for i := 0; i < 4; i++ {
+		result, err := models.Run(nil)
+		if err != nil {
+			t.Fatalf("run: %v", err)
+		}
+		results = append(results, result)
+	}
+	if exp := []int{1, 1, 2, 2}; !reflect.DeepEqual(results, exp) {
+		t.Errorf("expected runs %v; got: %v", exp, results)
+	}
+	if n := models.InFlight(); n != 0 {
+		t.Errorf("expected no runs in flight; got: %d", n)
+	}
+
+	if err := models.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if n := models.Capacity(); n != 0 {
+		t.Errorf("expected no capacity once closed; got: %d", n)
+	}
+	if _, err := models.Run(nil); !errors.Is(err, serpent.ErrNotInitialized) {
+		t.Errorf("expected ErrNotInitialized once closed; got: %v", err)
+	}
+}
+
+// newTestPool returns a pool created with opts which is shut down when the test completes, skipping the
+// test if additional pools are not supported.
+func newTestPool(tb testing.TB, opts ...serpent.Option) *serpent.Pool {
+	lib := testLib
+
+	pool, err := serpent.NewPool(lib, opts...)
+	if errors.Is(err, serpent.ErrAlreadyInitialized) {
+		tb.Skip("additional pools require sub-interpreters")
+	}
+	if err != nil {
+		tb.Fatalf("new pool: %v", err)
+	}
+	tb.Cleanup(func() { pool.Shutdown() })
+	return pool
+}
+
+func TestRun_DaemonThreads(t *testing.T) {
+	// An exception which merely mentions daemon threads is not mistaken for a disabled daemon thread.
+	program := serpent.Program[*struct{}, *struct{}]("def run(input): raise RuntimeError('no daemon thread available')")
+	if _, err := serpent.Run(program, nil); err == nil || errors.Is(err, serpent.ErrDaemonThreadsDisabled) {
+		t.Errorf("expected the RuntimeError alone; got: %v", err)
+	}
+
+	daemon := serpent.Program[*struct{}, bool](`
+import threading
+def run(input):
+    thread = threading.Thread(target=lambda: None, daemon=True)
+    thread.start()
+    thread.join()
+    return True
+`)
+	exec, err := serpent.LoadPool(newTestPool(t), daemon)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+	if _, err := exec.Run(nil); !errors.Is(err, serpent.ErrDaemonThreadsDisabled) {
+		t.Errorf("expected ErrDaemonThreadsDisabled in a sub-interpreter; got: %v", err)
+	}
+
+	exec, err = serpent.LoadPool(newTestPool(t, serpent.WithDaemonThreads()), daemon)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+	if _, err := exec.Run(nil); err != nil {
+		t.Errorf("run with daemon threads: %v", err)
+	}
+}
+
+func TestNewPool_Compression(t *testing.T) {
+	pool := newTestPool(t, serpent.WithCompression())
+	exec, err := serpent.LoadPool(pool, serpent.Program[[]string, map[string]int]("def run(input): return {s: len(s) for s in input}"))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+
+	result, err := exec.Run([]string{"a", "héllo", strings.Repeat("x", 1<<16)})
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	exp := map[string]int{"a": 1, "héllo": 5, strings.Repeat("x", 1<<16): 1 << 16}
+	if !reflect.DeepEqual(result, exp) {
+		t.Errorf("unexpected result")
+	}
+
+	if _, err := exec.RunJSON(json.RawMessage(`"abc"`)); err != nil {
+		t.Errorf("run JSON: %v", err)
+	}
+}
+
+func TestNewPool_CPULimit(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("CPU limits are only enforced on linux")
+	}
+	pool := newTestPool(t, serpent.WithCPULimit(100*time.Millisecond))
+
+	busy, err := serpent.LoadPool(pool, serpent.Program[*struct{}, struct{}]("def run(input):\n\twhile True: pass"))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer busy.Close()
+	if _, err := busy.Run(nil); !errors.Is(err, serpent.ErrCPULimitExceeded) {
+		t.Errorf("expected ErrCPULimitExceeded; got: %v", err)
+	}
+
+	// Waiting does not use CPU time, and the worker remains usable after exceeding the limit.
+	sleep, err := serpent.LoadPool(pool, serpent.Program[*struct{}, int]("import time\ndef run(input):\n\ttime.sleep(0.3)\n\treturn 1"))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer sleep.Close()
+	if result, err := sleep.Run(nil); err != nil || result != 1 {
+		t.Errorf("expected 1; got: %d, %v", result, err)
+	}
+}
+
+// BenchmarkRun_Compression compares running a program with a 20MB compressible input and result with and
+// without WithCompression.
+func BenchmarkRun_Compression(b *testing.B) {
+	program := serpent.Program[[]string, []string]("def run(input): return input")
+	input := make([]string, 20<<10)
+	for i := range input {
+		input[i] = strings.Repeat("serpent ", 127)
+	}
+	compressed, err := serpent.LoadPool(newTestPool(b, serpent.WithCompression()), program)
+	if err != nil {
+		b.Fatalf("load: %v", err)
+	}
+	defer compressed.Close()
+	plain, err := serpent.LoadPool(newTestPool(b), program)
+	if err != nil {
+		b.Fatalf("load: %v", err)
+	}
+	defer plain.Close()
+
+	for _, bm := range []struct {
+		name string
+		exec *serpent.Executable[[]string, []string]
+	}{{"Plain", plain}, {"Compressed", compressed}} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(20 << 20)
+			for i := 0; i < b.N; i++ {
+				if _, err := bm.exec.Run(input); err != nil {
+					b.Fatalf("run result: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestStop(t *testing.T) {
+	program := serpent.Program[*struct{}, string](`
+import _serpent_go, time
+
+def run(input):
+	while not _serpent_go.should_stop():
+		time.sleep(0.01)
+	return "stopped"
+`)
+	results := make(chan string)
+	go func() {
+		result, err := serpent.Run(program, nil)
+		if err != nil {
+			t.Errorf("run result: %v", err)
+		}
+		results <- result
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := serpent.Stop(5 * time.Second); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if result := <-results; result != "stopped" {
+		t.Errorf("unexpected result: %q; got: %q", "stopped", result)
+	}
+
+	result, err := serpent.Run(serpent.Program[*struct{}, bool]("import _serpent_go\ndef run(input): return _serpent_go.should_stop()"), nil)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if result {
+		t.Errorf("expected should_stop to be reset after Stop")
+	}
+}
+
+func TestStop_Interrupt(t *testing.T) {
+	program := serpent.Program[*struct{}, struct{}]("def run(input):\n\twhile True: pass")
+	errs := make(chan error)
+	go func() {
+		_, err := serpent.Run(program, nil)
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := serpent.Stop(50 * time.Millisecond); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if err := <-errs; !errors.Is(err, serpent.ErrInterrupted) {
+		t.Errorf("expected ErrInterrupted; got: %v", err)
+	}
+
+	if _, err := serpent.Run(serpent.Program[*struct{}, int]("def run(input): return 1"), nil); err != nil {
+		t.Errorf("run after interrupt: %v", err)
+	}
+}
+
+func TestRun_KeyboardInterrupt(t *testing.T) {
+	// A KeyboardInterrupt raised by the program itself is an ordinary exception, not an interrupt.
+	_, err := serpent.Run(serpent.Program[*struct{}, struct{}]("def run(input): raise KeyboardInterrupt('user')"), nil)
+	var pyErr *serpent.PythonError
+	if errors.Is(err, serpent.ErrInterrupted) || !errors.As(err, &pyErr) || pyErr.Type != "KeyboardInterrupt" {
+		t.Errorf("expected a KeyboardInterrupt PythonError; got: %v", err)
+	}
+
+	// The helpers do not shadow the serpent package on PyPI.
+	shadowed, err := serpent.Run(serpent.Program[*struct{}, bool]("import sys\ndef run(input): return 'serpent' in sys.modules"), nil)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if shadowed {
+		t.Errorf("expected no serpent module in sys.modules")
+	}
+}
+
+func TestExecutable_Interrupt(t *testing.T) {
+	exec, err := serpent.Load(serpent.Program[*struct{}, struct{}]("def run(input):\n\twhile True: pass"))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer exec.Close()
+	other, err := serpent.Load(serpent.Program[float64, int]("import time\ndef run(input):\n\ttime.sleep(input)\n\treturn 1"))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer other.Close()
+
+	// The run is interrupted once it is in flight.
+	errs := make(chan error)
+	go func() {
+		_, err := exec.Run(nil)
+		errs <- err
+	}()
+	for done := false; !done; {
+		if err := exec.Interrupt(); err != nil {
+			t.Fatalf("interrupt: %v", err)
+		}
+		select {
+		case err := <-errs:
+			if !errors.Is(err, serpent.ErrInterrupted) {
+				t.Fatalf("expected ErrInterrupted; got: %v", err)
+			}
+			done = true
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	// Runs of other executables, including on the same worker, are not interrupted.
+	results := make(chan error)
+	go func() {
+		_, err := other.Run(0.2)
+		results <- err
+	}()
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if err := exec.Interrupt(); err != nil {
+			t.Fatalf("interrupt: %v", err)
+		}
+	}
+	if err := <-results; err != nil {
+		t.Errorf("run of another executable: %v", err)
+	}
+}
+
+func TestNewPool(t *testing.T) {
+	lib := testLib
+
+	pool, err := serpent.NewPool(lib)
+	if errors.Is(err, serpent.ErrAlreadyInitialized) {
+		t.Skip("additional pools require sub-interpreters")
+	}
+	if err != nil {
+		t.Fatalf("new pool: %v", err)
+	}
+
+	program := serpent.Program[int, int](`
+count = 0
+
+def run(input):
+	global count
+	count += input
+	return count
+`)
+	exec, err := serpent.LoadPool(pool, program)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	for _, exp := range []int{2, 4} {
+		result, err := exec.Run(2)
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+		if result != exp {
+			t.Errorf("expected %d; got: %d", exp, result)
+		}
+	}
+	exec.Close()
+
+	if err := pool.Shutdown(); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := pool.Shutdown(); !errors.Is(err, serpent.ErrNotInitialized) {
+		t.Errorf("expected ErrNotInitialized on second shutdown; got: %v", err)
+	}
+	if n := pool.WorkerCount(); n != 0 {
+		t.Errorf("expected no workers after shutdown; got: %d", n)
+	}
+	if _, err := serpent.LoadPool(pool, program); !errors.Is(err, serpent.ErrNotInitialized) {
+		t.Errorf("expected ErrNotInitialized loading on a shut down pool; got: %v", err)
+	}
+
+	// The default pool is unaffected by shutting down another pool.
+	result, err := serpent.Run(program, 3)
+	if err != nil {
+		t.Fatalf("run result: %v", err)
+	}
+	if result != 3 {
+		t.Errorf("expected 3; got: %d", result)
+	}
+}
+
+func TestRunInSubprocess(t *testing.T) {
+	lib := testLib
+
+	serpenttest.RunInSubprocess(t, lib, func(t *testing.T) {
+		serpenttest.InitForTesting(t)
+		if path := os.Getenv("LIBPYTHON_PATH"); path != lib {
+			t.Errorf("expected LIBPYTHON_PATH %q; got: %q", lib, path)
+		}
+
+		program := serpent.Program[int, int]("def run(input): return input + 1")
+		result, err := serpent.Run(program, 1)
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+		if result != 2 {
+			t.Errorf("expected 2; got: %d", result)
+		}
+	})
+}
+
+// testLib is the path of the Python library, found by TestMain before any test changes LIBPYTHON_PATH.
+var testLib string
+
+// mainThread passes the functions given to onMainThread to TestMain, which runs them on the main thread.
+var mainThread = make(chan func())
+
+func init() {
+	// serpent.Main must be called from the main goroutine locked to the main thread.
+	if serpenttest.Subprocess() == "TestMainThread" {
+		runtime.LockOSThread()
+	}
+}
+
+// onMainThread runs fn on the main thread of the subprocess started by TestMainThread.
+func onMainThread(fn func()) {
+	done := make(chan struct{})
+	mainThread <- func() {
+		defer close(done)
+		fn()
+	}
+	<-done
+}
+
+// inSubprocess runs fn in a new process of the test binary, in which TestMain leaves serpent
+// uninitialized for fn to initialize with the options under test.
+func inSubprocess(t *testing.T, fn func(t *testing.T)) {
+	t.Helper()
+
+	lib := testLib
+	serpenttest.RunInSubprocess(t, lib, fn)
+}
+
+// initSubprocess initializes serpent with opts in a subprocess started by inSubprocess, closing it when
+// the test completes.
+func initSubprocess(t *testing.T, opts ...serpent.Option) {
+	t.Helper()
+
+	lib := testLib
+	if err := serpent.Init(lib, opts...); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	t.Cleanup(func() { serpent.Close() })
+}
+
+func TestDlopenFlags_Default(t *testing.T) {
+	// The library is opened with RTLD_GLOBAL by default, making its symbols globally visible.
+	if _, err := purego.Dlsym(purego.RTLD_DEFAULT, "Py_IsInitialized"); err != nil {
+		t.Errorf("expected Python symbols in the global namespace: %v", err)
+	}
+}
+
+func TestDlopenFlags(t *testing.T) {
+	inSubprocess(t, func(t *testing.T) {
+		initSubprocess(t, serpent.WithDlopenFlags(purego.RTLD_NOW|purego.RTLD_LOCAL))
+
+		if _, err := purego.Dlsym(purego.RTLD_DEFAULT, "Py_IsInitialized"); err == nil {
+			t.Errorf("expected no Python symbols in the global namespace with RTLD_LOCAL")
+		}
+		result, err := serpent.Run(serpent.Program[int, int]("def run(input): return input + 1"), 1)
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+		if result != 2 {
+			t.Errorf("expected 2; got: %d", result)
+		}
+	})
+}
+
+func TestMainThread(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("thread ids are only compared on linux")
+	}
+	inSubprocess(t, func(t *testing.T) {
+		lib := testLib
+
+		// On Linux the id of the main thread is the process id.
+		program := serpent.Program[*struct{}, bool]("import os, threading\ndef run(input): return threading.get_native_id() == os.getpid()")
+		var result bool
+		var err, runErr error
+		onMainThread(func() {
+			err = serpent.Main(lib, func() { result, runErr = serpent.Run(program, nil) })
+		})
+		if err != nil {
+			t.Fatalf("main: %v", err)
+		}
+		if runErr != nil {
+			t.Fatalf("run result: %v", runErr)
+		}
+		if !result {
+			t.Errorf("expected the program to run on the main thread")
+		}
+	})
+}
+
+func TestInitMode(t *testing.T) {
+	inSubprocess(t, func(t *testing.T) {
+		lib := testLib
+		if err := serpent.InitMode(lib, serpent.Mode(-1)); !errors.Is(err, serpent.ErrModeUnsupported) {
+			t.Fatalf("expected ErrModeUnsupported for an unknown mode; got: %v", err)
+		}
+
+		// Builds with a GIL are not free-threaded; the library is unloaded so that another mode can be
+		// initialized.
+		if err := serpent.InitMode(lib, serpent.ModeFreeThreaded); err == nil {
+			serpent.Close()
+			t.Skip("the library is a free-threaded build")
+		} else if !errors.Is(err, serpent.ErrModeUnsupported) {
+			t.Fatalf("expected ErrModeUnsupported for a build with a GIL; got: %v", err)
+		}
+
+		// Sub-interpreters are used even on a single CPU, and are unsupported before Python 3.12.
+		err := serpent.InitMode(lib, serpent.ModeSubInterpreters)
+		supported := err == nil
+		if errors.Is(err, serpent.ErrModeUnsupported) {
+			if n := serpent.WorkerCount(); n != 0 {
+				t.Errorf("expected no workers after an unsupported mode; got: %d", n)
+			}
+			err = serpent.InitMode(lib, serpent.ModeSingleWorker)
+		}
+		if err != nil {
+			t.Fatalf("init: %v", err)
+		}
+		defer serpent.Close()
+
+		if supported {
+			program := serpent.Program[*struct{}, bool](`
+try:
+    import _interpreters as interpreters
+except ImportError:
+    import _xxsubinterpreters as interpreters
+def run(_): return interpreters.get_current() != interpreters.get_main()
+`)
+			if sub, err := serpent.Run(program, nil); err != nil || !sub {
+				t.Errorf("expected the program to run in a sub-interpreter; got: %v, %v", sub, err)
+			}
+		}
+
+		result, err := serpent.Run(serpent.Program[int, int]("def run(input): return input + 1"), 1)
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+		if result != 2 {
+			t.Errorf("expected 2; got: %d", result)
+		}
+	})
+}
+
+func TestAttachExisting(t *testing.T) {
+	inSubprocess(t, func(t *testing.T) {
+		lib := testLib
+		if err := serpent.AttachExisting(lib); !errors.Is(err, serpent.ErrNotInitialized) {
+			t.Fatalf("expected ErrNotInitialized without a running interpreter; got: %v", err)
+		}
+
+		// The host initializes the interpreter on its own thread and releases the GIL for serpent.
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		handle, err := purego.Dlopen(lib, purego.RTLD_NOW|purego.RTLD_GLOBAL)
+		if err != nil {
+			t.Fatalf("dlopen: %v", err)
+		}
+		var initialize func(int32)
+		var isInitialized func() int32
+		var saveThread func() uintptr
+		var restoreThread func(uintptr)
+		var runSimpleString func(string) int32
+		purego.RegisterLibFunc(&initialize, handle, "Py_InitializeEx")
+		purego.RegisterLibFunc(&isInitialized, handle, "Py_IsInitialized")
+		purego.RegisterLibFunc(&saveThread, handle, "PyEval_SaveThread")
+		purego.RegisterLibFunc(&restoreThread, handle, "PyEval_RestoreThread")
+		purego.RegisterLibFunc(&runSimpleString, handle, "PyRun_SimpleString")
+		initialize(0)
+		runSimpleString("import builtins; builtins.host_value = 41")
+		state := saveThread()
+
+		if err := serpent.AttachExisting(lib); err != nil {
+			t.Fatalf("attach: %v", err)
+		}
+		result, err := serpent.Run(serpent.Program[int, int]("def run(input): return host_value + input"), 1)
+		if err != nil || result != 42 {
+			t.Errorf("expected the program to run in the host's interpreter; got: %d, %v", result, err)
+		}
+
+		// Closing detaches without finalizing the host's interpreter.
+		if err := serpent.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		restoreThread(state)
+		if isInitialized() == 0 {
+			t.Errorf("expected the host's interpreter to be left running")
+		}
+		if status := runSimpleString("assert host_value == 41"); status != 0 {
+			t.Errorf("expected the host's interpreter to remain usable")
+		}
+	})
+}
+
+func TestFreeThreaded(t *testing.T) {
+	inSubprocess(t, func(t *testing.T) {
+		lib, err := serpent.Lib(serpent.WithFreeThreaded())
+		if err != nil {
+			t.Fatalf("lib: %v", err)
+		}
+		err = serpent.InitMode(lib, serpent.ModeFreeThreaded)
+		if errors.Is(err, serpent.ErrModeUnsupported) {
+			t.Skip("the Python library is not a free-threaded build")
+		}
+		if err != nil {
+			t.Fatalf("init: %v", err)
+		}
+		defer serpent.Close()
+
+		// The workers run in the main interpreter without a GIL.
+		program := serpent.Program[*struct{}, bool](`
+import sys
+try:
+    import _interpreters as interpreters
+except ImportError:
+    import _xxsubinterpreters as interpreters
+def run(_): return not sys._is_gil_enabled() and interpreters.get_current() == interpreters.get_main()
+`)
+		if free, err := serpent.Run(program, nil); err != nil || !free {
+			t.Errorf("expected the program to run free-threaded in the main interpreter; got: %v, %v", free, err)
+		}
+
+		// Stop requests are recorded per thread, so stopping another pool sharing the interpreter is not
+		// seen by programs running in this one.
+		other, err := serpent.NewPool(lib, serpent.WithFreeThreaded())
+		if err != nil {
+			t.Fatalf("new pool: %v", err)
+		}
+		defer other.Shutdown()
+		program = serpent.Program[*struct{}, bool](`
+import _serpent_go, time
+def run(_):
+    end = time.monotonic() + 0.5
+    while time.monotonic() < end:
+        if _serpent_go.should_stop():
+            return True
+        time.sleep(0.01)
+    return False
+`)
+		stopped := make(chan bool)
+		go func() {
+			result, err := serpent.Run(program, nil)
+			if err != nil {
+				t.Errorf("run result: %v", err)
+			}
+			stopped <- result
+		}()
+		time.Sleep(100 * time.Millisecond)
+		if err := other.Stop(time.Second); err != nil {
+			t.Fatalf("stop: %v", err)
+		}
+		if <-stopped {
+			t.Errorf("expected the stop of another pool not to reach the program")
+		}
+	})
+}
+
+func TestInitTimeout(t *testing.T) {
+	// site imports sitecustomize from PYTHONPATH as each interpreter starts. The first sub-interpreter
+	// to do so sleeps, hanging its worker's initialization.
+	dir := t.TempDir()
+	sitecustomize := `
+import os, time
+try:
+    import _interpreters as interpreters
+except ImportError:
+    import _xxsubinterpreters as interpreters
+if interpreters.get_current() != interpreters.get_main():
+    try:
+        os.close(os.open(os.path.join(os.path.dirname(__file__), "hung"), os.O_CREAT | os.O_EXCL))
+        time.sleep(3)
+    except FileExistsError:
+        pass
+`
+	if err := os.WriteFile(filepath.Join(dir, "sitecustomize.py"), []byte(sitecustomize), 0o644); err != nil {
+		t.Fatalf("write sitecustomize: %v", err)
+	}
+	t.Setenv("PYTHONPATH", dir)
+	inSubprocess(t, func(t *testing.T) {
+		lib := testLib
+		start := time.Now()
+		err := serpent.InitMode(lib, serpent.ModeSubInterpreters, serpent.WithInitTimeout(500*time.Millisecond))
+		if errors.Is(err, serpent.ErrModeUnsupported) {
+			// Without sub-interpreters no worker runs sitecustomize in a sub-interpreter.
+			return
+		}
+		defer serpent.Close()
+		if !errors.Is(err, serpent.ErrInitTimeout) {
+			t.Fatalf("expected ErrInitTimeout; got: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("expected init to abandon the hung worker; took: %v", elapsed)
+		}
+
+		// Initialization continues with the remaining workers, if any.
+		if serpent.WorkerCount() > 0 {
+			result, err := serpent.Run(serpent.Program[int, int]("def run(input): return input + 1"), 1)
+			if err != nil || result != 2 {
+				t.Errorf("expected 2; got: %d, %v", result, err)
+			}
+		}
+
+		// Shutdown waits for the hung worker for the init timeout, then leaks it and leaves the
+		// interpreter running for later pools.
+		start = time.Now()
+		if err := serpent.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("expected close to leak the hung worker; took: %v", elapsed)
+		}
+		if err := serpent.InitMode(lib, serpent.ModeSubInterpreters); err != nil {
+			t.Fatalf("init after leak: %v", err)
+		}
+		result, err := serpent.Run(serpent.Program[int, int]("def run(input): return input + 1"), 1)
+		if err != nil || result != 2 {
+			t.Errorf("expected 2 after leak; got: %d, %v", result, err)
+		}
+	})
+}
+
+func TestJSONModule(t *testing.T) {
+	inSubprocess(t, func(t *testing.T) {
+		initSubprocess(t, serpent.WithJSONModule("orjson"), serpent.WithSortKeys(true))
+
+		available, err := serpent.Run(serpent.Program[*struct{}, bool]("import importlib.util\ndef run(input): return importlib.util.find_spec('orjson') is not None"), nil)
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+
+		// The raw result shows which module encoded it. Keys are sorted, and the json module escapes
+		// non-ASCII characters by default. Integer keys are converted to strings by both.
+		program := serpent.Program[map[string]any, json.RawMessage]("def run(input): return {'b': [input['n'], 'é'], 'a': None, 'c': {1: True}}")
+		result, err := serpent.Run(program, map[string]any{"n": 1})
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+		exp := `{"a": null, "b": [1, "\u00e9"], "c": {"1": true}}`
+		if available {
+			exp = `{"a":null,"b":[1,"é"],"c":{"1":true}}`
+		}
+		if string(result) != exp {
+			t.Errorf("expected %s (orjson available: %v); got: %s", exp, available, result)
+		}
+
+		if _, err := serpent.Run(serpent.Program[*struct{}, any]("def run(input): return object()"), nil); !errors.Is(err, serpent.ErrResultNotSerializable) {
+			t.Errorf("expected ErrResultNotSerializable; got: %v", err)
+		}
+
+		// Non-finite floats are rejected as by the json module, while None is still encoded as null.
+		for _, value := range []string{"float('nan')", "[None, {'x': float('inf')}]"} {
+			program := serpent.Program[*struct{}, any]("def run(input): return " + value)
+			if _, err := serpent.Run(program, nil); !errors.Is(err, serpent.ErrResultNotSerializable) {
+				t.Errorf("expected ErrResultNotSerializable for %s; got: %v", value, err)
+			}
+		}
+
+		// orjson passes NamedTuples to the default serializer, which encodes them as objects.
+		program = serpent.Program[map[string]any, json.RawMessage]("import collections\ndef run(input): return collections.namedtuple('Point', 'x y')(1, 2)")
+		if result, err = serpent.Run(program, nil); err != nil {
+			t.Fatalf("run named tuple: %v", err)
+		}
+		exp = `[1, 2]`
+		if available {
+			exp = `{"x":1,"y":2}`
+		}
+		if string(result) != exp {
+			t.Errorf("expected named tuple %s (orjson available: %v); got: %s", exp, available, result)
+		}
+	})
+}
+
+func TestJSONModule_Compression(t *testing.T) {
+	// The module marks the objects it decodes, showing which module decoded the input.
+	dir := t.TempDir()
+	module := "import json\ndumps = json.dumps\ndef loads(s):\n    return {**json.loads(s), 'decoder': 'probe'}\n"
+	if err := os.WriteFile(filepath.Join(dir, "serpent_json_probe.py"), []byte(module), 0o644); err != nil {
+		t.Fatalf("write module: %v", err)
+	}
+	t.Setenv("PYTHONPATH", dir)
+	inSubprocess(t, func(t *testing.T) {
+		// gzip corrupts the heap of sub-interpreters on some Python versions when they are finalized.
+		lib := testLib
+		if err := serpent.InitSingleWorker(lib, serpent.WithJSONModule("serpent_json_probe"), serpent.WithCompression()); err != nil {
+			t.Fatalf("init: %v", err)
+		}
+		defer serpent.Close()
+
+		program := serpent.Program[map[string]any, string]("def run(input): return input.get('decoder', 'json')")
+		result, err := serpent.Run(program, map[string]any{"n": 1})
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+		if result != "probe" {
+			t.Errorf("expected the compressed input to be decoded by the configured module; got: %q", result)
+		}
+	})
+}
+
+func TestInit_StdlibUnavailable(t *testing.T) {
+	t.Setenv("PYTHONHOME", t.TempDir())
+	inSubprocess(t, func(t *testing.T) {
+		lib := testLib
+		// Without the check the process would abort here.
+		if err := serpent.Init(lib); !errors.Is(err, serpent.ErrStdlibUnavailable) {
+			t.Fatalf("expected ErrStdlibUnavailable; got: %v", err)
+		}
+
+		// The library can be initialized once the environment is fixed.
+		os.Unsetenv("PYTHONHOME")
+		if err := serpent.Init(lib); err != nil {
+			t.Fatalf("init: %v", err)
+		}
+		defer serpent.Close()
+		if _, err := serpent.Run(serpent.Program[int, int]("def run(input): return input"), 1); err != nil {
+			t.Errorf("run result: %v", err)
+		}
+	})
+}
+
+func TestInitTry(t *testing.T) {
+	inSubprocess(t, func(t *testing.T) {
+		lib := testLib
+		missing := filepath.Join(t.TempDir(), "libpython3.so")
+		invalid := filepath.Join(t.TempDir(), "libpython3.so")
+		if err := os.WriteFile(invalid, []byte("not a library"), 0o644); err != nil {
+			t.Fatalf("write library: %v", err)
+		}
+
+		if _, err := serpent.InitTry([]string{missing, invalid}); !errors.Is(err, serpent.ErrLibraryNotFound) {
+			t.Fatalf("expected ErrLibraryNotFound; got: %v", err)
+		}
+
+		path, err := serpent.InitTry([]string{missing, invalid, lib})
+		if err != nil {
+			t.Fatalf("init: %v", err)
+		}
+		defer serpent.Close()
+		if path != lib {
+			t.Errorf("expected %q; got: %q", lib, path)
+		}
+
+		// No candidate is loaded once serpent is initialized.
+		if path, err := serpent.InitTry([]string{lib}); path != "" || !errors.Is(err, serpent.ErrAlreadyInitialized) {
+			t.Errorf("expected an empty path with ErrAlreadyInitialized; got: %q, %v", path, err)
+		}
+
+		result, err := serpent.Run(serpent.Program[int, int]("def run(input): return input + 1"), 1)
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+		if result != 2 {
+			t.Errorf("expected 2; got: %d", result)
+		}
+	})
+}
+
+func TestMemoryLimit(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("memory limits are only enforced on linux")
+	}
+	inSubprocess(t, func(t *testing.T) {
+		// The limit covers the address space of the whole process, so it is set above its current size.
+		status, err := os.ReadFile("/proc/self/status")
+		if err != nil {
+			t.Fatalf("read status: %v", err)
+		}
+		var size int
+		for _, line := range strings.Split(string(status), "\n") {
+			if strings.HasPrefix(line, "VmSize:") {
+				fmt.Sscanf(strings.TrimPrefix(line, "VmSize:"), "%d", &size)
+			}
+		}
+		if size == 0 {
+			t.Fatalf("no VmSize in status")
+		}
+
+		lib := testLib
+		if err := serpent.Init(lib, serpent.WithMemoryLimit(size<<10+1<<30)); err != nil {
+			t.Fatalf("init: %v", err)
+		}
+		defer serpent.Close()
+
+		exec, err := serpent.Load(serpent.Program[int, int]("def run(input): return len(bytearray(input))"))
+		if err != nil {
+			t.Fatalf("load: %v", err)
+		}
+		defer exec.Close()
+
+		if _, err := exec.Run(4 << 30); !errors.Is(err, serpent.ErrMemoryLimitExceeded) || !errors.Is(err, serpent.ErrRunFailed) {
+			t.Errorf("expected ErrMemoryLimitExceeded; got: %v", err)
+		}
+
+		// The worker continues to serve runs which stay within the limit.
+		result, err := exec.Run(1 << 20)
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+		if result != 1<<20 {
+			t.Errorf("expected %d; got: %d", 1<<20, result)
+		}
+	})
+}
+
+func TestMemoryLimit_RejectedPool(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("memory limits are only enforced on linux")
+	}
+	inSubprocess(t, func(t *testing.T) {
+		lib := testLib
+		if err := serpent.InitSingleWorker(lib); err != nil {
+			t.Fatalf("init: %v", err)
+		}
+		defer serpent.Close()
+
+		var before, after syscall.Rlimit
+		if err := syscall.Getrlimit(syscall.RLIMIT_AS, &before); err != nil {
+			t.Fatalf("get limit: %v", err)
+		}
+		// A pool rejected because serpent runs a single worker leaves the process's limit unchanged.
+		if _, err := serpent.NewPool(lib, serpent.WithMemoryLimit(1<<40)); !errors.Is(err, serpent.ErrAlreadyInitialized) {
+			t.Fatalf("expected ErrAlreadyInitialized; got: %v", err)
+		}
+		if err := syscall.Getrlimit(syscall.RLIMIT_AS, &after); err != nil {
+			t.Fatalf("get limit: %v", err)
+		}
+		if after != before {
+			t.Errorf("expected the limit to be unchanged at %+v; got: %+v", before, after)
+		}
+	})
+}
+
+func TestIsolated(t *testing.T) {
+	inSubprocess(t, func(t *testing.T) {
+		// Isolated mode ignores the environment, which would otherwise disable writing bytecode.
+		t.Setenv("PYTHONDONTWRITEBYTECODE", "1")
+		initSubprocess(t, serpent.WithIsolated())
+
+		program := serpent.Program[*struct{}, map[string]bool](`
+import sys
+def run(_):
+    return {
+        "isolated": sys.flags.isolated == 1,
+        "ignore_environment": sys.flags.ignore_environment == 1,
+        "no_user_site": sys.flags.no_user_site == 1,
+        "write_bytecode": not sys.dont_write_bytecode,
+    }
+`)
+		result, err := serpent.Run(program, nil)
+		if err != nil {
+			t.Fatalf("run result: %v", err)
+		}
+		for name, ok := range result {
+			if !ok {
+				t.Errorf("expected %s in isolated mode", name)
+			}
+		}
+	})
+}
+
+func TestSignalHandlers_Default(t *testing.T) {
+	// Python's SIGINT handler would replace the Go runtime's, so that signal.Notify never received it.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatalf("kill: %v", err)
+	}
+	select {
+	case <-signals:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Go to receive SIGINT")
+	}
+}
+
+func TestInstallSignalHandlers(t *testing.T) {
+	inSubprocess(t, func(t *testing.T) {
+		lib := testLib
+		if err := serpent.InitSingleWorker(lib, serpent.WithInstallSignalHandlers(true)); err != nil {
+			t.Fatalf("init: %v", err)
+		}
+		defer serpent.Close()
+
+		program := serpent.Program[*struct{}, bool](`
+import signal, time
+def run(_):
+    if signal.getsignal(signal.SIGINT) is not __import__("_serpent_go")._sigint:
+        return False
+    while True:
+        time.sleep(0.01)
+`)
+		time.AfterFunc(200*time.Millisecond, func() { syscall.Kill(os.Getpid(), syscall.SIGINT) })
+		if _, err := serpent.Run(program, nil); !errors.Is(err, serpent.ErrInterrupted) {
+			t.Errorf("expected the program to be interrupted by KeyboardInterrupt; got: %v", err)
+		}
+	})
+}
+
+func TestRun_Cache(t *testing.T) {
+	inSubprocess(t, func(t *testing.T) {
+		initSubprocess(t, serpent.WithCache(2))
+
+		// Each run which is not served from the cache returns a different token.
+		program := serpent.Program[string, string]("import os\ndef run(input): return os.urandom(8).hex()")
+		run := func(input string) string {
+			t.Helper()
+			result, err := serpent.Run(program, input)
+			if err != nil {
+				t.Fatalf("run result: %v", err)
+			}
+			return result
+		}
+
+		a, b := run("a"), run("b")
+		if a == b {
+			t.Fatalf("expected different results for different inputs")
+		}
+		if result := run("a"); result != a {
+			t.Errorf("expected cached result %q; got: %q", a, result)
+		}
+		if result, err := serpent.RunJSON(program, json.RawMessage(`"b"`)); err != nil || result != b {
+			t.Errorf("expected cached result %q from RunJSON; got: %q, %v", b, result, err)
+		}
+
+		// Running a third input evicts the least recently used result, a.
+		run("c")
+		if result := run("a"); result == a {
+			t.Errorf("expected the result for a to have been evicted")
+		}
+
+		b = run("b")
+		serpent.ClearCache()
+		if result := run("b"); result == b {
+			t.Errorf("expected the result for b to have been cleared")
+		}
+
+		// Results are not reused once the code transform changes.
+		b = run("b")
+		serpent.SetCodeTransform(func(code string) string { return "# transformed\n" + code })
+		defer serpent.SetCodeTransform(nil)
+		if result := run("b"); result == b {
+			t.Errorf("expected the result for b to be run again with the new transform")
+		}
+
+		// An input which implements Marshaler is passed with its own encoding, even when the input type is an
+		// interface, so its runs are not cached by the JSON encoding of the input.
+		marshaled := serpent.Program[any, string]("def run(input): return type(input).__name__ + ':' + input.hex()")
+		for _, input := range []rawInput{{0x01}, {0x02}} {
+			exp := "bytes:" + hex.EncodeToString(input)
+			if result, err := serpent.Run(marshaled, any(input)); err != nil || result != exp {
+				t.Errorf("expected %q for a Marshaler input; got: %q, %v", exp, result, err)
+			}
+		}
+
+		// Environment and Packages are not served from the cache, so changes to sys.path after the first
+		// call are seen.
+		if _, err := serpent.Environment(); err != nil {
+			t.Fatalf("environment: %v", err)
+		}
+		if _, err := serpent.Packages(); err != nil {
+			t.Fatalf("packages: %v", err)
+		}
+		dir := t.TempDir()
+		distInfo := filepath.Join(dir, "serpent_cached-1.0.dist-info")
+		if err := os.Mkdir(distInfo, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		metadata := "Metadata-Version: 2.1\nName: serpent-cached\nVersion: 1.0\n"
+		if err := os.WriteFile(filepath.Join(distInfo, "METADATA"), []byte(metadata), 0o644); err != nil {
+			t.Fatalf("write metadata: %v", err)
+		}
+		path := serpent.Program[string, struct{}]("import sys\ndef run(input): sys.path.append(input)")
+		for _, err := range serpent.Broadcast(path, dir) {
+			if err != nil {
+				t.Fatalf("broadcast: %v", err)
+			}
+		}
+		if env, err := serpent.Environment(); err != nil {
+			t.Fatalf("environment: %v", err)
+		} else if len(env.Path) == 0 || env.Path[len(env.Path)-1] != dir {
+			t.Errorf("expected %s at the end of the module search path; got: %v", dir, env.Path)
+		}
+		packages, err := serpent.Packages()
+		if err != nil {
+			t.Fatalf("packages: %v", err)
+		}
+		exp := serpent.PackageInfo{Name: "serpent-cached", Version: "1.0"}
+		for _, p := range packages {
+			if p == exp {
+				return
+			}
+		}
+		t.Errorf("expected %v in packages; got: %v", exp, packages)
+	})
+}
+
+func TestMain(m *testing.M) {
+	// Test that running without Init returns ErrNotInitialized. This is considered to be a test case
+	// but cannot be in its own test function as the library initialization is global.
+	program := serpent.Program[int, int]("def run(input): return input + 2")
+	if _, err := serpent.Run(program, 1); !errors.Is(err, serpent.ErrNotInitialized) {
+		fmt.Fprintf(os.Stderr, "expected ErrNotInitialized before Init; got: %v", err)
+		os.Exit(1)
+	}
+
+	var err error
+	testLib, err = serpent.Lib()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "set LIBPYTHON_PATH: %v", err)
+		os.Exit(1)
+	}
+
+	// Tests run in a subprocess initialize serpent themselves. The main goroutine runs the functions
+	// passed to onMainThread until they complete.
+	if serpenttest.Subprocess() != "" {
+		code := make(chan int)
+		go func() { code <- m.Run() }()
+		for {
+			select {
+			case fn := <-mainThread:
+				fn()
+			case code := <-code:
+				os.Exit(code)
+			}
+		}
+	}
+
+	if err := serpent.Init(testLib); err != nil && !errors.Is(err, serpent.ErrAlreadyInitialized) {
 		fmt.Fprintf(os.Stderr, "init: %v", err)
 		os.Exit(1)
 	}
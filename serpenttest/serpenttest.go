@@ -0,0 +1,108 @@
+// Package serpenttest provides helpers for testing code which uses serpent.
+//
+// The Python interpreter cannot be re-initialized with a different library within one process, so tests
+// which exercise several Python versions must run each version in its own process. [RunInSubprocess]
+// re-executes the current test binary with LIBPYTHON_PATH set to the requested library and runs only the
+// calling test there. [InitForTesting] initializes serpent for the tests of a binary which share one
+// interpreter.
+package serpenttest
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/adamkeys/serpent"
+)
+
+// subprocessEnv is set in the environment of a subprocess to the name of the test it should run.
+const subprocessEnv = "SERPENTTEST_SUBPROCESS"
+
+// InitForTesting initializes serpent's default pool with the library returned by serpent.Lib, which
+// reads LIBPYTHON_PATH or searches the standard locations, failing tb if it cannot be found or
+// initialized. Tests in one binary share the interpreter, so only the first call initializes it, with
+// opts; later calls find it already initialized and use it as it is, ignoring opts. Tests may therefore
+// each call InitForTesting, in any order, and a TestMain which initializes serpent itself is not needed.
+//
+// The interpreter stays initialized until the process exits, as it cannot be initialized again once
+// closed. The cleanup registered with tb instead checks that the default pool still has workers, failing
+// the test which left it without any, such as after a program crashed its worker, rather than the tests
+// which run after it.
+//
+//	func TestGreet(t *testing.T) {
+//		serpenttest.InitForTesting(t)
+//		result, err := serpent.Run(program, "world")
+//		...
+//	}
+func InitForTesting(tb testing.TB, opts ...serpent.Option) {
+	tb.Helper()
+
+	lib, err := serpent.Lib()
+	if err != nil {
+		tb.Fatalf("find python library: %v", err)
+	}
+	if err := serpent.Init(lib, opts...); err != nil && !errors.Is(err, serpent.ErrAlreadyInitialized) {
+		tb.Fatalf("init serpent with %s: %v", lib, err)
+	}
+	tb.Cleanup(func() {
+		if serpent.WorkerCount() == 0 {
+			tb.Errorf("serpent has no workers left after %s", tb.Name())
+		}
+	})
+}
+
+// RunInSubprocess runs fn in a new process of the current test binary with LIBPYTHON_PATH set to lib,
+// and fails t if the subprocess fails or skips t if fn skips the test there. The test binary's TestMain
+// is expected to initialize serpent using the library returned by serpent.Lib, which reads
+// LIBPYTHON_PATH, or, for tests which initialize serpent with options of their own, to leave it
+// uninitialized in a process started by RunInSubprocess, as reported by [Subprocess].
+//
+// The calling test is run again in the subprocess, where RunInSubprocess calls fn with the subprocess's
+// t instead of starting another process. Code in the test before RunInSubprocess therefore runs in both
+// processes, and a test should call RunInSubprocess at most once.
+//
+//	func TestPython312(t *testing.T) {
+//		serpenttest.RunInSubprocess(t, "/usr/lib/libpython3.12.so", func(t *testing.T) {
+//			// Runs with Python 3.12.
+//		})
+//	}
+func RunInSubprocess(t *testing.T, lib string, fn func(t *testing.T)) {
+	t.Helper()
+
+	if os.Getenv(subprocessEnv) == t.Name() {
+		fn(t)
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run="+testPattern(t.Name()), "-test.v")
+	cmd.Env = append(os.Environ(), subprocessEnv+"="+t.Name(), "LIBPYTHON_PATH="+lib)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("subprocess with %s: %v\n%s", lib, err, output)
+	}
+	if strings.Contains(string(output), "--- SKIP: "+t.Name()) {
+		t.Skipf("subprocess with %s skipped %s\n%s", lib, t.Name(), output)
+	}
+	if !strings.Contains(string(output), "--- PASS: "+t.Name()) {
+		t.Fatalf("subprocess with %s did not run %s\n%s", lib, t.Name(), output)
+	}
+}
+
+// Subprocess returns the name of the test which the current process was started by [RunInSubprocess] to
+// run, or an empty string if it was not started by RunInSubprocess.
+func Subprocess() string {
+	return os.Getenv(subprocessEnv)
+}
+
+// testPattern returns the -test.run pattern which matches only the named test. Each element of a subtest
+// name is matched separately.
+func testPattern(name string) string {
+	elems := strings.Split(name, "/")
+	for i, elem := range elems {
+		elems[i] = "^" + regexp.QuoteMeta(elem) + "$"
+	}
+	return strings.Join(elems, "/")
+}
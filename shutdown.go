@@ -0,0 +1,37 @@
+package serpent
+
+import "sync/atomic"
+
+// shutdownCode holds the Python code registered with OnWorkerShutdown, if any.
+var shutdownCode atomic.Pointer[string]
+
+// OnWorkerShutdown registers Python source code to run in each worker as it is shut down by
+// [Pool.Shutdown] or [Close], just before its interpreter is ended, so that programs which keep state
+// between runs can release external resources such as database connections or flush caches. The code runs
+// once per worker, after the worker's queued requests have completed, in a fresh namespace of the worker's
+// interpreter, where it can reach the state of programs through the modules they import. An exception
+// raised by the code is written to the writer registered with [SetStderr] and does not prevent the
+// shutdown. Calling OnWorkerShutdown again replaces the code, and an empty string removes it.
+//
+// Example:
+//
+//	serpent.OnWorkerShutdown("import mydb\nmydb.close_all()")
+func OnWorkerShutdown(code string) {
+	if code == "" {
+		shutdownCode.Store(nil)
+		return
+	}
+	shutdownCode.Store(&code)
+}
+
+// runShutdownCode runs the code registered with OnWorkerShutdown in the current interpreter, which must
+// hold the GIL.
+func (w *worker) runShutdownCode() {
+	code := shutdownCode.Load()
+	if code == nil {
+		return
+	}
+	if err := initWorker(*code); err != nil {
+		writeTraceback(err)
+	}
+}
@@ -0,0 +1,51 @@
+package serpent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkStdlib returns [ErrStdlibUnavailable] if PYTHONHOME is set but does not contain the standard
+// library of the Python version reported by Py_GetVersion, which CPython reports during initialization by
+// printing a fatal error, such as "unable to load the file system codec", and aborting the process. The
+// standard library is looked for in the lib and lib64 directories of the prefix, as a directory with
+// os.py and the encodings package or as a zip archive. Without PYTHONHOME the standard library is located
+// from the executable and the prefix compiled into the library, which cannot be known before
+// initialization, so it is not checked.
+func checkStdlib(version string) error {
+	home := os.Getenv("PYTHONHOME")
+	if home == "" {
+		return nil
+	}
+	major, minor, ok := parseVersion(version)
+	if !ok {
+		return nil
+	}
+
+	// PYTHONHOME is either the prefix or the prefix and exec prefix separated by the list separator.
+	prefix, _, _ := strings.Cut(home, string(os.PathListSeparator))
+	name := fmt.Sprintf("python%d.%d", major, minor)
+	for _, lib := range []string{"lib", "lib64"} {
+		dir := filepath.Join(prefix, lib, name)
+		if fileExists(filepath.Join(dir, "os.py")) && dirExists(filepath.Join(dir, "encodings")) {
+			return nil
+		}
+		if fileExists(filepath.Join(prefix, lib, fmt.Sprintf("python%d%d.zip", major, minor))) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: PYTHONHOME is %q but %s does not contain the standard library; unset PYTHONHOME "+
+		"or set it to the prefix of the loaded Python library", ErrStdlibUnavailable, home,
+		filepath.Join(prefix, "lib", name))
+}
+
+// dirExists returns true if the given path exists and is a directory.
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return info.IsDir()
+}
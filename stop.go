@@ -0,0 +1,139 @@
+package serpent
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ErrInterrupted is returned by runs which were interrupted by [Stop] because they did not stop within the
+// grace period.
+var ErrInterrupted = errors.New("interrupted")
+
+// Stop asks the programs running on the default pool to stop. See [Pool.Stop].
+func Stop(grace time.Duration) error {
+	if err := checkInit(); err != nil {
+		return err
+	}
+	return workerPool.Stop(grace)
+}
+
+// Stop asks the programs running in the pool to stop and waits for them to finish. Programs check for the
+// request with should_stop from the _serpent_go module, which is available to every program, so that
+// long-running and streaming programs can flush their output and clean up before returning:
+//
+//	import _serpent_go
+//
+//	def run(input):
+//	    while not _serpent_go.should_stop():
+//	        ...
+//
+// The request also applies to programs queued before Stop is called. Programs which are still running
+// after grace are interrupted by raising _serpent_go.Interrupted, a KeyboardInterrupt, in them, and their
+// runs fail with [ErrInterrupted]. A program which catches KeyboardInterrupt or is blocked in a call to a
+// C extension is not interrupted until it returns to Python code, and Stop waits for it. Once Stop
+// returns, should_stop reports false to later runs.
+func (p *Pool) Stop(grace time.Duration) error {
+	if p.closed.Load() {
+		return ErrNotInitialized
+	}
+
+	errs := make([]error, len(p.workers))
+	var wg sync.WaitGroup
+	for i, w := range p.workers {
+		if w.exited.Load() {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, w *worker) {
+			defer wg.Done()
+			if err := w.stop(grace); err != nil {
+				errs[i] = fmt.Errorf("worker %d: %w", w.id, err)
+			}
+		}(i, w)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// stop asks the program running on the worker to stop, interrupting it if it is still running after
+// grace. It returns once the requests queued before the call have completed.
+func (w *worker) stop(grace time.Duration) error {
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+
+	if err := w.withGIL(func() error {
+		return evalDiscard(fmt.Sprintf(`__import__("_serpent_go")._stopping.add(%d)`, w.thread))
+	}); err != nil {
+		return err
+	}
+
+	// The request is completed by the worker once the requests ahead of it have run. finished guards
+	// against interrupting a later run: it is set by the worker and read by the interrupt while each
+	// holds the GIL, and mu orders them on free-threaded builds.
+	var mu sync.Mutex
+	var finished bool
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.submit(&execContext{
+			call: func(pyObject) (string, error) {
+				mu.Lock()
+				finished = true
+				mu.Unlock()
+
+				pyThreadState_SetAsyncExc(w.thread, 0)
+				return "", evalDiscard(fmt.Sprintf(`__import__("_serpent_go")._stopping.discard(%d)`, w.thread))
+			},
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	w.withGIL(func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if finished {
+			return nil
+		}
+		return w.raiseAsync("Interrupted")
+	})
+	return <-done
+}
+
+// withGIL calls fn on the current goroutine while holding the GIL of the worker's interpreter, which the
+// worker holds only while it executes a request.
+func (w *worker) withGIL(fn func() error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if w.interp == 0 {
+		gstate := pyGILState_Ensure()
+		defer pyGILState_Release(gstate)
+		return fn()
+	}
+
+	tstate := pyThreadState_New(pyThreadState_GetInterpreter(w.interp))
+	pyEval_RestoreThread(tstate)
+	defer func() {
+		pyThreadState_Clear(tstate)
+		pyThreadState_DeleteCurrent()
+	}()
+	return fn()
+}
+
+// evalDiscard evaluates a Python expression for its side effects.
+func evalDiscard(expr string) error {
+	result := evalObject(expr, nil)
+	if result == 0 {
+		return fetchPythonError()
+	}
+	py_DecRef(result)
+	return nil
+}
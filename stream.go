@@ -0,0 +1,127 @@
+package serpent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// StreamItem is an item yielded by a program run with [RunStream].
+type StreamItem[TItem any] struct {
+	// Value is the item.
+	Value TItem
+	// Err is the error which ended the stream, or the error from decoding the item.
+	Err error
+}
+
+// RunStream runs a [Program] whose run() function returns an iterable, typically a generator, and sends
+// each item it yields on the returned channel as it is produced, so results can be consumed before the
+// program finishes. Each item is encoded as JSON and decoded into a TItem.
+//
+// The channel holds up to buffer items. When it is full the worker blocks until the consumer receives,
+// so a slow consumer holds the generator back rather than items accumulating in memory. The GIL is
+// released while the worker is blocked, so workers sharing it continue to run programs.
+//
+// The channel is closed once the iterable is exhausted. If the program fails, a final item carrying the
+// error is sent. Cancelling ctx stops the stream after the item being sent, closing the generator so
+// that its finally blocks run, and closes the channel; the consumer must otherwise receive from the
+// channel until it is closed.
+//
+// Example Python program:
+//
+//	def run(input):
+//	    for line in open(input):
+//	        yield line.upper()
+func RunStream[TInput, TItem any](ctx context.Context, program Program[TInput, TItem], arg TInput, buffer int) (<-chan StreamItem[TItem], error) {
+	if buffer < 0 {
+		return nil, fmt.Errorf("%w: negative stream buffer %d", ErrInvalidInput, buffer)
+	}
+	input, err := json.Marshal(arg)
+	if err != nil {
+		return nil, fmt.Errorf("marshal input: %w", err)
+	}
+	exec, err := Load(program)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(chan StreamItem[TItem], buffer)
+	go func() {
+		defer close(items)
+		defer exec.Close()
+
+		// send delivers an item with the GIL released, reporting whether the stream should continue.
+		send := func(data string) bool {
+			tstate := pyEval_SaveThread()
+			defer pyEval_RestoreThread(tstate)
+
+			var item StreamItem[TItem]
+			if err := json.Unmarshal([]byte(data), &item.Value); err != nil {
+				item.Err = fmt.Errorf("unmarshal item: %w", err)
+			}
+			select {
+			case items <- item:
+				return item.Err == nil
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		w := exec.worker
+		_, err := exec.dispatch(&execContext{
+			call: func(globals pyObject) (string, error) {
+				return "", streamRun(w, globals, string(input), send)
+			},
+		})
+		if err != nil {
+			select {
+			case items <- StreamItem[TItem]{Err: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return items, nil
+}
+
+// streamRun invokes the run function with the JSON input and passes each item of the iterable it returns
+// to send as JSON, until the iterable is exhausted or send returns false.
+func streamRun(w *worker, globals pyObject, jsonInput string, send func(string) bool) error {
+	runfn, err := runFunc(globals)
+	if err != nil {
+		return err
+	}
+	input, err := loadJSON(jsonInput)
+	if err != nil {
+		return err
+	}
+	result, err := invokeRun(w, runfn, input)
+	py_DecRef(input)
+	if err != nil {
+		return err
+	}
+	iter := pyObject_GetIter(result)
+	py_DecRef(result)
+	if iter == 0 {
+		return fetchPythonError()
+	}
+	// Releasing an unfinished generator closes it.
+	defer py_DecRef(iter)
+
+	for {
+		item := pyIter_Next(iter)
+		if item == 0 {
+			if pyErr_Occurred() != 0 {
+				return fetchPythonError()
+			}
+			return nil
+		}
+		data, err := dumpJSON(w, item)
+		py_DecRef(item)
+		if err != nil {
+			return err
+		}
+		if !send(data) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package serpent
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// setSwitchIntervalProgram sets the switch interval of a worker's GIL to the input in seconds.
+const setSwitchIntervalProgram = "import sys\ndef run(input): sys.setswitchinterval(input)"
+
+// switchIntervalProgram reports the switch interval of a worker's GIL in seconds.
+const switchIntervalProgram = "import sys\ndef run(input): return sys.getswitchinterval()"
+
+// SetSwitchInterval sets the GIL switch interval of every worker of the default pool. See
+// [Pool.SetSwitchInterval].
+func SetSwitchInterval(d time.Duration) error {
+	if err := checkInit(); err != nil {
+		return err
+	}
+	return workerPool.SetSwitchInterval(d)
+}
+
+// SetSwitchInterval sets the switch interval of the GIL held by each worker of the pool with
+// sys.setswitchinterval, waiting for runs already queued on each worker to complete first. The interval is
+// how long a thread holding the GIL runs before it is asked to release it to a waiting thread, 5ms by
+// default. When workers share a GIL, as in single worker mode and on Python versions before 3.12, a
+// shorter interval lets a worker which is waiting for the GIL start sooner, trading throughput for
+// latency. Python keeps the interval in microseconds, so d is truncated to a whole number of them.
+//
+// The interval is irrelevant to workers in sub-interpreters with their own GIL, which never wait on one
+// another; it then applies only between the threads started by a program within its worker. Free-threaded
+// builds have no GIL and ignore it. The returned error joins an error for each worker on which the interval
+// could not be set.
+func (p *Pool) SetSwitchInterval(d time.Duration) error {
+	if p.closed.Load() {
+		return ErrNotInitialized
+	}
+	if d < time.Microsecond {
+		return fmt.Errorf("%w: switch interval %v is less than 1µs", ErrInvalidInput, d)
+	}
+	_, errs := broadcast(p, Program[float64, struct{}](setSwitchIntervalProgram), d.Truncate(time.Microsecond).Seconds())
+	return joinWorkerErrors(p, errs)
+}
+
+// SwitchInterval returns the GIL switch interval of the default pool. See [Pool.SwitchInterval].
+func SwitchInterval() (time.Duration, error) {
+	if err := checkInit(); err != nil {
+		return 0, err
+	}
+	return workerPool.SwitchInterval()
+}
+
+// SwitchInterval returns the GIL switch interval of the pool, as reported by sys.getswitchinterval on one
+// of its workers. Workers with their own GIL each have an interval, which differ only if a program has set
+// one with sys.setswitchinterval.
+func (p *Pool) SwitchInterval() (time.Duration, error) {
+	if p.closed.Load() {
+		return 0, ErrNotInitialized
+	}
+	exec, err := LoadPool(p, Program[*struct{}, float64](switchIntervalProgram))
+	if err != nil {
+		return 0, err
+	}
+	defer exec.Close()
+
+	seconds, err := exec.Run(nil)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(math.Round(seconds*1e6)) * time.Microsecond, nil
+}
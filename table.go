@@ -0,0 +1,72 @@
+package serpent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidTable is returned when a result decoded as a [Table] is not an object of equal-length
+// columns.
+var ErrInvalidTable = errors.New("invalid table")
+
+// Table is a result type for column-oriented tables, such as the dict of lists returned by pandas'
+// DataFrame.to_dict("list"). Decoding a Table checks that the result is an object whose values are arrays
+// of equal length, so programs returning tabular data can be used without validating every result:
+//
+//	program := serpent.Program[string, serpent.Table[float64]](`
+//	import pandas
+//
+//	def run(input):
+//	    return pandas.read_csv(input).to_dict("list")
+//	`)
+//	table, err := serpent.Run(program, "prices.csv")
+type Table[T any] struct {
+	// Columns holds the names of the columns in the order the program returned them.
+	Columns []string
+	// Data holds the values of each column, keyed by name.
+	Data map[string][]T
+}
+
+// Len returns the number of rows in the table.
+func (t Table[T]) Len() int {
+	if len(t.Columns) == 0 {
+		return 0
+	}
+	return len(t.Data[t.Columns[0]])
+}
+
+// UnmarshalJSON implements json.Unmarshaler, failing with [ErrInvalidTable] if the columns differ in
+// length.
+func (t *Table[T]) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return fmt.Errorf("%w: expected an object of columns", ErrInvalidTable)
+	}
+
+	table := Table[T]{Data: make(map[string][]T)}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		name := tok.(string)
+
+		var column []T
+		if err := dec.Decode(&column); err != nil {
+			return fmt.Errorf("%w: column %q: %w", ErrInvalidTable, name, err)
+		}
+		if _, ok := table.Data[name]; !ok {
+			table.Columns = append(table.Columns, name)
+		}
+		table.Data[name] = column
+
+		if rows := len(table.Data[table.Columns[0]]); len(column) != rows {
+			return fmt.Errorf("%w: column %q has %d rows; expected %d", ErrInvalidTable, name, len(column), rows)
+		}
+	}
+
+	*t = table
+	return nil
+}
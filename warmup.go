@@ -0,0 +1,146 @@
+package serpent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// WarmupError is returned by [Warmup], [WarmupContext] and their pool equivalents when the program could not
+// be warmed up on every worker.
+type WarmupError struct {
+	// Completed holds the ids of the workers on which warmup completed successfully.
+	Completed []int
+	// Err describes why warmup did not complete on the remaining workers.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *WarmupError) Error() string {
+	return fmt.Sprintf("warmup completed on %d workers: %v", len(e.Completed), e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *WarmupError) Unwrap() error {
+	return e.Err
+}
+
+// Warmup runs the module body of a [Program] on every worker of the default pool so that its imports are
+// cached in each interpreter before the first run. See [WarmupContext].
+func Warmup[TInput, TResult any](program Program[TInput, TResult]) error {
+	return WarmupContext(context.Background(), program)
+}
+
+// WarmupContext runs the module body of a [Program] on every worker of the default pool concurrently so that
+// expensive imports, such as loading a machine learning library, are paid before the first run. The
+// module-level state of the warmup is discarded; only interpreter-wide state such as sys.modules is kept.
+// Workers which have exited are skipped. If ctx is cancelled before every worker completes, warmups which
+// have not started are abandoned and a [WarmupError] listing the workers which completed is returned. A
+// warmup which has already started runs to completion in the background.
+func WarmupContext[TInput, TResult any](ctx context.Context, program Program[TInput, TResult]) error {
+	if err := checkInit(); err != nil {
+		return err
+	}
+	return workerPool.warmup(ctx, generateCode(program))
+}
+
+// WarmupPool runs the module body of a [Program] on every worker of the given pool. It is the equivalent of
+// [Warmup] for pools created with [NewPool].
+func WarmupPool[TInput, TResult any](pool *Pool, program Program[TInput, TResult]) error {
+	return WarmupPoolContext(context.Background(), pool, program)
+}
+
+// WarmupPoolContext runs the module body of a [Program] on every worker of the given pool concurrently. It
+// is the equivalent of [WarmupContext] for pools created with [NewPool].
+func WarmupPoolContext[TInput, TResult any](ctx context.Context, pool *Pool, program Program[TInput, TResult]) error {
+	return pool.warmup(ctx, generateCode(program))
+}
+
+// warmup runs code on every worker of the pool which has not exited, as described by [WarmupContext].
+func (p *Pool) warmup(ctx context.Context, code string) error {
+	if p.closed.Load() {
+		return ErrNotInitialized
+	}
+
+	type result struct {
+		id  int
+		err error
+	}
+	abort := make(chan struct{})
+	results := make(chan result, len(p.workers))
+	var pending int
+	for _, w := range p.workers {
+		if w.exited.Load() {
+			continue
+		}
+		pending++
+		go func(w *worker) {
+			exec := &executable{code: code}
+			exec.pinTo(w)
+			defer exec.Close()
+			_, err := exec.dispatch(&execContext{
+				abort: abort,
+				call: func(pyObject) (string, error) {
+					return "", nil
+				},
+			})
+			results <- result{w.id, err}
+		}(w)
+	}
+
+	var completed []int
+	var errs []error
+	for i := 0; i < pending; i++ {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				errs = append(errs, fmt.Errorf("worker %d: %w", r.id, r.err))
+			} else {
+				completed = append(completed, r.id)
+			}
+		case <-ctx.Done():
+			close(abort)
+			return &WarmupError{Completed: completed, Err: ctx.Err()}
+		}
+	}
+
+	if len(errs) > 0 {
+		return &WarmupError{Completed: completed, Err: errors.Join(errs...)}
+	}
+	return nil
+}
+
+// warmImportProgram imports the module named by its input.
+const warmImportProgram = "import importlib\ndef run(input): importlib.import_module(input)"
+
+// WarmImports imports each of the named modules on every worker of the default pool. See
+// [Pool.WarmImports].
+func WarmImports(modules []string) []error {
+	if err := checkInit(); err != nil {
+		return []error{err}
+	}
+	return workerPool.WarmImports(modules)
+}
+
+// WarmImports imports each of the named modules, such as "pandas" or "torch", on every worker of the pool
+// so that programs loaded later, whose dependencies are known but whose code is not, do not pay for cold
+// imports on their first run. Unlike [Warmup] it needs no program. Modules are imported in order, each on
+// every worker concurrently. The returned slice holds an error for each module which failed to import on a
+// worker, identifying both and wrapping the [PythonError] raised by the import; it is empty when every
+// import succeeded.
+func (p *Pool) WarmImports(modules []string) []error {
+	if p.closed.Load() {
+		return []error{ErrNotInitialized}
+	}
+
+	var errs []error
+	for _, module := range modules {
+		_, results := broadcast(p, Program[string, struct{}](warmImportProgram), module)
+		for i, err := range results {
+			if err != nil {
+				errs = append(errs, fmt.Errorf("worker %d: import %s: %w", p.workers[i].id, module, err))
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package serpent
+
+import "os"
+
+// setThreadWorkdir changes the working directory of the process on platforms other than Linux, where
+// threads cannot have their own working directory.
+func setThreadWorkdir(dir string) error {
+	return os.Chdir(dir)
+}
+
+// threadWorkdir reports whether setThreadWorkdir gives the calling thread its own working directory.
+const threadWorkdir = false
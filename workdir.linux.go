@@ -0,0 +1,19 @@
+//go:build linux
+
+package serpent
+
+import "syscall"
+
+// setThreadWorkdir changes the working directory of the calling thread, which must be locked to its
+// goroutine, without affecting the rest of the process. The thread is given its own filesystem attributes
+// with unshare(CLONE_FS), which threads it starts share, so it must not be returned to the Go runtime
+// afterwards; see releaseThread.
+func setThreadWorkdir(dir string) error {
+	if err := syscall.Unshare(syscall.CLONE_FS); err != nil {
+		return err
+	}
+	return syscall.Chdir(dir)
+}
+
+// threadWorkdir reports whether setThreadWorkdir gives the calling thread its own working directory.
+const threadWorkdir = true